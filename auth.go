@@ -0,0 +1,46 @@
+package tftp
+
+import (
+	"strings"
+)
+
+// TokenAuth returns a Handler which authenticates requests using a token
+// embedded in each requested filename, before passing them to h.
+//
+// The filename must begin with prefix, followed by the token, a slash, and
+// the name of the file being requested, such as "token/abc123/boot/file" for
+// a prefix of "token/".  If validate reports that the token is valid, h is
+// called with a copy of the request whose filename is the name following the
+// token.  Otherwise, an ERROR packet with ErrorCodeNoSuchUser is sent to the
+// client.
+func TokenAuth(prefix string, validate func(token string) bool, h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		token, filename, ok := splitToken(prefix, r.Filename)
+		if !ok || !validate(token) {
+			_ = w.WriteError(ErrorCodeNoSuchUser, "invalid token")
+			_ = w.Close()
+			return
+		}
+
+		rr := *r
+		rr.Filename = filename
+		h.ServeTFTP(w, &rr)
+	})
+}
+
+// splitToken splits a filename beginning with prefix into its token and the
+// filename following the token.  If the filename does not contain a token,
+// splitToken returns false.
+func splitToken(prefix string, filename string) (string, string, bool) {
+	if !strings.HasPrefix(filename, prefix) {
+		return "", "", false
+	}
+
+	rest := filename[len(prefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 {
+		return "", "", false
+	}
+
+	return rest[:i], rest[i+1:], true
+}
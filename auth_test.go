@@ -0,0 +1,82 @@
+package tftp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestTokenAuth verifies that TokenAuth passes requests with a valid token to
+// its Handler, with the token removed from the filename, and rejects any
+// other requests.
+func TestTokenAuth(t *testing.T) {
+	var tests = []struct {
+		description string
+		filename    string
+		served      string
+		err         *ErrorPacket
+	}{
+		{
+			description: "valid token",
+			filename:    "token/secret/boot/file",
+			served:      "boot/file",
+		},
+		{
+			description: "invalid token",
+			filename:    "token/guess/boot/file",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeNoSuchUser,
+				ErrorMsg:  "invalid token",
+			},
+		},
+		{
+			description: "missing token",
+			filename:    "boot/file",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeNoSuchUser,
+				ErrorMsg:  "invalid token",
+			},
+		},
+		{
+			description: "empty token",
+			filename:    "token//boot/file",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeNoSuchUser,
+				ErrorMsg:  "invalid token",
+			},
+		},
+	}
+
+	validate := func(token string) bool {
+		return token == "secret"
+	}
+
+	for i, tt := range tests {
+		var served string
+		h := TokenAuth("token/", validate, HandlerFunc(func(w ResponseWriter, r *Request) {
+			served = r.Filename
+		}))
+
+		w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+		r := &Request{Opcode: OpcodeRead, Filename: tt.filename}
+		h.ServeTFTP(w, r)
+
+		if want, got := tt.served, served; want != got {
+			t.Fatalf("[%02d] test %q, unexpected filename: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.err, w.err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		// The original request is not modified
+		if want, got := tt.filename, r.Filename; want != got {
+			t.Fatalf("[%02d] test %q, request modified: %q != %q",
+				i, tt.description, want, got)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package tftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultClientTimeout is the amount of time a Client waits for each
+	// packet from a server, unless Client.Timeout is set.
+	defaultClientTimeout = 5 * time.Second
+
+	// defaultClientRetries is the number of times a Client retransmits a
+	// packet without a reply from a server, unless Client.MaxRetries is set.
+	defaultClientRetries = 5
+
+	// maxIdleSockets is the largest number of idle sockets retained by a
+	// Client for reuse.
+	maxIdleSockets = 4
+)
+
+// errUnexpectedPacket is returned when a Client receives a packet which it
+// does not expect, such as a DATA packet for the wrong block.
+var errUnexpectedPacket = errors.New("tftp: unexpected packet")
+
+// A Client is a TFTP client, which transfers files in octet mode without
+// negotiating any options.  The zero value is a usable Client.  A Client is
+// safe for concurrent use by multiple goroutines.
+type Client struct {
+	// Timeout is the amount of time to wait for each packet from a server
+	// before the last packet sent to the server is retransmitted.  The
+	// default value is 5 seconds.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a packet is retransmitted without a
+	// reply from the server before a transfer fails.  The default value is
+	// 5.  If MaxRetries is negative, packets are never retransmitted.
+	MaxRetries int
+
+	// ReuseSockets specifies whether or not the socket used for a transfer
+	// which completes successfully is retained and used to send a later
+	// request, rather than binding a new socket for each request.  This is
+	// useful when fetching many files from the same server.
+	ReuseSockets bool
+
+	// mu guards idle.
+	mu   sync.Mutex
+	idle []net.PacketConn
+}
+
+// Get retrieves the named file from the server at addr, and writes its
+// content to w.  It returns the number of bytes written to w.  If the server
+// rejects the request, the returned error is an *ErrorPacket.
+func (c *Client) Get(addr string, filename string, w io.Writer) (int64, error) {
+	return c.GetContext(context.Background(), addr, filename, w)
+}
+
+// GetContext is like Get, but the transfer is aborted if ctx is canceled or
+// expires before it is complete, in which case the socket used for the
+// transfer is closed, and ctx.Err() is returned.
+func (c *Client) GetContext(ctx context.Context, addr string, filename string, w io.Writer) (int64, error) {
+	t, err := c.request(ctx, OpcodeRead, addr, filename)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := t.get(w)
+	return n, c.finish(ctx, t, err)
+}
+
+// Put sends the content of r to the server at addr, to be stored as the named
+// file.  If the server rejects the request, the returned error is an
+// *ErrorPacket.
+func (c *Client) Put(addr string, filename string, r io.Reader) error {
+	return c.PutContext(context.Background(), addr, filename, r)
+}
+
+// PutContext is like Put, but the transfer is aborted if ctx is canceled or
+// expires before it is complete, in which case the socket used for the
+// transfer is closed, and ctx.Err() is returned.
+func (c *Client) PutContext(ctx context.Context, addr string, filename string, r io.Reader) error {
+	t, err := c.request(ctx, OpcodeWrite, addr, filename)
+	if err != nil {
+		return err
+	}
+
+	return c.finish(ctx, t, t.put(r))
+}
+
+// request sends a request with the specified opcode for the named file to the
+// server at addr, and returns a clientTransfer used to complete it.
+func (c *Client) request(ctx context.Context, op Opcode, addr string, filename string) (*clientTransfer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.socket()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+
+	retries := c.MaxRetries
+	switch {
+	case retries == 0:
+		retries = defaultClientRetries
+	case retries < 0:
+		retries = 0
+	}
+
+	// A reused socket may still have the deadline of its previous transfer
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	t := &clientTransfer{
+		ctx:     ctx,
+		conn:    conn,
+		timeout: timeout,
+		retries: retries,
+		buf:     make([]byte, 4+DefaultBlockSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	// Interrupt any operation in progress once ctx is done
+	go func() {
+		defer close(t.stopped)
+
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-t.done:
+		}
+	}()
+
+	b := make([]byte, 2, 2+len(filename)+1+len(ModeOctet)+1)
+	binary.BigEndian.PutUint16(b[0:2], uint16(op))
+	b = append(b, filename...)
+	b = append(b, 0)
+	b = append(b, ModeOctet...)
+	b = append(b, 0)
+
+	// The request is retransmitted to the server's listening address until
+	// the server first replies
+	t.last, t.lastAddr = b, raddr
+	if _, err := conn.WriteTo(b, raddr); err != nil {
+		return nil, c.finish(ctx, t, err)
+	}
+
+	return t, nil
+}
+
+// finish ends the transfer t, which returned err.  If the transfer succeeded,
+// its socket may be retained for reuse.  Otherwise, the socket is closed, and
+// ctx.Err() is returned if ctx is done.
+func (c *Client) finish(ctx context.Context, t *clientTransfer, err error) error {
+	// Once the goroutine watching ctx stops, it can no longer interrupt
+	// the socket, so the socket is safe to reuse if ctx is not done
+	close(t.done)
+	<-t.stopped
+
+	if cerr := ctx.Err(); cerr != nil {
+		_ = t.conn.Close()
+		return cerr
+	}
+	if err != nil {
+		_ = t.conn.Close()
+		return err
+	}
+
+	c.release(t.conn)
+	return nil
+}
+
+// socket returns an idle socket for reuse, if one is available, or binds a new
+// socket.
+func (c *Client) socket() (net.PacketConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	return net.ListenPacket("udp", ":0")
+}
+
+// release retains conn for reuse, if ReuseSockets is set and the client does
+// not already retain too many idle sockets.  Otherwise, conn is closed.
+func (c *Client) release(conn net.PacketConn) {
+	if c.ReuseSockets {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if len(c.idle) < maxIdleSockets {
+			c.idle = append(c.idle, conn)
+			return
+		}
+	}
+
+	_ = conn.Close()
+}
+
+// CloseIdleSockets closes any sockets retained for reuse by c.
+func (c *Client) CloseIdleSockets() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, conn := range c.idle {
+		_ = conn.Close()
+	}
+	c.idle = nil
+}
+
+// clientTransfer is the client side of a single transfer.  Once the server
+// replies, all further packets are sent to the server's transfer ID, and
+// packets from any other address are ignored.
+type clientTransfer struct {
+	ctx     context.Context
+	conn    net.PacketConn
+	addr    net.Addr
+	timeout time.Duration
+	retries int
+	buf     []byte
+
+	// The last packet sent, and the address it was sent to, which are sent
+	// again if the server does not reply
+	last     []byte
+	lastAddr net.Addr
+
+	// done is closed once the transfer is complete, to stop watching ctx,
+	// and stopped is closed once ctx is no longer watched
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// get receives the content of a file from the server, and writes it to w.
+func (t *clientTransfer) get(w io.Writer) (int64, error) {
+	var n int64
+	for block := uint16(1); ; block++ {
+		data, err := t.readDATA(block)
+		if err != nil {
+			return n, err
+		}
+
+		wn, err := w.Write(data)
+		n += int64(wn)
+		if err != nil {
+			_ = t.write(errorPacket(ErrorCodeUndefined, err.Error()))
+			return n, err
+		}
+
+		if err := t.write(clientACK(block)); err != nil {
+			return n, err
+		}
+
+		// A short block ends the transfer
+		if len(data) < DefaultBlockSize {
+			return n, nil
+		}
+	}
+}
+
+// put sends the content of r to the server.
+func (t *clientTransfer) put(r io.Reader) error {
+	if err := t.readACK(0); err != nil {
+		return err
+	}
+
+	b := make([]byte, 4+DefaultBlockSize)
+	binary.BigEndian.PutUint16(b[0:2], uint16(opcodeDATA))
+
+	// The final block is always shorter than the block size, even if it
+	// must be empty
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(r, b[4:])
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+		default:
+			_ = t.write(errorPacket(ErrorCodeUndefined, err.Error()))
+			return err
+		}
+
+		binary.BigEndian.PutUint16(b[2:4], block)
+		if err := t.write(b[:4+n]); err != nil {
+			return err
+		}
+		if err := t.readACK(block); err != nil {
+			return err
+		}
+
+		if n < DefaultBlockSize {
+			return nil
+		}
+	}
+}
+
+// write sends b to the server's transfer ID.  b is retained, and must not be
+// modified until the next packet is sent.
+func (t *clientTransfer) write(b []byte) error {
+	t.last, t.lastAddr = b, t.addr
+	_, err := t.conn.WriteTo(b, t.addr)
+	return err
+}
+
+// read reads a single packet from the server, ignoring packets from any
+// address other than the server's transfer ID, if it is known.  If the server
+// does not reply before the timeout expires, the last packet sent is sent
+// again, up to the maximum number of retries.
+func (t *clientTransfer) read() ([]byte, net.Addr, error) {
+	for retries := 0; ; retries++ {
+		b, addr, err := t.readTimeout()
+		if err == nil {
+			return b, addr, nil
+		}
+		if !isTimeout(err) || retries >= t.retries || t.ctx.Err() != nil {
+			return nil, nil, err
+		}
+
+		// The expired deadline also applies to writes
+		if err := t.conn.SetWriteDeadline(time.Now().Add(t.timeout)); err != nil {
+			return nil, nil, err
+		}
+		if _, err := t.conn.WriteTo(t.last, t.lastAddr); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// readTimeout reads a single packet from the server, waiting at most for the
+// transfer's timeout.
+func (t *clientTransfer) readTimeout() ([]byte, net.Addr, error) {
+	if err := t.conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+		return nil, nil, err
+	}
+
+	// ctx must be checked after the deadline is set, so that a cancelation
+	// which interrupted a previous deadline is not missed
+	if err := t.ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		n, addr, err := t.conn.ReadFrom(t.buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if t.addr != nil && addr.String() != t.addr.String() {
+			continue
+		}
+
+		return t.buf[:n], addr, nil
+	}
+}
+
+// readDATA reads a DATA packet with the specified block number, returning its
+// data.  If the server sends the previous block again, the acknowledgement of
+// that block is sent again.
+func (t *clientTransfer) readDATA(block uint16) ([]byte, error) {
+	for {
+		b, addr, err := t.read()
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := parseDATAPacket(b)
+
+		// The server's transfer ID is taken from its first reply.  A
+		// reused socket may receive stray packets from the transfer
+		// which used it previously, and they are ignored.
+		if t.addr == nil {
+			if err == nil && p.Block != block {
+				continue
+			}
+			t.addr = addr
+		}
+
+		if err != nil {
+			return nil, limitErrorMessage(err, 0)
+		}
+
+		switch p.Block {
+		case block:
+			return p.Data, nil
+		case block - 1:
+			if err := t.write(clientACK(p.Block)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errUnexpectedPacket
+		}
+	}
+}
+
+// readACK reads an ACK packet with the specified block number.  Duplicate ACKs
+// of the previous block are ignored.
+func (t *clientTransfer) readACK(block uint16) error {
+	for {
+		b, addr, err := t.read()
+		if err != nil {
+			return err
+		}
+
+		p, err := parseACKPacket(b)
+
+		// As with readDATA, stray packets are ignored until the server
+		// first replies
+		if t.addr == nil {
+			if err == nil && p.Block != block {
+				continue
+			}
+			t.addr = addr
+		}
+
+		if err != nil {
+			return limitErrorMessage(err, 0)
+		}
+
+		switch p.Block {
+		case block:
+			return nil
+		case block - 1:
+			// A duplicate of the previous ACK, which may be sent
+			// again if the server retransmits, is ignored
+			continue
+		default:
+			return errUnexpectedPacket
+		}
+	}
+}
+
+// clientACK creates an ACK packet for the specified block number.
+func clientACK(block uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], uint16(opcodeACK))
+	binary.BigEndian.PutUint16(b[2:4], block)
+	return b
+}
+
+// errorPacket creates an ERROR packet with the specified code and message.
+func errorPacket(code ErrorCode, msg string) []byte {
+	b, _ := (&ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: code,
+		ErrorMsg:  msg,
+	}).MarshalBinary()
+
+	return b
+}
@@ -0,0 +1,274 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestClientGetPut verifies that a Client retrieves and sends files of
+// various sizes.
+func TestClientGetPut(t *testing.T) {
+	var tests = []struct {
+		description string
+		content     []byte
+	}{
+		{
+			description: "empty file",
+		},
+		{
+			description: "partial block",
+			content:     []byte("hello"),
+		},
+		{
+			description: "exactly one block",
+			content:     bytes.Repeat([]byte("a"), DefaultBlockSize),
+		},
+		{
+			description: "several blocks",
+			content:     bytes.Repeat([]byte("abc"), 1000),
+		},
+	}
+
+	for i, tt := range tests {
+		content := tt.content
+		puts := make(chan []byte, 1)
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				if r.Opcode == OpcodeRead {
+					_ = ServeContent(w, r, bytes.NewReader(content))
+					return
+				}
+
+				var buf bytes.Buffer
+				_, _ = ReceiveContent(w, r, &buf)
+				_ = w.Close()
+				puts <- buf.Bytes()
+			}),
+			DisableDally: true,
+		}
+
+		addr, done := testServe(t, s)
+		c := &Client{}
+
+		var got bytes.Buffer
+		n, err := c.Get(addr.String(), "foo", &got)
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected Get error: %v", i, tt.description, err)
+		}
+		if err := c.Put(addr.String(), "foo", bytes.NewReader(tt.content)); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected Put error: %v", i, tt.description, err)
+		}
+		done()
+
+		if want, got := int64(len(tt.content)), n; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.content, got.Bytes(); !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content retrieved", i, tt.description)
+		}
+		if want, got := tt.content, <-puts; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content sent", i, tt.description)
+		}
+	}
+}
+
+// TestClientGetError verifies that a Client returns an *ErrorPacket when a
+// server rejects a request.
+func TestClientGetError(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+			_ = w.Close()
+		}),
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	_, err := (&Client{}).Get(addr.String(), "foo", ioutil.Discard)
+	if p, ok := err.(*ErrorPacket); !ok || p.ErrorCode != ErrorCodeFileNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestClientReuseSockets verifies that a Client sends later requests using the
+// socket of a completed transfer, if ReuseSockets is set.
+func TestClientReuseSockets(t *testing.T) {
+	addrs := make(chan string, 2)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			addrs <- r.RemoteAddr
+			_ = ServeContent(w, r, bytes.NewReader([]byte("hello")))
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c := &Client{ReuseSockets: true}
+	defer c.CloseIdleSockets()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(addr.String(), "foo", ioutil.Discard); err != nil {
+			t.Fatalf("[%02d] unexpected error: %v", i, err)
+		}
+	}
+
+	if want, got := <-addrs, <-addrs; want != got {
+		t.Fatalf("socket was not reused: %v != %v", want, got)
+	}
+}
+
+// TestClientGetContextCancel verifies that canceling the context passed to
+// Client.GetContext stops a transfer in progress promptly.
+func TestClientGetContextCancel(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			// 100 blocks take at least 5 seconds to send
+			w.SetMinBlockInterval(50 * time.Millisecond)
+			_ = ServeContent(w, r, bytes.NewReader(make([]byte, 100*DefaultBlockSize)))
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	n, err := (&Client{}).GetContext(ctx, addr.String(), "foo", ioutil.Discard)
+	if want, got := context.Canceled, err; want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	if d := time.Since(start); d > 1*time.Second {
+		t.Fatalf("transfer was not stopped promptly: %v", d)
+	}
+	if n == 0 || n >= 100*DefaultBlockSize {
+		t.Fatalf("transfer was not stopped mid-download: %d bytes", n)
+	}
+}
+
+// TestClientRetransmit verifies that a Client sends its last packet again if
+// a server does not reply before the timeout expires.
+func TestClientRetransmit(t *testing.T) {
+	addr, wait := testClientServer(t, func(c net.PacketConn) error {
+		block1 := append([]byte{0, 3, 0, 1}, make([]byte, DefaultBlockSize)...)
+
+		// Ignore the first request and the first acknowledgement of the
+		// first block, so that each is sent again
+		script := []struct {
+			want, reply []byte
+		}{
+			{want: testRRQ("foo")},
+			{want: testRRQ("foo"), reply: block1},
+			{want: []byte{0, 4, 0, 1}},
+			{want: []byte{0, 4, 0, 1}, reply: append([]byte{0, 3, 0, 2}, "hello"...)},
+			{want: []byte{0, 4, 0, 2}},
+		}
+
+		buf := make([]byte, 1500)
+		for i, p := range script {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(p.want, buf[:n]) {
+				return fmt.Errorf("unexpected packet %d: %v", i, buf[:n])
+			}
+
+			if p.reply == nil {
+				continue
+			}
+			if _, err := c.WriteTo(p.reply, addr); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	c := &Client{Timeout: 50 * time.Millisecond}
+
+	var got bytes.Buffer
+	if _, err := c.Get(addr.String(), "foo", &got); err != nil {
+		t.Fatalf("unexpected Get error: %v", err)
+	}
+	if want, got := DefaultBlockSize+len("hello"), got.Len(); want != got {
+		t.Fatalf("unexpected number of bytes: %v != %v", want, got)
+	}
+
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientPutDuplicateACK verifies that a Client ignores a duplicate
+// acknowledgement of the previous block while sending a file.
+func TestClientPutDuplicateACK(t *testing.T) {
+	addr, wait := testClientServer(t, func(c net.PacketConn) error {
+		buf := make([]byte, 1500)
+		for _, replies := range [][][]byte{
+			// WRQ
+			{{0, 4, 0, 0}},
+			// DATA block 1, which the server acknowledges after
+			// acknowledging the request again
+			{{0, 4, 0, 0}, {0, 4, 0, 1}},
+		} {
+			_, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+
+			for _, r := range replies {
+				if _, err := c.WriteTo(r, addr); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	c := &Client{Timeout: 1 * time.Second}
+	if err := c.Put(addr.String(), "foo", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("unexpected Put error: %v", err)
+	}
+
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClientServer starts a scripted server on a loopback address, which
+// replies to a Client using fn.  It returns the address of the server and a
+// function which waits for fn to return, and then stops the server.
+func testClientServer(t *testing.T, fn func(c net.PacketConn) error) (net.Addr, func() error) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- fn(c)
+	}()
+
+	return c.LocalAddr(), func() error {
+		defer c.Close()
+		return <-errC
+	}
+}
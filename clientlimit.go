@@ -0,0 +1,80 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+)
+
+// PerClientLimit returns a Handler which permits each client IP address to
+// have at most n transfers in progress with h at once.  Requests from a
+// client which already has n transfers in progress are rejected with an
+// ERROR packet with ErrorCodeUndefined.  If n is zero or less, requests are
+// always passed to h.
+//
+// A transfer is no longer counted once h returns, even if h panics.
+func PerClientLimit(n int, h Handler) Handler {
+	if n <= 0 {
+		return h
+	}
+
+	l := &clientLimiter{
+		n:      n,
+		active: make(map[string]int),
+	}
+
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		host := clientHost(r.RemoteAddr)
+		if !l.acquire(host) {
+			_ = w.WriteError(ErrorCodeUndefined, "too many transfers")
+			_ = w.Close()
+			return
+		}
+		defer l.release(host)
+
+		h.ServeTFTP(w, r)
+	})
+}
+
+// clientLimiter counts the number of transfers in progress for each client.
+type clientLimiter struct {
+	n int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire reports whether or not host may begin another transfer, and if so,
+// counts the transfer as in progress.
+func (l *clientLimiter) acquire(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[host] >= l.n {
+		return false
+	}
+
+	l.active[host]++
+	return true
+}
+
+// release ends a transfer for host which was counted by acquire.
+func (l *clientLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active[host]--
+	if l.active[host] <= 0 {
+		delete(l.active, host)
+	}
+}
+
+// clientHost returns the host portion of a client's address, or the entire
+// address if it does not contain a port.
+func clientHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
@@ -0,0 +1,105 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestPerClientLimit verifies that PerClientLimit rejects a request from a
+// client which already has the maximum number of transfers in progress, while
+// permitting requests from other clients.
+func TestPerClientLimit(t *testing.T) {
+	const n = 3
+
+	var (
+		started = make(chan struct{})
+		unblock = make(chan struct{})
+		served  int
+		mu      sync.Mutex
+	)
+
+	h := PerClientLimit(n, HandlerFunc(func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		served++
+		mu.Unlock()
+
+		started <- struct{}{}
+		<-unblock
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			h.ServeTFTP(&captureResponseWriter{buf: bytes.NewBuffer(nil)}, &Request{
+				RemoteAddr: net.JoinHostPort("192.0.2.1", strconv.Itoa(i+1)),
+			})
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-started
+	}
+
+	// Another transfer from the same IP address, but a different port, is
+	// rejected
+	w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+	h.ServeTFTP(w, &Request{RemoteAddr: "192.0.2.1:9"})
+
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeUndefined,
+		ErrorMsg:  "too many transfers",
+	}
+	if got := w.err; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected ERROR for transfer over limit:\n- want: %v\n-  got: %v",
+			want, got)
+	}
+
+	// A transfer from another IP address is permitted
+	go h.ServeTFTP(&captureResponseWriter{buf: bytes.NewBuffer(nil)}, &Request{
+		RemoteAddr: "192.0.2.2:1",
+	})
+	<-started
+
+	close(unblock)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want, got := n+1, served; want != got {
+		t.Fatalf("unexpected number of transfers served: %v != %v", want, got)
+	}
+}
+
+// TestPerClientLimitPanic verifies that PerClientLimit stops counting a
+// transfer whose handler panics.
+func TestPerClientLimitPanic(t *testing.T) {
+	var served int
+	h := PerClientLimit(1, HandlerFunc(func(w ResponseWriter, r *Request) {
+		served++
+		panic("handler panic")
+	}))
+
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() { _ = recover() }()
+
+			w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+			h.ServeTFTP(w, &Request{RemoteAddr: "192.0.2.1:1"})
+
+			if w.err != nil {
+				t.Fatalf("[%02d] unexpected ERROR after handler panic: %v", i, w.err)
+			}
+		}()
+	}
+
+	if want, got := 2, served; want != got {
+		t.Fatalf("unexpected number of transfers served: %v != %v", want, got)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/mdlayher/tftp"
 )
@@ -70,21 +69,17 @@ func (h *Handler) ServeTFTP(w tftp.ResponseWriter, r *tftp.Request) {
 	}
 
 	log.Printf(" serving: [%s] %q, %d bytes", r.RemoteAddr, r.Filename, s.Size())
-	start := time.Now()
 
-	// Begin copying file to client
-	if _, err := io.Copy(w, f); err != nil && err != io.EOF {
-		log.Println(err)
-		return
-	}
-
-	// Flush any remaining buffered bytes
-	if err := w.Flush(); err != nil {
+	// Copy file to client, flushing any remaining buffered bytes once the
+	// entire file is read
+	if _, err := io.Copy(w, f); err != nil {
 		log.Println(err)
 		return
 	}
 
 	// Close server's socket for this client
 	_ = w.Close()
-	log.Printf("complete: [%s] %q, %d bytes in %s", r.RemoteAddr, r.Filename, s.Size(), time.Now().Sub(start))
+
+	stats := w.Stats()
+	log.Printf("complete: [%s] %q, %d bytes in %s", r.RemoteAddr, r.Filename, s.Size(), stats.EndTime.Sub(stats.StartTime))
 }
@@ -0,0 +1,312 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	// optionOffset is a non-standard option which allows a client to
+	// request that a transfer begin at a byte offset within a file.
+	optionOffset = "offset"
+
+	// optionResumeOffset is a non-standard option which allows a client to
+	// resume an interrupted transfer in a new request, beginning at a byte
+	// offset which is a multiple of the block size.
+	optionResumeOffset = "resume-offset"
+)
+
+// ServeContent replies to a request using the content from the input
+// io.Reader, and flushes any remaining data to the client once the
+// io.Reader returns io.EOF.
+//
+// If the client requests the non-standard "offset" option and content
+// implements io.Seeker or io.ReaderAt, the transfer begins at the requested
+// byte offset within content, and the offset is acknowledged to the client.
+// Any transfer size acknowledged to the client remains the size of all of
+// content.  If content implements neither interface, the option is ignored.
+// An offset beyond the end of content results in an ERROR packet being sent
+// to the client, and an error being returned.
+//
+// If the client requests the non-standard "resume-offset" option in octet
+// mode, and content implements io.Seeker or io.ReaderAt, the transfer
+// resumes at the requested byte offset, and the offset is acknowledged to the
+// client.  The offset must be a multiple of the transfer's block size, and
+// blocks are numbered as if the preceding content had been sent in the same
+// transfer: the first DATA block is numbered offset / blocksize + 1, wrapping
+// around modulo 65536, and the client must expect that block number instead
+// of 1.  If both options are requested, only resume-offset is honored.
+//
+// If the client requests the transfer size using the tsize option from RFC
+// 2349, and content reports its size using a Size method, as is the case for
+// *io.SectionReader and *bytes.Reader, the size is acknowledged to the
+// client in octet mode.  A transfer size already set in the options by a
+// previous handler is not replaced.
+func ServeContent(w ResponseWriter, r *Request, content io.Reader) error {
+	if _, ok := r.Options[optionTransferSize]; ok && r.Mode == ModeOctet {
+		if sc, ok := content.(sizer); ok {
+			if _, ok := w.Options()[optionTransferSize]; !ok {
+				w.Options()[optionTransferSize] = strconv.FormatInt(sc.Size(), 10)
+			}
+		}
+	}
+
+	var resumed bool
+	if v, ok := r.Options[optionResumeOffset]; ok && r.Mode == ModeOctet {
+		rc, err := resumeContent(w, content, v)
+		if err != nil {
+			writeError(w, err)
+			return err
+		}
+
+		if rc != nil {
+			content = rc
+			w.Options()[optionResumeOffset] = v
+			resumed = true
+		}
+	}
+
+	if v, ok := r.Options[optionOffset]; ok && !resumed {
+		rc, err := seekContent(content, v)
+		if err != nil {
+			writeError(w, err)
+			return err
+		}
+
+		if rc != nil {
+			content = rc
+			w.Options()[optionOffset] = v
+
+			// The skipped content counts towards any advertised
+			// transfer size, which remains the size of all content
+			if sk, ok := w.(skipper); ok {
+				off, _ := strconv.ParseInt(v, 10, 64)
+				sk.skip(off)
+			}
+		}
+	}
+
+	if _, err := io.Copy(w, content); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// sizer is implemented by content which reports its size in bytes.
+type sizer interface {
+	Size() int64
+}
+
+// ServeStreaming replies to a request using content which is generated while
+// it is sent, and whose size is not known in advance, such as a rendered
+// template.  The transfer size option from RFC 2349 is always declined, even
+// if it was set by a previous handler, so the client is not told a size.
+// Data is flushed to the client once content returns io.EOF.
+func ServeStreaming(w ResponseWriter, r *Request, content io.Reader) error {
+	delete(w.Options(), optionTransferSize)
+
+	if _, err := io.Copy(w, content); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// ServeChannel replies to a request using content received from ch, which is
+// generated by a producer while it is sent, such as a stream of events.  Each
+// slice received from ch is written to w, which frames the content into
+// blocks, and data is flushed to the client once ch is closed.  As with
+// ServeStreaming, the transfer size option from RFC 2349 is always declined.
+//
+// If a write fails, ServeChannel returns the error without draining ch.
+func ServeChannel(w ResponseWriter, ch <-chan []byte) error {
+	delete(w.Options(), optionTransferSize)
+
+	for b := range ch {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// ServeBlocks replies to a request using the content provided by src, one
+// block at a time.  The default ResponseWriter reads each block from src
+// directly into the DATA packet which is sent to the client, without any
+// additional buffering.  Any other ResponseWriter, such as one which
+// performs netascii conversions, receives each block using Write, in blocks
+// of DefaultBlockSize bytes.
+//
+// If src returns an error, ServeBlocks returns it without sending an ERROR
+// packet, so a handler can choose how to abort the transfer.
+func ServeBlocks(w ResponseWriter, src BlockSource) error {
+	if bs, ok := w.(blockServer); ok {
+		return bs.serveBlocks(src)
+	}
+
+	return copyBlocks(src, DefaultBlockSize, w.Write, w.Flush)
+}
+
+// blockServer is implemented by ResponseWriters which can send the content
+// of a BlockSource directly.
+type blockServer interface {
+	serveBlocks(src BlockSource) error
+}
+
+// copyBlocks reads blocks of up to size bytes from src and passes each to
+// write, until src reports its final block or returns a short block, and
+// then calls flush.
+func copyBlocks(src BlockSource, size int, write func(p []byte) (int, error), flush func() error) error {
+	buf := make([]byte, size)
+	for block := uint16(1); ; block++ {
+		n, last, err := src.ReadBlock(block, buf)
+		if err != nil {
+			return err
+		}
+
+		if _, err := write(buf[:n]); err != nil {
+			return err
+		}
+
+		if last || n < size {
+			return flush()
+		}
+	}
+}
+
+// errCannotReceive is returned when a ResponseWriter cannot be used to
+// receive content from a client.
+var errCannotReceive = errors.New("tftp: ResponseWriter cannot receive content")
+
+// ReceiveContent accepts a write request, and copies the content sent by the
+// client to dst, returning the number of bytes written.  If dst returns an
+// error, the transfer is aborted with an ERROR packet chosen by ErrorFromOS,
+// and the error is returned.  For example, an error which wraps
+// syscall.ENOSPC is reported to the client with ErrorCodeDiskFull.
+//
+// A handler may reject a write request without acknowledging it by calling
+// WriteError instead of ReceiveContent.
+func ReceiveContent(w ResponseWriter, r *Request, dst io.Writer) (int64, error) {
+	rw, ok := w.(receiver)
+	if !ok || r.Opcode != OpcodeWrite {
+		return 0, errCannotReceive
+	}
+
+	return rw.receive(dst)
+}
+
+// errInvalidOffset is returned when a client requests an offset which is not
+// valid for the content being served.
+var errInvalidOffset = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeBadOptions,
+	ErrorMsg:  "invalid offset",
+}
+
+// resumer is implemented by ResponseWriters which can resume a transfer at a
+// byte offset, numbering blocks as if the preceding content had been sent.
+type resumer interface {
+	resume(off int64) error
+}
+
+// skipper is implemented by ResponseWriters which can account for content
+// skipped using the offset option.
+type skipper interface {
+	skip(off int64)
+}
+
+// resumeContent returns an io.Reader which begins at the offset specified by
+// string v within content, and prepares w to resume the transfer at that
+// offset.  If w cannot resume a transfer or content cannot seek,
+// resumeContent returns a nil io.Reader and no error.
+func resumeContent(w ResponseWriter, content io.Reader, v string) (io.Reader, error) {
+	rs, ok := w.(resumer)
+	if !ok {
+		return nil, nil
+	}
+
+	rc, err := seekContent(content, v)
+	if err != nil || rc == nil {
+		return nil, err
+	}
+
+	// seekContent already verified that the offset is valid
+	off, _ := strconv.ParseInt(v, 10, 64)
+	if err := rs.resume(off); err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// seekContent returns an io.Reader which begins at the offset specified by
+// string v within content.  If content cannot seek, seekContent returns a nil
+// io.Reader and no error.
+func seekContent(content io.Reader, v string) (io.Reader, error) {
+	off, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || off < 0 {
+		return nil, errInvalidOffset
+	}
+
+	switch c := content.(type) {
+	case io.Seeker:
+		// Determine the size of content to verify the offset does not
+		// extend beyond its end
+		size, err := c.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if off > size {
+			return nil, errInvalidOffset
+		}
+
+		if _, err := c.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return content, nil
+	case io.ReaderAt:
+		// If the byte preceding the offset cannot be read, the offset is
+		// beyond the end of content
+		if off > 0 {
+			if _, err := c.ReadAt(make([]byte, 1), off-1); err != nil {
+				return nil, errInvalidOffset
+			}
+		}
+
+		return io.NewSectionReader(c, off, math.MaxInt64-off), nil
+	}
+
+	return nil, nil
+}
+
+// writeError sends an ERROR packet to a client using w.  If err is an
+// *ErrorPacket, its code and message are sent.  Otherwise, an undefined
+// error is sent with the message from err.
+func writeError(w ResponseWriter, err error) {
+	if e, ok := err.(*ErrorPacket); ok {
+		_ = w.WriteError(e.ErrorCode, e.ErrorMsg)
+		return
+	}
+
+	_ = w.WriteError(ErrorCodeUndefined, err.Error())
+}
+
+// errorReporter is implemented by ResponseWriters which can report errors
+// which occur in a handler using the server's Errors channel.
+type errorReporter interface {
+	reportError(err error)
+}
+
+// reportHandlerError reports err using the server which created w, if w
+// supports it.  It is used by the handlers in this package to record the
+// details of errors which should not be revealed to clients.
+func reportHandlerError(w ResponseWriter, err error) {
+	if er, ok := w.(errorReporter); ok {
+		er.reportError(err)
+	}
+}
@@ -0,0 +1,340 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestServeContentSectionReader verifies that ServeContent sends exactly the
+// bytes within an io.SectionReader, and reports the section's length as the
+// transfer size.
+func TestServeContentSectionReader(t *testing.T) {
+	full := make([]byte, 4096)
+	for i := range full {
+		full[i] = byte(i)
+	}
+	section := io.NewSectionReader(bytes.NewReader(full), 1500, 1000)
+
+	w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+	r := &Request{
+		Opcode:   OpcodeRead,
+		Filename: "part.img",
+		Mode:     ModeOctet,
+		Options: map[string]string{
+			"tsize": "0",
+		},
+	}
+
+	if err := ServeContent(w, r, section); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "1000", w.Options()["tsize"]; want != got {
+		t.Fatalf("unexpected transfer size: %q != %q", want, got)
+	}
+	if want, got := full[1500:2500], w.buf.Bytes(); !bytes.Equal(want, got) {
+		t.Fatalf("unexpected content:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// TestServeContentOffset verifies that ServeContent begins a transfer at the
+// offset requested by a client, or returns an error for an invalid offset.
+func TestServeContentOffset(t *testing.T) {
+	var tests = []struct {
+		description string
+		offset      string
+		reads       []testRead
+		writes      [][]byte
+		err         error
+	}{
+		{
+			description: "offset 0, entire content sent",
+			offset:      "0",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes: [][]byte{
+				append([]byte{0, 6}, "offset\x000\x00"...),
+				append([]byte{0, 3, 0, 1}, "hello world"...),
+			},
+		},
+		{
+			description: "offset 6, partial content sent",
+			offset:      "6",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes: [][]byte{
+				append([]byte{0, 6}, "offset\x006\x00"...),
+				append([]byte{0, 3, 0, 1}, "world"...),
+			},
+		},
+		{
+			description: "offset 20, beyond end of content",
+			offset:      "20",
+			writes: [][]byte{
+				append([]byte{0, 5, 0, 8}, "invalid offset\x00"...),
+			},
+			err: errInvalidOffset,
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+		r := &Request{
+			Opcode:   OpcodeRead,
+			Filename: "hello.txt",
+			Mode:     ModeOctet,
+			Options: map[string]string{
+				"offset": tt.offset,
+			},
+		}
+
+		err := ServeContent(w, r, bytes.NewReader([]byte("hello world")))
+		if want, got := tt.err, err; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServeContentResumeOffset verifies that ServeContent resumes a transfer
+// at the offset requested by a client, numbering blocks from the offset, or
+// returns an error for an offset which is not a multiple of the block size.
+func TestServeContentResumeOffset(t *testing.T) {
+	content := make([]byte, DefaultBlockSize*3+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	var tests = []struct {
+		description string
+		offset      string
+		reads       []testRead
+		writes      [][]byte
+		err         error
+	}{
+		{
+			description: "offset 1024, blocks 3 and 4 sent",
+			offset:      "1024",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 3}},
+				{b: []byte{0, 4, 0, 4}},
+			},
+			writes: [][]byte{
+				append([]byte{0, 6}, "resume-offset\x001024\x00"...),
+				append([]byte{0, 3, 0, 3}, content[1024:1536]...),
+				append([]byte{0, 3, 0, 4}, content[1536:]...),
+			},
+		},
+		{
+			description: "offset 100, not a multiple of the block size",
+			offset:      "100",
+			writes: [][]byte{
+				append([]byte{0, 5, 0, 8}, "invalid offset\x00"...),
+			},
+			err: errInvalidOffset,
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+		r := &Request{
+			Opcode:   OpcodeRead,
+			Filename: "file.bin",
+			Mode:     ModeOctet,
+			Options: map[string]string{
+				"resume-offset": tt.offset,
+			},
+		}
+
+		err := ServeContent(w, r, bytes.NewReader(content))
+		if want, got := tt.err, err; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServeStreaming verifies that a client which requests the transfer size
+// still completes a transfer when ServeStreaming declines to send it.
+func TestServeStreaming(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+			_ = ServeStreaming(w, r, strings.NewReader("hello"))
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b := append(testRRQ("foo"), "tsize\x000\x00blksize\x00512\x00"...)
+	if _, err := c.WriteTo(b, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the block size is acknowledged
+		if oack, err := parseOACKPacket(buf[:n]); err == nil {
+			want := map[string]string{"blksize": "512"}
+			if got := oack.Options; !reflect.DeepEqual(want, got) {
+				t.Fatalf("unexpected options:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			if _, err := c.WriteTo([]byte{0, 4, 0, 0}, raddr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		data, err := parseDATAPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := "hello", string(data.Data); want != got {
+			t.Fatalf("unexpected data: %q != %q", want, got)
+		}
+
+		if _, err := c.WriteTo([]byte{0, 4, 0, 1}, raddr); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+}
+
+// TestServeChannel verifies that ServeChannel sends the content of each slice
+// received from a channel, in order, until the channel is closed.
+func TestServeChannel(t *testing.T) {
+	chunks := [][]byte{
+		[]byte("hello"),
+		nil,
+		bytes.Repeat([]byte("a"), DefaultBlockSize),
+		bytes.Repeat([]byte("b"), 3*DefaultBlockSize/2),
+		[]byte("world"),
+	}
+
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			ch := make(chan []byte)
+			go func() {
+				defer close(ch)
+				for _, c := range chunks {
+					ch <- c
+				}
+			}()
+
+			_ = ServeChannel(w, ch)
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	var got bytes.Buffer
+	if _, err := (&Client{}).Get(addr.String(), "foo", &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bytes.Join(chunks, nil); !bytes.Equal(want, got.Bytes()) {
+		t.Fatalf("unexpected content: %d bytes != %d bytes", len(want), got.Len())
+	}
+}
+
+// TestReceiveContentDiskFull verifies that a client receives an ERROR packet
+// with ErrorCodeDiskFull when the destination passed to ReceiveContent
+// reports that a disk is full.
+func TestReceiveContentDiskFull(t *testing.T) {
+	var tests = []struct {
+		description string
+		err         error
+	}{
+		{
+			description: "ENOSPC",
+			err:         syscall.ENOSPC,
+		},
+		{
+			description: "path error",
+			err:         &os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC},
+		},
+		{
+			description: "wrapped path error",
+			err: fmt.Errorf("replica: %w",
+				&os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}),
+		},
+	}
+
+	for i, tt := range tests {
+		dst := errWriter{err: tt.err}
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				defer w.Close()
+				_, _ = ReceiveContent(w, r, dst)
+			}),
+		}
+
+		addr, done := testServe(t, s)
+		err := (&Client{}).Put(addr.String(), "foo", strings.NewReader("hello"))
+		done()
+
+		p, ok := err.(*ErrorPacket)
+		if !ok {
+			t.Fatalf("[%02d] test %q, expected *ErrorPacket, but got: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := ErrorCodeDiskFull, p.ErrorCode; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error code: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := syscall.ENOSPC.Error(), p.ErrorMsg; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error message: %q != %q",
+				i, tt.description, want, got)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package tftp
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// supportsDeadlines reports whether or not c supports read deadlines.
+// Clearing the deadline has no effect on a connection which supports them.
+func supportsDeadlines(c net.PacketConn) bool {
+	return c.SetReadDeadline(time.Time{}) == nil
+}
+
+// timerConn is a net.PacketConn which implements read deadlines using timers,
+// for a net.PacketConn which does not support deadlines itself.  Packets are
+// read from the underlying net.PacketConn by a separate goroutine, and passed
+// to ReadFrom unless the deadline expires first.  Writes never time out.
+type timerConn struct {
+	net.PacketConn
+
+	reads chan timerRead
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// timerRead is the result of a single read by a timerConn's goroutine.
+type timerRead struct {
+	b    []byte
+	addr net.Addr
+	err  error
+}
+
+// newTimerConn creates a timerConn which reads from c.
+func newTimerConn(c net.PacketConn) *timerConn {
+	tc := &timerConn{
+		PacketConn: c,
+		reads:      make(chan timerRead),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	go tc.readLoop()
+	return tc
+}
+
+// readLoop reads packets from the underlying net.PacketConn until it returns
+// an error, or the timerConn is closed.
+func (c *timerConn) readLoop() {
+	// A buffer large enough for any UDP packet
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+
+		r := timerRead{
+			b:    append([]byte(nil), buf[:n]...),
+			addr: addr,
+			err:  err,
+		}
+
+		select {
+		case c.reads <- r:
+		case <-c.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn.  If the read deadline expires before a
+// packet is read, ReadFrom returns an error which reports itself as a
+// timeout.  If a packet does not fit in b, it is truncated.
+func (c *timerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		var (
+			t       *time.Timer
+			expired <-chan time.Time
+		)
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.timeout()
+			}
+
+			t = time.NewTimer(d)
+			expired = t.C
+		}
+
+		select {
+		case r := <-c.reads:
+			stopTimer(t)
+			return copy(b, r.b), r.addr, r.err
+		case <-expired:
+			return 0, nil, c.timeout()
+		case <-c.wake:
+			// The deadline changed, so it must be checked again
+			stopTimer(t)
+		case <-c.done:
+			stopTimer(t)
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+		}
+	}
+}
+
+// stopTimer stops t, if it is not nil.
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// timeout returns the error returned when a read deadline expires.
+func (c *timerConn) timeout() error {
+	return &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+}
+
+// SetDeadline implements net.PacketConn.  Only the read deadline is set.
+func (c *timerConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *timerConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+
+	// Interrupt a read in progress, so that it observes the new deadline
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.  Writes never time out.
+func (c *timerConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// Close implements net.PacketConn, and stops reading from the underlying
+// net.PacketConn.
+func (c *timerConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,81 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test_bufferedSocketResponseWriterNoDeadlines verifies that a transfer over
+// a connection which does not support deadlines uses timers to retransmit a
+// block which is not acknowledged, and completes.
+func Test_bufferedSocketResponseWriterNoDeadlines(t *testing.T) {
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &noDeadlinePacketConn{PacketConn: p}
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w := newTestResponseWriter(nil)
+	w.conn = nil
+	w.listen = func() (net.PacketConn, error) { return conn, nil }
+	w.remoteAddr = c.LocalAddr()
+	w.server.RetransmitTimeout = 50 * time.Millisecond
+	w.server.DisableDally = true
+
+	// Ignore the first copy of the block, and acknowledge the second
+	go func() {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 1500)
+		for i := 0; i < 2; i++ {
+			if _, _, err := c.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+
+		_, _ = c.WriteTo([]byte{0, 4, 0, 1}, p.LocalAddr())
+	}()
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	if want, got := 1, w.Stats().Retransmits; want != got {
+		t.Fatalf("unexpected retransmits: %v != %v", want, got)
+	}
+	if !conn.closed {
+		t.Fatal("underlying connection was not closed")
+	}
+}
+
+// errNoDeadlines is returned by noDeadlinePacketConn when setting a deadline.
+var errNoDeadlines = errors.New("deadlines not supported")
+
+// noDeadlinePacketConn is a net.PacketConn which does not support deadlines.
+type noDeadlinePacketConn struct {
+	net.PacketConn
+	closed bool
+}
+
+func (c *noDeadlinePacketConn) SetDeadline(time.Time) error      { return errNoDeadlines }
+func (c *noDeadlinePacketConn) SetReadDeadline(time.Time) error  { return errNoDeadlines }
+func (c *noDeadlinePacketConn) SetWriteDeadline(time.Time) error { return errNoDeadlines }
+
+func (c *noDeadlinePacketConn) Close() error {
+	c.closed = true
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,61 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// errDrainUnsupported is returned when the packets queued on a socket cannot
+// be read without blocking, either because the socket does not expose its
+// file descriptor, or because the platform does not support it.
+var errDrainUnsupported = errors.New("tftp: draining sockets is not supported")
+
+// drain discards any packets queued on c without blocking, such as packets
+// which arrived while c was idle.  A socket which cannot be drained must not
+// be reused by another transfer, because a stale packet from a previous
+// transfer could be mistaken for a reply from the client.
+func drain(c net.PacketConn) error {
+	return readFD(c, drainFD)
+}
+
+// readQueued reads a single packet queued on c into b without blocking.  If
+// no packet is queued, readQueued returns a nil net.Addr and no error.
+func readQueued(c net.PacketConn, b []byte) (int, net.Addr, error) {
+	var (
+		n    int
+		addr net.Addr
+	)
+
+	err := readFD(c, func(fd uintptr) error {
+		var err error
+		n, addr, err = recvFD(fd, b)
+		return err
+	})
+
+	return n, addr, err
+}
+
+// readFD calls fn with the non-blocking file descriptor of c, and returns
+// the error returned by fn.
+func readFD(c net.PacketConn, fn func(fd uintptr) error) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return errDrainUnsupported
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	if err := rc.Read(func(fd uintptr) bool {
+		ferr = fn(fd)
+		return true
+	}); err != nil {
+		return err
+	}
+
+	return ferr
+}
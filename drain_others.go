@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package tftp
+
+import (
+	"net"
+)
+
+// drainFD always returns errDrainUnsupported on this platform, so sockets
+// are closed rather than reused.
+func drainFD(_ uintptr) error {
+	return errDrainUnsupported
+}
+
+// recvFD always returns errDrainUnsupported on this platform.
+func recvFD(_ uintptr, _ []byte) (int, net.Addr, error) {
+	return 0, nil, errDrainUnsupported
+}
@@ -0,0 +1,62 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package tftp
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// drainFD reads and discards packets from the non-blocking socket fd until
+// no more packets are queued.
+func drainFD(fd uintptr) error {
+	// Each packet is discarded entirely, even if it does not fit in b
+	b := make([]byte, 1)
+	for {
+		_, _, err := syscall.Recvfrom(int(fd), b, 0)
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recvFD reads a single packet from the non-blocking socket fd into b.  If no
+// packet is queued, recvFD returns a nil net.Addr and no error.
+func recvFD(fd uintptr, b []byte) (int, net.Addr, error) {
+	n, from, err := syscall.Recvfrom(int(fd), b, 0)
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch sa := from.(type) {
+	case *syscall.SockaddrInet4:
+		return n, &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), sa.Addr[:]...)),
+			Port: sa.Port,
+		}, nil
+	case *syscall.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			zone = strconv.Itoa(int(sa.ZoneId))
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				zone = ifi.Name
+			}
+		}
+
+		return n, &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), sa.Addr[:]...)),
+			Port: sa.Port,
+			Zone: zone,
+		}, nil
+	}
+
+	return 0, nil, errDrainUnsupported
+}
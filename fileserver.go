@@ -0,0 +1,508 @@
+package tftp
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileServer is a Handler which serves read requests using the files in a
+// directory.  Write requests are rejected.
+type FileServer struct {
+	// Root is the directory containing files to be served.
+	Root string
+
+	// MaxCacheBytes, if greater than zero, enables an in-memory cache of
+	// file contents, so that a popular file is only read from disk once
+	// while it remains unmodified.  The total size of cached files never
+	// exceeds MaxCacheBytes, and the least recently used files are evicted
+	// to make room for new ones.  Files larger than MaxCacheBytes are never
+	// cached.
+	MaxCacheBytes int64
+
+	// FollowSymlinks specifies whether or not symbolic links which resolve
+	// to a file outside of Root may be served.  By default, requests for
+	// such files are rejected with ErrorCodeAccessViolation.  Symbolic
+	// links which resolve to a file within Root are always served.
+	FollowSymlinks bool
+
+	// IndexFilename, if not empty, is a reserved filename, such as
+	// ".index.json".  A read request for IndexFilename is served a JSON
+	// array describing each regular file directly within Root, with the
+	// name, size, and modification time of each file.  Subdirectories are
+	// not listed, and symbolic links are only listed if they could be
+	// served.  A file in Root named IndexFilename cannot be served.
+	IndexFilename string
+
+	// FileOptions, if not empty, specifies preferred option values for
+	// files whose names match a pattern.  The first FileOptions whose
+	// Pattern matches the requested filename is used.
+	FileOptions []FileOptions
+
+	// mu guards the cache.
+	mu         sync.Mutex
+	cache      map[string]*list.Element
+	cacheLRU   *list.List
+	cacheBytes int64
+}
+
+// FileOptions specifies preferred option values for the files served by a
+// FileServer whose names match Pattern.  Preferred values only apply when a
+// client requests the corresponding option, and can only reduce the value
+// negotiated with the client, as permitted by RFC 2348.
+type FileOptions struct {
+	// Pattern is matched against the requested filename, using the syntax
+	// of path.Match, such as "images/*.img".
+	Pattern string
+
+	// BlockSize, if greater than zero, is the largest block size
+	// negotiated for matching files.  If a client requests the blksize2
+	// option, the largest power of two within BlockSize is negotiated.
+	BlockSize int
+}
+
+// cacheEntry is a single file stored in a FileServer's cache.
+type cacheEntry struct {
+	name    string
+	modTime time.Time
+	b       []byte
+}
+
+// ServeTFTP serves a file from fs.Root in response to a read request.
+func (fs *FileServer) ServeTFTP(w ResponseWriter, r *Request) {
+	defer w.Close()
+
+	if r.Opcode != OpcodeRead {
+		_ = w.WriteError(ErrorCodeAccessViolation, "server is read-only")
+		return
+	}
+
+	var (
+		content io.Reader
+		err     error
+	)
+	if fs.IndexFilename != "" && r.Filename == fs.IndexFilename {
+		content, err = fs.index()
+	} else {
+		content, err = fs.open(r.Filename)
+	}
+	if err != nil {
+		writeError(w, ErrorFromOS(err))
+		return
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if o, ok := fs.fileOptions(r.Filename); ok {
+		o.apply(w.Options())
+	}
+
+	_ = ServeContent(w, r, content)
+}
+
+// fileOptions returns the first FileOptions whose pattern matches filename.
+func (fs *FileServer) fileOptions(filename string) (FileOptions, bool) {
+	for _, o := range fs.FileOptions {
+		if ok, _ := path.Match(o.Pattern, filename); ok {
+			return o, true
+		}
+	}
+
+	return FileOptions{}, false
+}
+
+// apply reduces the values of the accepted options to the preferred values in
+// o.  Preferred values which could not be negotiated are ignored.
+func (o FileOptions) apply(options map[string]string) {
+	if o.BlockSize < MinBlockSize {
+		return
+	}
+
+	if v, ok := options[optionBlockSize]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > o.BlockSize {
+			options[optionBlockSize] = strconv.Itoa(o.BlockSize)
+		}
+	}
+
+	if v, ok := options[optionBlockSize2]; ok {
+		p := MinBlockSize
+		for p*2 <= o.BlockSize {
+			p *= 2
+		}
+
+		if n, err := strconv.Atoi(v); err == nil && n > p {
+			options[optionBlockSize2] = strconv.Itoa(p)
+		}
+	}
+}
+
+// open opens a file relative to fs.Root, returning its content from the
+// cache if possible.  Files larger than fs.MaxCacheBytes are never read into
+// memory, and the opened file is returned instead.
+func (fs *FileServer) open(filename string) (io.Reader, error) {
+	name := fs.path(filename)
+
+	if !fs.FollowSymlinks {
+		if err := fs.checkSymlinks(name); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.MaxCacheBytes <= 0 {
+		return f, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	// Files which are too large to be cached are served directly, rather
+	// than being read into memory
+	if fi.Size() > fs.MaxCacheBytes {
+		return f, nil
+	}
+	defer f.Close()
+
+	// Serve the cached copy of the file if it has not been modified since
+	// it was cached
+	if b, ok := fs.cached(name, fi.ModTime()); ok {
+		return bytes.NewReader(b), nil
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.store(name, fi.ModTime(), b)
+	return bytes.NewReader(b), nil
+}
+
+// indexEntry is the JSON representation of a single file in a FileServer's
+// index.
+type indexEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// index generates a JSON index of the regular files directly within fs.Root,
+// ordered by name.
+func (fs *FileServer) index() (io.Reader, error) {
+	fis, err := ioutil.ReadDir(fs.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]indexEntry, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Name() == fs.IndexFilename {
+			continue
+		}
+
+		// Symbolic links are described by the file they resolve to, and
+		// omitted if they could not be served
+		if fi.Mode()&os.ModeSymlink != 0 {
+			name := filepath.Join(fs.Root, fi.Name())
+			if !fs.FollowSymlinks && fs.checkSymlinks(name) != nil {
+				continue
+			}
+
+			if fi, err = os.Stat(name); err != nil {
+				continue
+			}
+		}
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		entries = append(entries, indexEntry{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// path returns the path to a file relative to fs.Root, preventing any
+// directory traversal beyond the root.
+func (fs *FileServer) path(filename string) string {
+	return filepath.Join(fs.Root, filepath.FromSlash(path.Clean("/"+filename)))
+}
+
+// errSymlinkEscapesRoot is returned when a symbolic link resolves to a file
+// outside of a FileServer's root.
+var errSymlinkEscapesRoot = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeAccessViolation,
+	ErrorMsg:  "access violation",
+}
+
+// checkSymlinks verifies that the file with the specified name does not
+// resolve to a file outside of fs.Root through a symbolic link.
+func (fs *FileServer) checkSymlinks(name string) error {
+	root, err := filepath.EvalSymlinks(fs.Root)
+	if err != nil {
+		return err
+	}
+
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return err
+	}
+
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return errSymlinkEscapesRoot
+	}
+
+	return nil
+}
+
+// cached retrieves the cached contents of the file with the specified name,
+// if they were cached when the file had the specified modification time.
+func (fs *FileServer) cached(name string, modTime time.Time) ([]byte, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e, ok := fs.cache[name]
+	if !ok {
+		return nil, false
+	}
+
+	ce := e.Value.(*cacheEntry)
+	if !ce.modTime.Equal(modTime) {
+		fs.remove(e)
+		return nil, false
+	}
+
+	fs.cacheLRU.MoveToFront(e)
+	return ce.b, true
+}
+
+// store adds the contents of a file to the cache, evicting the least
+// recently used files if needed to stay within fs.MaxCacheBytes.
+func (fs *FileServer) store(name string, modTime time.Time, b []byte) {
+	size := int64(len(b))
+	if size > fs.MaxCacheBytes {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.cache == nil {
+		fs.cache = make(map[string]*list.Element)
+		fs.cacheLRU = list.New()
+	}
+
+	// Another request may have cached this file in the meantime
+	if e, ok := fs.cache[name]; ok {
+		fs.remove(e)
+	}
+
+	for fs.cacheBytes+size > fs.MaxCacheBytes {
+		fs.remove(fs.cacheLRU.Back())
+	}
+
+	fs.cache[name] = fs.cacheLRU.PushFront(&cacheEntry{
+		name:    name,
+		modTime: modTime,
+		b:       b,
+	})
+	fs.cacheBytes += size
+}
+
+// remove removes a single entry from the cache.  fs.mu must be held when
+// calling remove.
+func (fs *FileServer) remove(e *list.Element) {
+	ce := fs.cacheLRU.Remove(e).(*cacheEntry)
+	delete(fs.cache, ce.name)
+	fs.cacheBytes -= int64(len(ce.b))
+}
+
+// ErrorFromOS returns an *ErrorPacket with an appropriate ErrorCode and
+// message for an error returned by a function in package os, such as when
+// opening or writing a file.  The message is taken from err, but never
+// contains a file's path.  If err is already an *ErrorPacket, it is returned
+// unchanged.
+//
+// Errors are mapped to ErrorCodes as follows:
+//   - os.IsNotExist:   ErrorCodeFileNotFound
+//   - os.IsPermission: ErrorCodeAccessViolation
+//   - os.IsExist:      ErrorCodeFileExists
+//   - ENOSPC:          ErrorCodeDiskFull
+//   - otherwise:       ErrorCodeUndefined
+func ErrorFromOS(err error) *ErrorPacket {
+	if e, ok := err.(*ErrorPacket); ok {
+		return e
+	}
+
+	msg := err.Error()
+	var perr *os.PathError
+	if errors.As(err, &perr) {
+		msg = perr.Err.Error()
+	}
+
+	code := ErrorCodeUndefined
+	switch {
+	case os.IsNotExist(err):
+		code = ErrorCodeFileNotFound
+	case os.IsPermission(err):
+		code = ErrorCodeAccessViolation
+	case os.IsExist(err):
+		code = ErrorCodeFileExists
+	case errors.Is(err, syscall.ENOSPC):
+		code = ErrorCodeDiskFull
+	}
+
+	return &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: code,
+		ErrorMsg:  msg,
+	}
+}
+
+// WritableFileServer is a Handler which serves read requests using the files
+// in a directory, in the same way as FileServer, and stores the files sent
+// by write requests in the same directory.
+type WritableFileServer struct {
+	FileServer
+
+	// Overwrite specifies whether or not a write request may replace an
+	// existing file.  By default, write requests for existing files are
+	// rejected with ErrorCodeFileExists.
+	Overwrite bool
+}
+
+// ServeTFTP serves a file from fs.Root in response to a read request, or
+// stores a file in fs.Root in response to a write request.
+func (fs *WritableFileServer) ServeTFTP(w ResponseWriter, r *Request) {
+	if r.Opcode != OpcodeWrite {
+		fs.FileServer.ServeTFTP(w, r)
+		return
+	}
+
+	defer w.Close()
+
+	f, target, err := fs.create(r.Filename)
+	if err != nil {
+		writeError(w, ErrorFromOS(err))
+		return
+	}
+
+	// Do not leave a partial file behind if the transfer fails
+	if _, err := ReceiveContent(w, r, f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		reportHandlerError(w, fmt.Errorf("tftp: failed to store %q: %w", r.Filename, err))
+		return
+	}
+
+	// Replace the existing file only once all of its new content is stored
+	if target != "" {
+		if err := os.Rename(f.Name(), target); err != nil {
+			_ = os.Remove(f.Name())
+			reportHandlerError(w, fmt.Errorf("tftp: failed to store %q: %w", r.Filename, err))
+		}
+	}
+}
+
+// errFileExists is returned when a write request would replace an existing
+// file, but overwriting files is not permitted.
+var errFileExists = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeFileExists,
+	ErrorMsg:  "file already exists",
+}
+
+// create creates a file relative to fs.Root to store the content of a write
+// request.  If the file may replace an existing file, the content is stored
+// in a temporary file in the same directory, and create returns the name of
+// the file which it must be renamed to once the transfer succeeds, so that
+// a failed transfer leaves the existing file intact.
+func (fs *WritableFileServer) create(filename string) (*os.File, string, error) {
+	name := fs.path(filename)
+
+	// Files may only be created within the root, and may never be created
+	// or replaced through a symbolic link, which may refer to a file
+	// outside of the root even if it does not yet exist
+	if !fs.FollowSymlinks {
+		if err := fs.checkSymlinks(filepath.Dir(name)); err != nil {
+			return nil, "", err
+		}
+
+		fi, err := os.Lstat(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return nil, "", errSymlinkEscapesRoot
+		}
+	}
+
+	// A new file is created exclusively, which also never follows a
+	// symbolic link
+	if !fs.Overwrite {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			if os.IsExist(err) {
+				return nil, "", errFileExists
+			}
+
+			return nil, "", err
+		}
+
+		return f, "", nil
+	}
+
+	// Replace the target of a symbolic link, rather than the link itself
+	if fs.FollowSymlinks {
+		if real, err := filepath.EvalSymlinks(name); err == nil {
+			name = real
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := f.Chmod(0644); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, "", err
+	}
+
+	return f, name, nil
+}
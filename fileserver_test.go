@@ -0,0 +1,561 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestFileServerCache verifies that FileServer serves files from its cache
+// until they are modified on disk.
+func TestFileServerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "boot.img")
+	modTime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	testWriteFile(t, name, "hello", modTime)
+
+	fs := &FileServer{
+		Root:          dir,
+		MaxCacheBytes: 16,
+	}
+
+	// First read is a cache miss, and populates the cache
+	if want, got := "hello", testFileServerRead(t, fs, "boot.img"); want != got {
+		t.Fatalf("unexpected content on cache miss: %q != %q", want, got)
+	}
+	if want, got := int64(5), fs.cacheBytes; want != got {
+		t.Fatalf("unexpected cache size: %v != %v", want, got)
+	}
+
+	// Change the file's contents without changing its modification time, so
+	// the stale cached copy is served
+	testWriteFile(t, name, "world", modTime)
+	if want, got := "hello", testFileServerRead(t, fs, "boot.img"); want != got {
+		t.Fatalf("unexpected content on cache hit: %q != %q", want, got)
+	}
+
+	// Once the modification time changes, the cached copy is invalidated
+	testWriteFile(t, name, "world", modTime.Add(1*time.Minute))
+	if want, got := "world", testFileServerRead(t, fs, "boot.img"); want != got {
+		t.Fatalf("unexpected content after invalidation: %q != %q", want, got)
+	}
+
+	// Caching another file evicts the least recently used file to stay
+	// within the size limit
+	testWriteFile(t, filepath.Join(dir, "other.img"), "0123456789AB", modTime)
+	if want, got := "0123456789AB", testFileServerRead(t, fs, "other.img"); want != got {
+		t.Fatalf("unexpected content for second file: %q != %q", want, got)
+	}
+	if want, got := int64(12), fs.cacheBytes; want != got {
+		t.Fatalf("unexpected cache size after eviction: %v != %v", want, got)
+	}
+	if _, ok := fs.cache[name]; ok {
+		t.Fatal("least recently used file was not evicted")
+	}
+
+	// A file larger than the cache is served directly from disk, without
+	// being cached
+	large := strings.Repeat("a", 32)
+	testWriteFile(t, filepath.Join(dir, "large.img"), large, modTime)
+	if want, got := large, testFileServerRead(t, fs, "large.img"); want != got {
+		t.Fatalf("unexpected content for large file: %q != %q", want, got)
+	}
+	if want, got := int64(12), fs.cacheBytes; want != got {
+		t.Fatalf("unexpected cache size after large file: %v != %v", want, got)
+	}
+
+	content, err := fs.open("large.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := content.(*os.File)
+	if !ok {
+		t.Fatalf("large file was read into memory: %T", content)
+	}
+	_ = f.Close()
+}
+
+// TestFileServerSymlinks verifies that FileServer only serves symbolic links
+// which resolve outside of its root if FollowSymlinks is set.
+func TestFileServerSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testWriteFile(t, filepath.Join(root, "file"), "inside", time.Now())
+	testWriteFile(t, filepath.Join(dir, "secret"), "outside", time.Now())
+
+	if err := os.Symlink(filepath.Join(root, "file"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description string
+		follow      bool
+		filename    string
+		content     string
+		err         error
+	}{
+		{
+			description: "symlink within root, OK",
+			filename:    "inside",
+			content:     "inside",
+		},
+		{
+			description: "symlink escaping root, access violation",
+			filename:    "outside",
+			err:         errSymlinkEscapesRoot,
+		},
+		{
+			description: "symlink escaping root, following symlinks, OK",
+			follow:      true,
+			filename:    "outside",
+			content:     "outside",
+		},
+	}
+
+	for i, tt := range tests {
+		fs := &FileServer{
+			Root:           root,
+			FollowSymlinks: tt.follow,
+		}
+
+		r, err := fs.open(tt.filename)
+		if want, got := tt.err, err; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if err != nil {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.(io.Closer).Close()
+
+		if want, got := tt.content, string(b); want != got {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// testFileServerRead reads a file using fs, returning its contents.
+func testFileServerRead(t *testing.T, fs *FileServer, filename string) string {
+	r, err := fs.open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// testWriteFile writes a file with the specified contents and modification
+// time.
+func testWriteFile(t *testing.T, name string, s string, modTime time.Time) {
+	if err := ioutil.WriteFile(name, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFileServerIndex verifies that FileServer serves a JSON index of the
+// files in its root for IndexFilename, only if IndexFilename is set.
+func TestFileServerIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	testWriteFile(t, filepath.Join(dir, "b.img"), "hello", modTime)
+	testWriteFile(t, filepath.Join(dir, "a.img"), "hi", modTime)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testWriteFile(t, filepath.Join(dir, "sub", "c.img"), "nested", modTime)
+
+	var tests = []struct {
+		description string
+		index       string
+		entries     []indexEntry
+		err         *ErrorPacket
+	}{
+		{
+			description: "index disabled",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeFileNotFound,
+				ErrorMsg:  "no such file or directory",
+			},
+		},
+		{
+			description: "index enabled",
+			index:       ".index.json",
+			entries: []indexEntry{
+				{Name: "a.img", Size: 2, ModTime: modTime},
+				{Name: "b.img", Size: 5, ModTime: modTime},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		fs := &FileServer{
+			Root:          dir,
+			IndexFilename: tt.index,
+		}
+
+		w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+		fs.ServeTFTP(w, &Request{
+			Opcode:   OpcodeRead,
+			Filename: ".index.json",
+			Mode:     ModeOctet,
+		})
+
+		if want, got := tt.err, w.err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ERROR:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		if tt.err != nil {
+			continue
+		}
+
+		var entries []indexEntry
+		if err := json.Unmarshal(w.buf.Bytes(), &entries); err != nil {
+			t.Fatalf("[%02d] test %q, invalid JSON index: %v", i, tt.description, err)
+		}
+
+		for j := range entries {
+			entries[j].ModTime = entries[j].ModTime.UTC()
+		}
+		if want, got := tt.entries, entries; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected index entries:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestFileServerFileOptions verifies that a FileServer reduces the options
+// negotiated for a file to the preferred values of the first FileOptions
+// whose pattern matches its name.
+func TestFileServerFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testWriteFile(t, filepath.Join(dir, "large.img"), "hello", time.Now())
+	testWriteFile(t, filepath.Join(dir, "small.cfg"), "hello", time.Now())
+
+	fileOptions := []FileOptions{
+		{Pattern: "*.img", BlockSize: 1024},
+		{Pattern: "*", BlockSize: 4096},
+	}
+
+	var tests = []struct {
+		description string
+		filename    string
+		accepted    map[string]string
+		want        map[string]string
+	}{
+		{
+			description: "blksize capped",
+			filename:    "large.img",
+			accepted:    map[string]string{"blksize": "1468"},
+			want:        map[string]string{"blksize": "1024"},
+		},
+		{
+			description: "smaller blksize unchanged",
+			filename:    "large.img",
+			accepted:    map[string]string{"blksize": "512"},
+			want:        map[string]string{"blksize": "512"},
+		},
+		{
+			description: "blksize2 capped to power of two",
+			filename:    "large.img",
+			accepted:    map[string]string{"blksize2": "8192"},
+			want:        map[string]string{"blksize2": "1024"},
+		},
+		{
+			description: "blksize not requested, not added",
+			filename:    "large.img",
+			accepted:    map[string]string{"tsize": "5"},
+			want:        map[string]string{"tsize": "5"},
+		},
+		{
+			description: "first matching pattern used",
+			filename:    "small.cfg",
+			accepted:    map[string]string{"blksize": "8192"},
+			want:        map[string]string{"blksize": "4096"},
+		},
+	}
+
+	for i, tt := range tests {
+		fs := &FileServer{
+			Root:        dir,
+			FileOptions: fileOptions,
+		}
+
+		w := &captureResponseWriter{
+			buf:     bytes.NewBuffer(nil),
+			options: tt.accepted,
+		}
+		fs.ServeTFTP(w, &Request{
+			Opcode:   OpcodeRead,
+			Filename: tt.filename,
+			Mode:     ModeOctet,
+		})
+
+		if w.err != nil {
+			t.Fatalf("[%02d] test %q, unexpected ERROR: %v", i, tt.description, w.err)
+		}
+		if want, got := tt.want, w.Options(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected options:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestWritableFileServerOverwrite verifies that WritableFileServer only
+// replaces an existing file if Overwrite is set.
+func TestWritableFileServerOverwrite(t *testing.T) {
+	var tests = []struct {
+		description string
+		overwrite   bool
+		reads       []testRead
+		content     string
+		writes      [][]byte
+	}{
+		{
+			description: "overwrite allowed, file replaced",
+			overwrite:   true,
+			content:     "new",
+			writes: [][]byte{
+				{0, 4, 0, 0},
+				{0, 4, 0, 1},
+			},
+		},
+		{
+			description: "overwrite allowed, transfer fails, file kept",
+			overwrite:   true,
+			reads: []testRead{
+				{b: append([]byte{0, 5, 0, 0}, "aborted\x00"...)},
+			},
+			content: "old",
+			writes: [][]byte{
+				{0, 4, 0, 0},
+			},
+		},
+		{
+			description: "overwrite denied, file exists",
+			content:     "old",
+			writes: [][]byte{
+				append([]byte{0, 5, 0, 6}, "file already exists\x00"...),
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "tftp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		name := filepath.Join(dir, "file")
+		testWriteFile(t, name, "old", time.Now())
+
+		reads := tt.reads
+		if reads == nil {
+			reads = []testRead{
+				{b: append([]byte{0, 3, 0, 1}, "new"...)},
+			}
+		}
+
+		c := &testPacketConn{reads: reads}
+		bsw := newTestResponseWriter(c)
+		bsw.server.DisableDally = true
+		w := &response{ResponseWriter: bsw, bsw: bsw}
+
+		fs := &WritableFileServer{
+			FileServer: FileServer{Root: dir},
+			Overwrite:  tt.overwrite,
+		}
+		fs.ServeTFTP(w, &Request{
+			Opcode:   OpcodeWrite,
+			Filename: "file",
+			Mode:     ModeOctet,
+		})
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := tt.content, string(b); want != got {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+
+		// No temporary files are left behind
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := 1, len(fis); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of files: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestWritableFileServerSymlinks verifies that WritableFileServer never
+// creates or replaces a file through a symbolic link unless FollowSymlinks
+// is set, even if the link does not resolve to an existing file.
+func TestWritableFileServerSymlinks(t *testing.T) {
+	for i, overwrite := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "tftp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		root := filepath.Join(dir, "root")
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		outside := filepath.Join(dir, "pwned")
+		if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+			t.Skipf("failed to create symlink: %v", err)
+		}
+
+		c := &testPacketConn{reads: []testRead{
+			{b: append([]byte{0, 3, 0, 1}, "new"...)},
+		}}
+		bsw := newTestResponseWriter(c)
+		bsw.server.DisableDally = true
+		w := &response{ResponseWriter: bsw, bsw: bsw}
+
+		fs := &WritableFileServer{
+			FileServer: FileServer{Root: root},
+			Overwrite:  overwrite,
+		}
+		fs.ServeTFTP(w, &Request{
+			Opcode:   OpcodeWrite,
+			Filename: "link",
+			Mode:     ModeOctet,
+		})
+
+		if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+			t.Fatalf("[%02d] overwrite %v, file created outside of root: %v",
+				i, overwrite, err)
+		}
+
+		want := [][]byte{append([]byte{0, 5, 0, 2}, "access violation\x00"...)}
+		if got := c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] overwrite %v, unexpected packets:\n- want: %v\n-  got: %v",
+				i, overwrite, want, got)
+		}
+	}
+}
+
+// TestErrorFromOS verifies that ErrorFromOS maps each class of error to the
+// appropriate ErrorCode, without revealing file paths.
+func TestErrorFromOS(t *testing.T) {
+	var tests = []struct {
+		description string
+		err         error
+		code        ErrorCode
+		msg         string
+	}{
+		{
+			description: "not exist",
+			err:         &os.PathError{Op: "open", Path: "/secret/foo", Err: os.ErrNotExist},
+			code:        ErrorCodeFileNotFound,
+			msg:         os.ErrNotExist.Error(),
+		},
+		{
+			description: "permission",
+			err:         &os.PathError{Op: "open", Path: "/secret/foo", Err: os.ErrPermission},
+			code:        ErrorCodeAccessViolation,
+			msg:         os.ErrPermission.Error(),
+		},
+		{
+			description: "exist",
+			err:         &os.PathError{Op: "open", Path: "/secret/foo", Err: os.ErrExist},
+			code:        ErrorCodeFileExists,
+			msg:         os.ErrExist.Error(),
+		},
+		{
+			description: "disk full",
+			err:         &os.PathError{Op: "write", Path: "/secret/foo", Err: syscall.ENOSPC},
+			code:        ErrorCodeDiskFull,
+			msg:         syscall.ENOSPC.Error(),
+		},
+		{
+			description: "other",
+			err:         errors.New("foo"),
+			code:        ErrorCodeUndefined,
+			msg:         "foo",
+		},
+		{
+			description: "ErrorPacket",
+			err:         errFileExists,
+			code:        ErrorCodeFileExists,
+			msg:         "file already exists",
+		},
+	}
+
+	for i, tt := range tests {
+		want := &ErrorPacket{
+			Opcode:    OpcodeError,
+			ErrorCode: tt.code,
+			ErrorMsg:  tt.msg,
+		}
+
+		if got := ErrorFromOS(tt.err); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ErrorPacket:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package tftp
+
+import (
+	"syscall"
+)
+
+// freeBindControl sets the IP_FREEBIND socket option on c before it is bound,
+// permitting it to bind to an IP address which is not assigned to the host.
+// Linux honors IP_FREEBIND for both IPv4 and IPv6 sockets.
+func freeBindControl(_, _ string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package tftp
+
+import (
+	"net"
+	"testing"
+)
+
+// TestServerFreeBind verifies that a Server with FreeBind set binds to an IP
+// address which is not assigned to the host, where a plain bind fails.
+func TestServerFreeBind(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, and is not expected to be
+	// assigned to the host running the tests
+	const addr = "192.0.2.1:0"
+
+	s := &Server{Addr: addr}
+	if c, err := s.listenPacket(); err == nil {
+		_ = c.Close()
+		t.Skipf("%s is assigned to this host", addr)
+	}
+
+	s.FreeBind = true
+	c, err := s.listenPacket()
+	if err != nil {
+		t.Fatalf("unexpected error binding with FreeBind: %v", err)
+	}
+	defer c.Close()
+
+	if want, got := "192.0.2.1", c.LocalAddr().(*net.UDPAddr).IP.String(); want != got {
+		t.Fatalf("unexpected bound address: %v != %v", want, got)
+	}
+}
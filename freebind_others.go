@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errFreeBindUnsupported is returned when Server.FreeBind is set on a platform
+// which does not support it.
+var errFreeBindUnsupported = errors.New("tftp: FreeBind is not supported on this platform")
+
+// freeBindControl always returns errFreeBindUnsupported, because binding to
+// an IP address which is not assigned to the host is not supported on this
+// platform.
+func freeBindControl(_, _ string, _ syscall.RawConn) error {
+	return errFreeBindUnsupported
+}
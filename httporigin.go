@@ -0,0 +1,80 @@
+package tftp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// HTTPOriginHandler returns a Handler which serves read requests using
+// content retrieved from an HTTP origin server.  Each requested filename is
+// appended to baseURL, and the content returned by an HTTP GET request for
+// the resulting URL is sent to the client.  If client is nil,
+// http.DefaultClient is used.  Write requests are rejected.
+//
+// Each filename is cleaned before it is appended to baseURL, and a filename
+// which refers to a path above baseURL is rejected with
+// ErrorCodeAccessViolation.
+//
+// If a client requests the transfer size using the tsize option from RFC
+// 2349 for an octet mode transfer, and the origin reports a Content-Length,
+// the length is acknowledged to the client.
+//
+// HTTP status 404 (Not Found) is reported to the client using
+// ErrorCodeFileNotFound, and HTTP status 403 (Forbidden) using
+// ErrorCodeAccessViolation.  Any other unsuccessful status, or a failure to
+// reach the origin, is reported using ErrorCodeUndefined.
+func HTTPOriginHandler(baseURL string, client *http.Client) Handler {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer w.Close()
+
+		if r.Opcode != OpcodeRead {
+			_ = w.WriteError(ErrorCodeAccessViolation, "server is read-only")
+			return
+		}
+
+		// Prevent any directory traversal beyond baseURL
+		name := path.Clean(r.Filename)
+		if name == ".." || strings.HasPrefix(name, "../") {
+			_ = w.WriteError(ErrorCodeAccessViolation, "access violation")
+			return
+		}
+		name = strings.TrimPrefix(name, "/")
+
+		// Escape the filename so that it is always treated as a path
+		u := baseURL + (&url.URL{Path: name}).EscapedPath()
+
+		res, err := client.Get(u)
+		if err != nil {
+			_ = w.WriteError(ErrorCodeUndefined, "origin unavailable")
+			return
+		}
+		defer res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			_ = w.WriteError(ErrorCodeFileNotFound, "file not found")
+			return
+		case http.StatusForbidden:
+			_ = w.WriteError(ErrorCodeAccessViolation, "access denied")
+			return
+		default:
+			_ = w.WriteError(ErrorCodeUndefined, fmt.Sprintf("origin returned HTTP %d", res.StatusCode))
+			return
+		}
+
+		if _, ok := r.Options[optionTransferSize]; ok && r.Mode == ModeOctet && res.ContentLength >= 0 {
+			w.Options()[optionTransferSize] = strconv.FormatInt(res.ContentLength, 10)
+		}
+
+		_ = ServeContent(w, r, res.Body)
+	})
+}
@@ -0,0 +1,147 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestHTTPOriginHandler verifies that HTTPOriginHandler serves content from
+// an HTTP origin server, and maps HTTP errors to the appropriate ErrorCode.
+func TestHTTPOriginHandler(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+
+		switch r.URL.Path {
+		case "/files/boot.img", "/files/boot image.img":
+			_, _ = w.Write([]byte("hello world"))
+		case "/files/secret.img":
+			w.WriteHeader(http.StatusForbidden)
+		case "/files/broken.img":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		description string
+		filename    string
+		mode        Mode
+		options     map[string]string
+		path        string
+		content     string
+		accepted    map[string]string
+		err         *ErrorPacket
+	}{
+		{
+			description: "file found",
+			filename:    "boot.img",
+			path:        "/files/boot.img",
+			content:     "hello world",
+		},
+		{
+			description: "file found, transfer size requested",
+			filename:    "boot.img",
+			options:     map[string]string{"tsize": "0"},
+			path:        "/files/boot.img",
+			content:     "hello world",
+			accepted:    map[string]string{"tsize": "11"},
+		},
+		{
+			description: "file found, transfer size requested in netascii mode",
+			filename:    "boot.img",
+			mode:        ModeNetASCII,
+			options:     map[string]string{"tsize": "0"},
+			path:        "/files/boot.img",
+			content:     "hello world",
+		},
+		{
+			description: "file found, filename cleaned",
+			filename:    "/pxe/../boot.img",
+			path:        "/files/boot.img",
+			content:     "hello world",
+		},
+		{
+			description: "filename escapes root",
+			filename:    "pxe/../../secret.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeAccessViolation,
+				ErrorMsg:  "access violation",
+			},
+		},
+		{
+			description: "file found, filename escaped",
+			filename:    "boot image.img",
+			path:        "/files/boot%20image.img",
+			content:     "hello world",
+		},
+		{
+			description: "file not found",
+			filename:    "missing.img",
+			path:        "/files/missing.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeFileNotFound,
+				ErrorMsg:  "file not found",
+			},
+		},
+		{
+			description: "forbidden",
+			filename:    "secret.img",
+			path:        "/files/secret.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeAccessViolation,
+				ErrorMsg:  "access denied",
+			},
+		},
+		{
+			description: "server error",
+			filename:    "broken.img",
+			path:        "/files/broken.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeUndefined,
+				ErrorMsg:  "origin returned HTTP 500",
+			},
+		},
+	}
+
+	h := HTTPOriginHandler(srv.URL+"/files/", nil)
+
+	for i, tt := range tests {
+		if tt.mode == "" {
+			tt.mode = ModeOctet
+		}
+
+		path = ""
+		w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+		r := NewRequest(OpcodeRead, tt.filename, tt.mode, tt.options, &net.UDPAddr{})
+
+		h.ServeTFTP(w, r)
+
+		if want, got := tt.path, path; want != got {
+			t.Fatalf("[%02d] test %q, unexpected path: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.err, w.err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.content, w.buf.String(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.accepted, w.options; (len(want) > 0 || len(got) > 0) && !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected options: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package tftp
+
+import (
+	"time"
+)
+
+// keepalive sends an OACK to the client, and sends it again every interval
+// until stopKeepalive is called, so that the client does not time out while
+// a handler prepares content.  The client's acknowledgement of the OACK is
+// recorded, so that the OACK is not sent again before the first block.
+func (w *bufferedSocketResponseWriter) keepalive(interval time.Duration) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	b, err := (&oackPacket{Options: w.options}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		for {
+			if _, err := w.conn.WriteTo(b, w.remoteAddr); err != nil {
+				return
+			}
+			if err := w.conn.SetReadDeadline(time.Now().Add(interval)); err != nil {
+				return
+			}
+
+			// Consume replies until the interval elapses, then send
+			// the OACK again
+			for {
+				n, err := w.read()
+
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if err != nil {
+					if isTimeout(err) {
+						break
+					}
+
+					return
+				}
+
+				if ack, err := parseACKPacket(w.rb[:n]); err == nil && ack.Block == 0 {
+					w.oacked = true
+				}
+			}
+		}
+	}()
+
+	w.stopKeepalive = func() {
+		close(stop)
+		_ = w.conn.SetReadDeadline(time.Now())
+		<-exited
+	}
+
+	return nil
+}
+
+// endKeepalive stops sending keepalives to the client, if they were enabled.
+// It must be called before any other packets are sent or received.
+func (w *bufferedSocketResponseWriter) endKeepalive() {
+	if w.stopKeepalive == nil {
+		return
+	}
+
+	w.stopKeepalive()
+	w.stopKeepalive = nil
+}
@@ -0,0 +1,50 @@
+package tftp
+
+import (
+	"time"
+)
+
+// limiter is a token bucket which paces outgoing packets so that a transfer
+// does not exceed a configured number of bytes per second.
+type limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter creates a limiter which permits rate bytes per second.
+func newLimiter(rate int64) *limiter {
+	return &limiter{
+		rate: float64(rate),
+		last: time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent without exceeding the limiter's
+// rate, and reports whether or not it blocked.  Tokens do not accumulate
+// while idle, so packets are never sent in a burst faster than the
+// configured rate.
+func (l *limiter) wait(n int) bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > 0 {
+		l.tokens = 0
+	}
+
+	// If previous packets have consumed more tokens than are available,
+	// wait until enough tokens accumulate
+	var waited bool
+	if l.tokens < 0 {
+		d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		time.Sleep(d)
+
+		now = now.Add(d)
+		l.tokens = 0
+		waited = true
+	}
+
+	l.tokens -= float64(n)
+	l.last = now
+
+	return waited
+}
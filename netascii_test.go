@@ -2,7 +2,10 @@ package tftp
 
 import (
 	"bytes"
+	"hash"
+	"net"
 	"testing"
+	"time"
 )
 
 // Test_netASCIIResponseWriterWrite verifies that netASCIIResponseWriter.Write
@@ -48,11 +51,37 @@ func Test_netASCIIResponseWriterWrite(t *testing.T) {
 	}
 }
 
-// captureResponseWriter captures any data written to it using a buffer.
+// captureResponseWriter captures any data written to it using a buffer, and
+// records any options or ERROR sent using it.
 type captureResponseWriter struct {
-	buf *bytes.Buffer
+	buf     *bytes.Buffer
+	options map[string]string
+	err     *ErrorPacket
 }
 
-func (w *captureResponseWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
-func (w *captureResponseWriter) Close() error                { return nil }
-func (w *captureResponseWriter) Flush() error                { return nil }
+func (w *captureResponseWriter) Write(p []byte) (int, error)       { return w.buf.Write(p) }
+func (w *captureResponseWriter) Close() error                      { return nil }
+func (w *captureResponseWriter) Cancel() error                     { return nil }
+func (w *captureResponseWriter) Flush() error                      { return nil }
+func (w *captureResponseWriter) Stats() TransferStats              { return TransferStats{} }
+func (w *captureResponseWriter) LocalAddr() net.Addr               { return nil }
+func (w *captureResponseWriter) SetMinBlockInterval(time.Duration) {}
+func (w *captureResponseWriter) Checksum(hash.Hash)                {}
+
+func (w *captureResponseWriter) Options() map[string]string {
+	if w.options == nil {
+		w.options = make(map[string]string)
+	}
+
+	return w.options
+}
+
+func (w *captureResponseWriter) WriteError(code ErrorCode, msg string) error {
+	w.err = &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: code,
+		ErrorMsg:  msg,
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore when the requested object
+// does not exist.
+var ErrObjectNotFound = errors.New("tftp: object not found")
+
+// ObjectStore is an interface for object storage services, such as Amazon
+// S3 or Google Cloud Storage.  Get retrieves the object with the specified
+// key, returning its content and its size in bytes.  If the size is not
+// known, Get should return a negative size.  If the object does not exist,
+// Get should return an error for which errors.Is(err, ErrObjectNotFound)
+// reports true.
+type ObjectStore interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+}
+
+// ObjectStoreHandler returns a Handler which serves read requests using the
+// objects in an ObjectStore, using each requested filename as an object key.
+// Write requests are rejected.
+//
+// If a client requests the transfer size using the tsize option from RFC
+// 2349 for an octet mode transfer, and store reports the size of the object,
+// the size is acknowledged to the client.
+//
+// Any error from store other than ErrObjectNotFound is reported to the
+// client using a generic message, since it may describe the store, and is
+// reported in full by the server's Errors channel.
+func ObjectStoreHandler(store ObjectStore) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer w.Close()
+
+		if r.Opcode != OpcodeRead {
+			_ = w.WriteError(ErrorCodeAccessViolation, "server is read-only")
+			return
+		}
+
+		rc, size, err := store.Get(context.Background(), r.Filename)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				_ = w.WriteError(ErrorCodeFileNotFound, "file not found")
+				return
+			}
+
+			// The error may describe the backend, so it is only
+			// reported to the server
+			reportHandlerError(w, fmt.Errorf("tftp: object store error for %q: %w", r.Filename, err))
+			_ = w.WriteError(ErrorCodeUndefined, "storage unavailable")
+			return
+		}
+		defer rc.Close()
+
+		if _, ok := r.Options[optionTransferSize]; ok && r.Mode == ModeOctet && size >= 0 {
+			w.Options()[optionTransferSize] = strconv.FormatInt(size, 10)
+		}
+
+		_ = ServeContent(w, r, rc)
+	})
+}
@@ -0,0 +1,154 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestObjectStoreHandler verifies that ObjectStoreHandler serves objects from
+// an ObjectStore, and maps errors to the appropriate ErrorCode.
+func TestObjectStoreHandler(t *testing.T) {
+	store := &memoryObjectStore{
+		objects: map[string][]byte{
+			"boot.img": []byte("hello world"),
+		},
+		errors: map[string]error{
+			"broken.img": errors.New("backend unavailable"),
+		},
+	}
+
+	var tests = []struct {
+		description string
+		filename    string
+		mode        Mode
+		options     map[string]string
+		content     string
+		accepted    map[string]string
+		err         *ErrorPacket
+	}{
+		{
+			description: "object found",
+			filename:    "boot.img",
+			content:     "hello world",
+		},
+		{
+			description: "object found, transfer size requested",
+			filename:    "boot.img",
+			options:     map[string]string{"tsize": "0"},
+			content:     "hello world",
+			accepted:    map[string]string{"tsize": "11"},
+		},
+		{
+			description: "object found, transfer size requested in netascii mode",
+			filename:    "boot.img",
+			mode:        ModeNetASCII,
+			options:     map[string]string{"tsize": "0"},
+			content:     "hello world",
+		},
+		{
+			description: "object not found",
+			filename:    "missing.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeFileNotFound,
+				ErrorMsg:  "file not found",
+			},
+		},
+		{
+			description: "backend error",
+			filename:    "broken.img",
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeUndefined,
+				ErrorMsg:  "storage unavailable",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if tt.mode == "" {
+			tt.mode = ModeOctet
+		}
+
+		w := &captureResponseWriter{buf: bytes.NewBuffer(nil)}
+		r := NewRequest(OpcodeRead, tt.filename, tt.mode, tt.options, &net.UDPAddr{})
+
+		ObjectStoreHandler(store).ServeTFTP(w, r)
+
+		if want, got := tt.err, w.err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.content, w.buf.String(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.accepted, w.options; (len(want) > 0 || len(got) > 0) && !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected options: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// memoryObjectStore is an in-memory ObjectStore.
+type memoryObjectStore struct {
+	objects map[string][]byte
+	errors  map[string]error
+}
+
+func (s *memoryObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if err, ok := s.errors[key]; ok {
+		return nil, 0, err
+	}
+
+	b, ok := s.objects[key]
+	if !ok {
+		return nil, 0, ErrObjectNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+// TestObjectStoreHandlerErrors verifies that ObjectStoreHandler reports the
+// details of a store error using the server's Errors channel, rather than
+// sending them to the client.
+func TestObjectStoreHandlerErrors(t *testing.T) {
+	s := &Server{
+		Handler: ObjectStoreHandler(&memoryObjectStore{
+			errors: map[string]error{
+				"broken.img": errors.New("bucket secret-bucket unavailable"),
+			},
+		}),
+	}
+	errC := s.Errors()
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	_, err := testGet(t, addr, "broken.img")
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeUndefined,
+		ErrorMsg:  "storage unavailable",
+	}
+	if got := err; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	select {
+	case err := <-errC:
+		if !strings.Contains(err.Error(), "secret-bucket") {
+			t.Fatalf("unexpected reported error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
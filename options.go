@@ -0,0 +1,250 @@
+package tftp
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Block size constants taken from RFC 1350 and RFC 2348.
+const (
+	// DefaultBlockSize is the size of the data in each DATA packet, as
+	// specified in RFC 1350, unless a different block size is negotiated.
+	DefaultBlockSize = 512
+
+	// MinBlockSize and MaxBlockSize are the bounds for a block size
+	// negotiated using the blksize option, as described in RFC 2348.
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+)
+
+const (
+	// optionBlockSize is the option used to negotiate a block size, as
+	// described in RFC 2348.
+	optionBlockSize = "blksize"
+
+	// optionBlockSize2 is a non-standard option used by some clients to
+	// negotiate a block size which must be a power of two.
+	optionBlockSize2 = "blksize2"
+
+	// optionTransferSize is the option used to communicate the size of a
+	// file, as described in RFC 2349.
+	optionTransferSize = "tsize"
+
+	// optionWindowSize is the option used to negotiate the number of
+	// blocks which may be sent before an acknowledgement, as described in
+	// RFC 7440.
+	optionWindowSize = "windowsize"
+
+	// optionDeflate is a non-standard option used by cooperating clients
+	// to request that the payload of each DATA block is compressed.
+	optionDeflate = "deflate"
+
+	// optionTimeout is the option used to negotiate the number of seconds
+	// to wait before retransmitting a packet, as described in RFC 2349.
+	optionTimeout = "timeout"
+
+	// minWindowSize and maxWindowSize are the bounds for a window size
+	// negotiated using the windowsize option, as described in RFC 7440.
+	minWindowSize = 1
+	maxWindowSize = 65535
+
+	// defaultMaxBlockSize is the largest block size a Server will accept by
+	// default.  It is the largest block size which can be sent in a single
+	// Ethernet frame without IP fragmentation:
+	//  - 1500 bytes: Ethernet MTU
+	//  -   20 bytes: IPv4 header
+	//  -    8 bytes: UDP header
+	//  -    4 bytes: TFTP DATA header
+	defaultMaxBlockSize = 1468
+
+	// defaultMaxOptions is the largest number of options a Server will
+	// accept in a single request by default.
+	defaultMaxOptions = 16
+
+	// defaultMaxFilenameLength is the longest filename a Server will accept
+	// in a single request by default.
+	defaultMaxFilenameLength = 255
+
+	// minTimeout and maxTimeout are the bounds, in seconds, for a timeout
+	// negotiated using the timeout option, as described in RFC 2349.
+	minTimeout = 1
+	maxTimeout = 255
+)
+
+// errTimeoutTooLong is returned when a client negotiates a timeout which
+// would allow a transfer to exceed a server's TransferTimeout.
+var errTimeoutTooLong = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeBadOptions,
+	ErrorMsg:  "timeout exceeds transfer timeout",
+}
+
+// negotiate accepts any options in requested which are handled by the server
+// itself, storing the accepted values in accepted.  If the requested options
+// are acceptable individually, but not in combination, an *ErrorPacket is
+// returned, and the request should be rejected.
+func (s *Server) negotiate(requested map[string]string, accepted map[string]string) error {
+	// blksize is preferred over blksize2 if a client requests both
+	size := DefaultBlockSize
+	if v, ok := requested[optionBlockSize]; ok {
+		if n, ok := s.blockSize(v); ok {
+			accepted[optionBlockSize] = strconv.Itoa(n)
+			size = n
+		}
+	} else if v, ok := requested[optionBlockSize2]; ok {
+		if n, ok := s.blockSize2(v); ok {
+			accepted[optionBlockSize2] = strconv.Itoa(n)
+			size = n
+		}
+	}
+
+	if v, ok := requested[optionWindowSize]; ok {
+		if n, ok := s.windowSize(v); ok {
+			accepted[optionWindowSize] = strconv.Itoa(n)
+		}
+	}
+
+	if s.Deflate && requested[optionDeflate] == "1" {
+		accepted[optionDeflate] = "1"
+	}
+
+	if v, ok := requested[optionTimeout]; ok {
+		if d, ok := parseTimeout(v); ok {
+			if s.TransferTimeout > 0 && worstCase(requested, size, d) > s.TransferTimeout {
+				return errTimeoutTooLong
+			}
+
+			accepted[optionTimeout] = v
+		}
+	}
+
+	return nil
+}
+
+// blockSize parses a block size requested by a client, and reports the block
+// size which the server will accept.  If the requested block size is
+// invalid, blockSize returns false, and the option should be ignored.
+func (s *Server) blockSize(v string) (int, bool) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < MinBlockSize || n > MaxBlockSize {
+		return 0, false
+	}
+
+	max := s.MaxBlockSize
+	if max <= 0 {
+		max = defaultMaxBlockSize
+	}
+	if n > max {
+		n = max
+	}
+
+	return n, true
+}
+
+// blockSize2 parses a block size requested by a client using the blksize2
+// option, and reports the block size which the server will accept.  The
+// requested block size must be a power of two, and if it exceeds the
+// server's maximum block size, the largest power of two within the maximum
+// is accepted instead.
+func (s *Server) blockSize2(v string) (int, bool) {
+	n, ok := s.blockSize(v)
+	if !ok {
+		return 0, false
+	}
+
+	// blockSize only reduces the requested value, so a power of two must
+	// be checked for in the value requested by the client
+	if req, _ := strconv.Atoi(v); req&(req-1) != 0 {
+		return 0, false
+	}
+
+	p := MinBlockSize
+	for p*2 <= n {
+		p *= 2
+	}
+
+	return p, true
+}
+
+// acceptedBlockSize returns the block size accepted in options, or
+// DefaultBlockSize if no valid block size was accepted.
+func acceptedBlockSize(options map[string]string) int {
+	for _, o := range []string{optionBlockSize, optionBlockSize2} {
+		v, ok := options[o]
+		if !ok {
+			continue
+		}
+
+		if n, err := strconv.Atoi(v); err == nil && n >= MinBlockSize && n <= MaxBlockSize {
+			return n
+		}
+	}
+
+	return DefaultBlockSize
+}
+
+// windowSize parses a window size requested by a client, and reports the
+// window size which the server will accept.  If windowed transfers are not
+// enabled, or the requested window size is invalid, windowSize returns false,
+// and the option should be ignored.
+func (s *Server) windowSize(v string) (int, bool) {
+	if s.MaxWindowSize <= 1 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minWindowSize || n > maxWindowSize {
+		return 0, false
+	}
+
+	if n > s.MaxWindowSize {
+		n = s.MaxWindowSize
+	}
+
+	return n, true
+}
+
+// acceptedWindowSize returns the window size accepted in options, or 1 if
+// no valid window size was accepted, so that each block is acknowledged
+// before the next is sent.
+func acceptedWindowSize(options map[string]string) int {
+	n, err := strconv.Atoi(options[optionWindowSize])
+	if err != nil || n < minWindowSize || n > maxWindowSize {
+		return 1
+	}
+
+	return n
+}
+
+// parseTimeout parses a timeout requested by a client.  If the requested
+// timeout is invalid, parseTimeout returns false, and the option should be
+// ignored.
+func parseTimeout(v string) (time.Duration, bool) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minTimeout || n > maxTimeout {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// worstCase estimates the longest time a transfer of blocks of the specified
+// size may take if the client waits for timeout d before every block.  If the
+// client reports the size of the file it is sending using the tsize option,
+// every block is accounted for.  Otherwise, at least one block is sent.
+func worstCase(requested map[string]string, size int, d time.Duration) time.Duration {
+	blocks := int64(1)
+	if v, ok := requested[optionTransferSize]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			blocks = n/int64(size) + 1
+		}
+	}
+
+	// Avoid overflow for absurdly large files
+	if blocks > int64(math.MaxInt64/d) {
+		return math.MaxInt64
+	}
+
+	return time.Duration(blocks) * d
+}
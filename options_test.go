@@ -0,0 +1,234 @@
+package tftp
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestServer_negotiate verifies that a Server accepts the options it handles
+// when they are requested by a client.
+func TestServer_negotiate(t *testing.T) {
+	var tests = []struct {
+		description string
+		s           *Server
+		requested   map[string]string
+		accepted    map[string]string
+	}{
+		{
+			description: "no options",
+			s:           &Server{},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "unknown option ignored",
+			s:           &Server{},
+			requested:   map[string]string{"foo": "bar"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "blksize too small, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"blksize": "7"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "blksize not a number, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"blksize": "foo"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "blksize 1024, accepted",
+			s:           &Server{},
+			requested:   map[string]string{"blksize": "1024"},
+			accepted:    map[string]string{"blksize": "1024"},
+		},
+		{
+			description: "blksize 4096, default maximum accepted",
+			s:           &Server{},
+			requested:   map[string]string{"blksize": "4096"},
+			accepted:    map[string]string{"blksize": "1468"},
+		},
+		{
+			description: "blksize 4096, accepted with larger maximum",
+			s:           &Server{MaxBlockSize: 8192},
+			requested:   map[string]string{"blksize": "4096"},
+			accepted:    map[string]string{"blksize": "4096"},
+		},
+		{
+			description: "blksize2 4096, accepted with larger maximum",
+			s:           &Server{MaxBlockSize: 8192},
+			requested:   map[string]string{"blksize2": "4096"},
+			accepted:    map[string]string{"blksize2": "4096"},
+		},
+		{
+			description: "blksize2 4096, largest power of two within default maximum accepted",
+			s:           &Server{},
+			requested:   map[string]string{"blksize2": "4096"},
+			accepted:    map[string]string{"blksize2": "1024"},
+		},
+		{
+			description: "blksize2 1000, not a power of two, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"blksize2": "1000"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "blksize2 4, too small, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"blksize2": "4"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "blksize and blksize2, blksize preferred",
+			s:           &Server{},
+			requested:   map[string]string{"blksize": "1428", "blksize2": "1024"},
+			accepted:    map[string]string{"blksize": "1428"},
+		},
+		{
+			description: "windowsize 8, not enabled, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"windowsize": "8"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "windowsize 0, ignored",
+			s:           &Server{MaxWindowSize: 16},
+			requested:   map[string]string{"windowsize": "0"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "windowsize 8, accepted",
+			s:           &Server{MaxWindowSize: 16},
+			requested:   map[string]string{"windowsize": "8"},
+			accepted:    map[string]string{"windowsize": "8"},
+		},
+		{
+			description: "windowsize 64, maximum accepted",
+			s:           &Server{MaxWindowSize: 16},
+			requested:   map[string]string{"windowsize": "64"},
+			accepted:    map[string]string{"windowsize": "16"},
+		},
+		{
+			description: "deflate, not enabled, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"deflate": "1"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "deflate 0, ignored",
+			s:           &Server{Deflate: true},
+			requested:   map[string]string{"deflate": "0"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "deflate 1, accepted",
+			s:           &Server{Deflate: true},
+			requested:   map[string]string{"deflate": "1"},
+			accepted:    map[string]string{"deflate": "1"},
+		},
+		{
+			description: "timeout 0, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"timeout": "0"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "timeout 256, ignored",
+			s:           &Server{},
+			requested:   map[string]string{"timeout": "256"},
+			accepted:    map[string]string{},
+		},
+		{
+			description: "timeout 5, accepted",
+			s:           &Server{},
+			requested:   map[string]string{"timeout": "5"},
+			accepted:    map[string]string{"timeout": "5"},
+		},
+		{
+			description: "timeout 5, accepted within transfer timeout",
+			s:           &Server{TransferTimeout: 1 * time.Minute},
+			requested:   map[string]string{"timeout": "5", "tsize": "4096"},
+			accepted:    map[string]string{"timeout": "5"},
+		},
+	}
+
+	for i, tt := range tests {
+		accepted := make(map[string]string)
+		if err := tt.s.negotiate(tt.requested, accepted); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.accepted, accepted; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected options:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServer_negotiateTransferTimeout verifies that a Server rejects requests
+// which negotiate a timeout which could allow a transfer to exceed its
+// TransferTimeout.
+func TestServer_negotiateTransferTimeout(t *testing.T) {
+	var tests = []struct {
+		description string
+		requested   map[string]string
+	}{
+		{
+			description: "absurd timeout",
+			requested:   map[string]string{"timeout": "255"},
+		},
+		{
+			description: "many blocks with small timeout",
+			requested:   map[string]string{"timeout": "1", "tsize": "1048576"},
+		},
+		{
+			description: "many blocks with larger blksize",
+			requested:   map[string]string{"timeout": "1", "tsize": "1048576", "blksize": "1024"},
+		},
+		{
+			description: "huge tsize",
+			requested:   map[string]string{"timeout": "255", "tsize": "9223372036854775807"},
+		},
+	}
+
+	s := &Server{TransferTimeout: 1 * time.Minute}
+	for i, tt := range tests {
+		err := s.negotiate(tt.requested, make(map[string]string))
+		if want, got := errTimeoutTooLong, err; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServer_blockSizeBounds verifies that a Server accepts block sizes
+// within the bounds described by the exported block size constants.
+func TestServer_blockSizeBounds(t *testing.T) {
+	var tests = []struct {
+		n  int
+		ok bool
+	}{
+		{n: MinBlockSize - 1, ok: false},
+		{n: MinBlockSize, ok: true},
+		{n: DefaultBlockSize, ok: true},
+		{n: MaxBlockSize, ok: true},
+		{n: MaxBlockSize + 1, ok: false},
+	}
+
+	s := &Server{MaxBlockSize: MaxBlockSize}
+	for i, tt := range tests {
+		n, ok := s.blockSize(strconv.Itoa(tt.n))
+		if want, got := tt.ok, ok; want != got {
+			t.Fatalf("[%02d] unexpected result for block size %d: %v != %v",
+				i, tt.n, want, got)
+		}
+		if ok && n != tt.n {
+			t.Fatalf("[%02d] unexpected accepted block size: %d != %d",
+				i, tt.n, n)
+		}
+	}
+}
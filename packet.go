@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
@@ -13,12 +15,42 @@ var (
 	// received, allowing the server to reject the request.
 	errInvalidRequestPacket = errors.New("invalid request packet")
 
+	// errEmptyMode is returned when a TFTP request contains a filename, but
+	// an empty transfer mode.
+	errEmptyMode = errors.New("empty transfer mode in request packet")
+
 	// errInvalidACKPacket is returned when an invalid TFTP ACK packet is received.
 	errInvalidACKPacket = errors.New("invalid ACK packet")
 
+	// errUnexpectedOACK is returned when an OACK packet is received while
+	// waiting for an ACK packet, such as when a misconfigured network
+	// echoes the server's own OACK back to it.
+	errUnexpectedOACK = errors.New("unexpected OACK packet while waiting for ACK")
+
 	// errInvalidERRORPacket is returned when an invalid TFTP ERROR packet is
 	// received.
 	errInvalidERRORPacket = errors.New("invalid ERROR packet")
+
+	// errInvalidDATAPacket is returned when an invalid TFTP DATA packet is
+	// received, such as a packet too short to contain the opcode and block
+	// number.
+	errInvalidDATAPacket = errors.New("invalid DATA packet")
+
+	// errInvalidOACKPacket is returned when an invalid TFTP OACK packet is
+	// received.
+	errInvalidOACKPacket = errors.New("invalid OACK packet")
+
+	// errMalformedOptions is returned when a request is otherwise valid, but
+	// its options are not a series of NULL-terminated name and value pairs.
+	errMalformedOptions = errors.New("malformed options")
+
+	// errDuplicateOption is returned when a request contains more than one
+	// option with the same name.
+	errDuplicateOption = errors.New("duplicate option")
+
+	// errInvalidOption is returned when a request contains an option with
+	// an empty name, or a malformed value.
+	errInvalidOption = errors.New("invalid option")
 )
 
 // ErrorPacket represents an ERROR packet, as defined in RFC 1350, Section 5.
@@ -30,21 +62,45 @@ type ErrorPacket struct {
 	ErrorMsg  string
 }
 
-// Error returns the string representation of an ErrorPacket.
+// Error returns the string representation of an ErrorPacket.  ErrorCodes
+// which are not defined by RFC 1350 or RFC 2347 are displayed using their
+// numeric value.
 func (e *ErrorPacket) Error() string {
+	if e.ErrorCode > ErrorCodeBadOptions {
+		return fmt.Sprintf("%s: %s", e.ErrorCode.String(), e.ErrorMsg)
+	}
+
 	return fmt.Sprintf("%s (%02d): %s", e.ErrorCode.String(), e.ErrorCode, e.ErrorMsg)
 }
 
+// MarshalBinary allocates a byte slice containing the wire representation
+// of an ErrorPacket.
+func (e *ErrorPacket) MarshalBinary() ([]byte, error) {
+	// 2 bytes: opcode
+	// 2 bytes: error code
+	// n bytes: message
+	// 1 byte : NULL
+	b := make([]byte, 4+len(e.ErrorMsg)+1)
+	binary.BigEndian.PutUint16(b[0:2], uint16(OpcodeError))
+	binary.BigEndian.PutUint16(b[2:4], uint16(e.ErrorCode))
+	copy(b[4:], e.ErrorMsg)
+
+	return b, nil
+}
+
 // requestPacket represents a raw request to a TFTP server.  It is used to
 // construct a Request for client consumption.
 type requestPacket struct {
 	Opcode   Opcode
 	Filename string
 	Mode     Mode
+	Options  map[string]string
 }
 
 // parseRequestPacket attempts to parse a TFTP read or write request as a
-// requestPacket.
+// requestPacket.  If only the options of an otherwise valid request are
+// invalid, the requestPacket is returned without options, along with the
+// error, so that the client can be informed.
 func parseRequestPacket(b []byte) (*requestPacket, error) {
 	// At a minimum, requests must contain a 2 byte opcode and
 	// 2 NULL bytes
@@ -74,6 +130,12 @@ func parseRequestPacket(b []byte) (*requestPacket, error) {
 		return nil, errInvalidRequestPacket
 	}
 
+	// An empty mode is reported separately from an unknown mode, so that
+	// the cause of the failure is clear
+	if idx == 0 {
+		return nil, errEmptyMode
+	}
+
 	// Mode can be any combination of uppercase and lowercase, but for our
 	// purposes, we just want to deal with lowercase letters
 	mode := Mode(strings.ToLower(string(b[offset : offset+idx])))
@@ -83,17 +145,154 @@ func parseRequestPacket(b []byte) (*requestPacket, error) {
 		return nil, errInvalidRequestPacket
 	}
 
-	// BUG(mdlayher): implement options extension from RFC 2347.
+	p := &requestPacket{
+		Opcode:   opcode,
+		Filename: filename,
+		Mode:     mode,
+	}
+
+	// Any bytes following the mode are options, as described in RFC 2347
+	options, err := parseOptions(b[offset+idx+1:])
+	if err != nil {
+		return p, err
+	}
+	p.Options = options
+
+	return p, nil
+}
+
+// isRequest reports whether b begins with the opcode of a read or write
+// request.
+func isRequest(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+
+	op := Opcode(binary.BigEndian.Uint16(b[0:2]))
+	return op == OpcodeRead || op == OpcodeWrite
+}
+
+// parseOptions parses a series of NULL-terminated option name and value pairs,
+// as described in RFC 2347.  Option names are case insensitive, and are
+// converted to lowercase.  If no options are present, parseOptions returns
+// a nil map.  If the options do not end with a NULL byte, or contain an odd
+// number of fields, errMalformedOptions is returned.
+//
+// RFC 2347 does not define the meaning of an option which appears more than
+// once, so any duplicate option name, regardless of case, is rejected with
+// errDuplicateOption.  An empty option name, or a value which is not a
+// decimal number for an option which requires one, is rejected with
+// errInvalidOption.
+func parseOptions(b []byte) (map[string]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
 
-	// Trailing NULL byte must be present to end packet
+	// Each name and value must be terminated with a NULL byte
 	if b[len(b)-1] != 0 {
-		return nil, errInvalidRequestPacket
+		return nil, errMalformedOptions
+	}
+	fields := bytes.Split(b[:len(b)-1], []byte{0})
+	if len(fields)%2 != 0 {
+		return nil, errMalformedOptions
 	}
 
-	return &requestPacket{
-		Opcode:   opcode,
-		Filename: filename,
-		Mode:     mode,
+	options := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		value := string(fields[i+1])
+
+		if _, ok := options[name]; ok {
+			return nil, errDuplicateOption
+		}
+		if name == "" || (numericOptions[name] && !isDecimal(value)) {
+			return nil, errInvalidOption
+		}
+
+		options[name] = value
+	}
+
+	return options, nil
+}
+
+// numericOptions is the set of options whose values must be decimal numbers.
+var numericOptions = map[string]bool{
+	optionBlockSize:    true,
+	optionBlockSize2:   true,
+	optionTransferSize: true,
+	optionTimeout:      true,
+	optionOffset:       true,
+	optionResumeOffset: true,
+	optionWindowSize:   true,
+}
+
+// isDecimal reports whether s is a non-empty string of decimal digits.
+func isDecimal(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// oackPacket represents an OACK packet, as defined in RFC 2347.  An OACK
+// packet is used to acknowledge the options a server accepts from a request.
+type oackPacket struct {
+	Options map[string]string
+}
+
+// MarshalBinary allocates a byte slice containing the wire representation
+// of an oackPacket.  Options are sorted by name so that output is
+// deterministic.
+func (p *oackPacket) MarshalBinary() ([]byte, error) {
+	names := make([]string, 0, len(p.Options))
+	for k := range p.Options {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b[0:2], uint16(opcodeOACK))
+
+	for _, k := range names {
+		b = append(b, k...)
+		b = append(b, 0)
+		b = append(b, p.Options[k]...)
+		b = append(b, 0)
+	}
+
+	return b, nil
+}
+
+// parseOACKPacket attempts to parse an oackPacket from a byte slice.
+func parseOACKPacket(b []byte) (*oackPacket, error) {
+	// At a minimum, OACK packet must contain a 2 byte opcode
+	if len(b) < 2 {
+		return nil, errInvalidOACKPacket
+	}
+
+	if Opcode(binary.BigEndian.Uint16(b[0:2])) != opcodeOACK {
+		return nil, errInvalidOACKPacket
+	}
+
+	// Trailing NULL byte must be present to end any options
+	if len(b) > 2 && b[len(b)-1] != 0 {
+		return nil, errInvalidOACKPacket
+	}
+
+	options, err := parseOptions(b[2:])
+	if err != nil {
+		return nil, errInvalidOACKPacket
+	}
+
+	return &oackPacket{
+		Options: options,
 	}, nil
 }
 
@@ -106,8 +305,15 @@ type ackPacket struct {
 }
 
 // parseACKPacket attempts to parse an ackPacket from a byte slice, but may
-// also return an ErrorPacket as the error value, if an error occurs.
+// also return an ErrorPacket as the error value, if an error occurs.  An OACK
+// packet, which only a server should send, results in errUnexpectedOACK.
 func parseACKPacket(b []byte) (*ackPacket, error) {
+	// An OACK may be as short as its opcode, so it must be detected before
+	// the length of an ACK is checked
+	if len(b) >= 2 && Opcode(binary.BigEndian.Uint16(b[0:2])) == opcodeOACK {
+		return nil, errUnexpectedOACK
+	}
+
 	// At a minimum, ACK packet must contain a 2 byte opcode and a 2 byte
 	// block number
 	if len(b) < 4 {
@@ -117,37 +323,128 @@ func parseACKPacket(b []byte) (*ackPacket, error) {
 	opcode := Opcode(binary.BigEndian.Uint16(b[0:2]))
 	n := binary.BigEndian.Uint16(b[2:4])
 
-	// If length is exactly 4 and opcode is correct, return an ACK packet
-	if len(b) == 4 && opcode == opcodeACK {
+	// If length is exactly 4, the packet must be an ACK packet, since an
+	// ERROR packet must contain at least 5 bytes
+	if len(b) == 4 {
+		if opcode != opcodeACK {
+			return nil, errInvalidACKPacket
+		}
+
 		return &ackPacket{
 			Opcode: opcode,
 			Block:  n,
 		}, nil
 	}
 
-	// Verify packet is an ERROR packet
-	if opcode != OpcodeError {
-		return nil, errInvalidERRORPacket
-	}
+	return nil, parseErrorPacket(b)
+}
 
+// parseErrorPacket attempts to parse an ErrorPacket from a byte slice.  If
+// the byte slice is a valid ERROR packet, an *ErrorPacket is returned.
+// Otherwise, errInvalidERRORPacket is returned.
+func parseErrorPacket(b []byte) error {
 	// At a minimum, ERROR packet must contain:
 	//  - 2 bytes: opcode
 	//  - 2 bytes: error code
 	//  - 1 byte : NULL
 	if len(b) < 5 {
-		return nil, errInvalidERRORPacket
+		return errInvalidERRORPacket
+	}
+
+	// Verify packet is an ERROR packet
+	opcode := Opcode(binary.BigEndian.Uint16(b[0:2]))
+	if opcode != OpcodeError {
+		return errInvalidERRORPacket
 	}
 
 	msg := string(b[4 : len(b)-1])
 
 	// Trailing NULL byte mut be present to end packet
 	if b[len(b)-1] != 0 {
-		return nil, errInvalidERRORPacket
+		return errInvalidERRORPacket
 	}
 
-	return nil, &ErrorPacket{
+	return &ErrorPacket{
 		Opcode:    opcode,
-		ErrorCode: ErrorCode(n),
+		ErrorCode: ErrorCode(binary.BigEndian.Uint16(b[2:4])),
+		ErrorMsg:  msg,
+	}
+}
+
+// defaultMaxErrorMessage is the largest number of bytes of an ERROR message
+// from a client which is retained by default.
+const defaultMaxErrorMessage = 256
+
+// errorMessageTruncated marks an ERROR message which was truncated by
+// limitErrorMessage.
+const errorMessageTruncated = "..."
+
+// limitErrorMessage truncates the message of err to max bytes, if err is an
+// *ErrorPacket with a longer message, and marks the message as truncated.  The
+// message is never truncated in the middle of a UTF-8 encoded rune.  If max is
+// zero or less, defaultMaxErrorMessage is used.  Any other error is returned
+// unmodified.
+func limitErrorMessage(err error, max int) error {
+	if max <= 0 {
+		max = defaultMaxErrorMessage
+	}
+
+	p, ok := err.(*ErrorPacket)
+	if !ok || len(p.ErrorMsg) <= max {
+		return err
+	}
+
+	n := max
+	if max > len(errorMessageTruncated) {
+		n -= len(errorMessageTruncated)
+	}
+
+	// Back off to the start of a rune, so that a multi-byte rune is not
+	// split by the truncation
+	for n > 0 && !utf8.RuneStart(p.ErrorMsg[n]) {
+		n--
+	}
+
+	msg := p.ErrorMsg[:n]
+	if max > len(errorMessageTruncated) {
+		msg += errorMessageTruncated
+	}
+
+	return &ErrorPacket{
+		Opcode:    p.Opcode,
+		ErrorCode: p.ErrorCode,
 		ErrorMsg:  msg,
 	}
 }
+
+// dataPacket represents a DATA packet, as defined in RFC 1350, Section 5.
+// A DATA packet carries a single block of data from a file.
+type dataPacket struct {
+	Opcode Opcode
+	Block  uint16
+	Data   []byte
+}
+
+// parseDATAPacket attempts to parse a dataPacket from a byte slice, but may
+// also return an ErrorPacket as the error value, if an error occurs.  The
+// Data field of the dataPacket refers to the input byte slice, and is empty
+// if the packet contains only a header.  A packet shorter than the header
+// results in errInvalidDATAPacket.
+func parseDATAPacket(b []byte) (*dataPacket, error) {
+	// At a minimum, DATA packet must contain a 2 byte opcode and a 2 byte
+	// block number
+	if len(b) < 4 {
+		return nil, errInvalidDATAPacket
+	}
+
+	opcode := Opcode(binary.BigEndian.Uint16(b[0:2]))
+	if opcode == opcodeDATA {
+		return &dataPacket{
+			Opcode: opcode,
+			Block:  binary.BigEndian.Uint16(b[2:4]),
+			Data:   b[4:],
+		}, nil
+	}
+
+	return nil, parseErrorPacket(b)
+}
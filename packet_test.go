@@ -2,6 +2,7 @@ package tftp
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -44,9 +45,14 @@ func Test_parseRequestPacket(t *testing.T) {
 			err:         errInvalidRequestPacket,
 		},
 		{
-			description: "opcode, filename, netascii mode, last byte not NULL, invalid request packet",
+			description: "opcode, filename, empty mode, empty mode",
+			buf:         []byte{0, 1, 'a', 0, 0},
+			err:         errEmptyMode,
+		},
+		{
+			description: "opcode, filename, netascii mode, last byte not NULL, malformed options",
 			buf:         []byte{0, 1, 'a', 0, 'N', 'e', 't', 'A', 'S', 'C', 'I', 'I', 0, 255},
-			err:         errInvalidRequestPacket,
+			err:         errMalformedOptions,
 		},
 		{
 			description: "opcode, filename, netascii mode, OK",
@@ -66,6 +72,61 @@ func Test_parseRequestPacket(t *testing.T) {
 				Mode:     ModeOctet,
 			},
 		},
+		{
+			description: "opcode, filename, octet mode, odd number of option fields, malformed options",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00blksize\x00"...),
+			err:         errMalformedOptions,
+		},
+		{
+			description: "opcode, filename, octet mode, duplicate option, invalid request packet",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00blksize\x001024\x00BLKSIZE\x00512\x00"...),
+			err:         errDuplicateOption,
+		},
+		{
+			description: "opcode, filename, octet mode, empty option name, invalid request packet",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00\x001024\x00"...),
+			err:         errInvalidOption,
+		},
+		{
+			description: "opcode, filename, octet mode, non-numeric blksize, invalid request packet",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00blksize\x00foo\x00"...),
+			err:         errInvalidOption,
+		},
+		{
+			description: "opcode, filename, octet mode, negative tsize, invalid request packet",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00tsize\x00-1\x00"...),
+			err:         errInvalidOption,
+		},
+		{
+			description: "opcode, filename, octet mode, non-numeric resume-offset, invalid request packet",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00resume-offset\x00foo\x00"...),
+			err:         errInvalidOption,
+		},
+		{
+			description: "opcode, filename, octet mode, empty value for unknown option, OK",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00foo\x00\x00"...),
+			rp: &requestPacket{
+				Opcode:   OpcodeRead,
+				Filename: "a",
+				Mode:     ModeOctet,
+				Options: map[string]string{
+					"foo": "",
+				},
+			},
+		},
+		{
+			description: "opcode, filename, octet mode, options, OK",
+			buf:         append([]byte{0, 1, 'a', 0}, "octet\x00BlkSize\x001024\x00offset\x0010\x00"...),
+			rp: &requestPacket{
+				Opcode:   OpcodeRead,
+				Filename: "a",
+				Mode:     ModeOctet,
+				Options: map[string]string{
+					"blksize": "1024",
+					"offset":  "10",
+				},
+			},
+		},
 	}
 
 	for i, tt := range tests {
@@ -113,13 +174,33 @@ func Test_parseACKPacket(t *testing.T) {
 			},
 		},
 		{
-			description: "wrong opcode, invalid ERROR packet",
+			description: "length 4 buffer, wrong opcode, invalid ACK packet",
 			buf:         []byte{0, 1, 0, 0},
-			err:         errInvalidERRORPacket,
+			err:         errInvalidACKPacket,
 		},
 		{
-			description: "length 4 buffer, invalid ERROR packet",
+			description: "length 4 buffer, DATA opcode, invalid ACK packet",
+			buf:         []byte{0, 3, 0, 1},
+			err:         errInvalidACKPacket,
+		},
+		{
+			description: "length 4 buffer, ERROR opcode, invalid ACK packet",
 			buf:         []byte{0, 5, 0, 0},
+			err:         errInvalidACKPacket,
+		},
+		{
+			description: "OACK packet, no options, unexpected OACK",
+			buf:         []byte{0, 6},
+			err:         errUnexpectedOACK,
+		},
+		{
+			description: "OACK packet, blksize option, unexpected OACK",
+			buf:         []byte{0, 6, 'b', 'l', 'k', 's', 'i', 'z', 'e', 0, '5', '1', '2', 0},
+			err:         errUnexpectedOACK,
+		},
+		{
+			description: "length 5 buffer, wrong opcode, invalid ERROR packet",
+			buf:         []byte{0, 1, 0, 0, 0},
 			err:         errInvalidERRORPacket,
 		},
 		{
@@ -135,6 +216,15 @@ func Test_parseACKPacket(t *testing.T) {
 				ErrorCode: ErrorCodeFileNotFound,
 			},
 		},
+		{
+			description: "ERROR packet, unknown code 42, 'abc' message, OK",
+			buf:         []byte{0, 5, 0, 42, 'a', 'b', 'c', 0},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCode(42),
+				ErrorMsg:  "abc",
+			},
+		},
 		{
 			description: "ERROR packet, disk full, 'abc' message, OK",
 			buf:         []byte{0, 5, 0, 3, 'a', 'b', 'c', 0},
@@ -163,3 +253,234 @@ func Test_parseACKPacket(t *testing.T) {
 		}
 	}
 }
+
+// Test_oackPacketRoundTrip verifies that an oackPacket can be marshaled to
+// binary form, and parsed back into an identical oackPacket.
+func Test_oackPacketRoundTrip(t *testing.T) {
+	var tests = []struct {
+		description string
+		p           *oackPacket
+	}{
+		{
+			description: "no options",
+			p:           &oackPacket{},
+		},
+		{
+			description: "blksize and tsize options",
+			p: &oackPacket{
+				Options: map[string]string{
+					"blksize": "1428",
+					"tsize":   "1048576",
+				},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		b, err := tt.p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := parseOACKPacket(b)
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.p, p; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packet:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_parseOACKPacket verifies that parseOACKPacket rejects invalid OACK
+// packets.
+func Test_parseOACKPacket(t *testing.T) {
+	var tests = []struct {
+		description string
+		buf         []byte
+	}{
+		{
+			description: "nil buffer",
+		},
+		{
+			description: "ACK opcode",
+			buf:         []byte{0, 4, 0, 0},
+		},
+		{
+			description: "no trailing NULL",
+			buf:         append([]byte{0, 6}, "blksize\x001428"...),
+		},
+		{
+			description: "odd number of option fields",
+			buf:         append([]byte{0, 6}, "blksize\x00"...),
+		},
+	}
+
+	for i, tt := range tests {
+		if _, err := parseOACKPacket(tt.buf); err != errInvalidOACKPacket {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, errInvalidOACKPacket, err)
+		}
+	}
+}
+
+// TestErrorPacketError verifies that ErrorPacket.Error returns a readable
+// string for both known and unknown error codes.
+func TestErrorPacketError(t *testing.T) {
+	var tests = []struct {
+		code ErrorCode
+		s    string
+	}{
+		{
+			code: ErrorCodeFileNotFound,
+			s:    "ErrorCodeFileNotFound (01): foo",
+		},
+		{
+			code: ErrorCodeBadOptions,
+			s:    "ErrorCodeBadOptions (08): foo",
+		},
+		{
+			code: ErrorCode(42),
+			s:    "ErrorCode(42): foo",
+		},
+	}
+
+	for i, tt := range tests {
+		e := &ErrorPacket{
+			Opcode:    OpcodeError,
+			ErrorCode: tt.code,
+			ErrorMsg:  "foo",
+		}
+
+		if want, got := tt.s, e.Error(); want != got {
+			t.Fatalf("[%02d] unexpected error string: %q != %q",
+				i, want, got)
+		}
+	}
+}
+
+// Test_parseDATAPacket verifies that parseDATAPacket returns a correct
+// dataPacket or error (possibly an ErrorPacket) for an input byte slice.
+func Test_parseDATAPacket(t *testing.T) {
+	var tests = []struct {
+		description string
+		buf         []byte
+		data        *dataPacket
+		err         error
+	}{
+		{
+			description: "nil buffer, invalid DATA packet",
+			err:         errInvalidDATAPacket,
+		},
+		{
+			description: "length 2 buffer, invalid DATA packet",
+			buf:         []byte{0, 3},
+			err:         errInvalidDATAPacket,
+		},
+		{
+			description: "length 3 buffer, invalid DATA packet",
+			buf:         []byte{0, 3, 0},
+			err:         errInvalidDATAPacket,
+		},
+		{
+			description: "length 4 buffer, empty payload, OK",
+			buf:         []byte{0, 3, 0, 1},
+			data: &dataPacket{
+				Opcode: opcodeDATA,
+				Block:  1,
+				Data:   []byte{},
+			},
+		},
+		{
+			description: "DATA packet, block 2, 'abc' payload, OK",
+			buf:         []byte{0, 3, 0, 2, 'a', 'b', 'c'},
+			data: &dataPacket{
+				Opcode: opcodeDATA,
+				Block:  2,
+				Data:   []byte{'a', 'b', 'c'},
+			},
+		},
+		{
+			description: "ERROR packet, disk full, 'abc' message, OK",
+			buf:         []byte{0, 5, 0, 3, 'a', 'b', 'c', 0},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeDiskFull,
+				ErrorMsg:  "abc",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		data, err := parseDATAPacket(tt.buf)
+		if want, got := tt.err, err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.data, data; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packet:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_limitErrorMessage verifies that limitErrorMessage truncates the
+// message of an ERROR packet parsed from a client if it is too long.
+func Test_limitErrorMessage(t *testing.T) {
+	var tests = []struct {
+		description string
+		msg         string
+		max         int
+		out         string
+	}{
+		{
+			description: "short message, unmodified",
+			msg:         "disk full",
+			out:         "disk full",
+		},
+		{
+			description: "message at maximum, unmodified",
+			msg:         "0123456789",
+			max:         10,
+			out:         "0123456789",
+		},
+		{
+			description: "message over maximum, truncated",
+			msg:         "0123456789a",
+			max:         10,
+			out:         "0123456...",
+		},
+		{
+			description: "message over maximum, truncated at rune boundary",
+			msg:         "012345\u00e9\u00e9\u00e9",
+			max:         10,
+			out:         "012345...",
+		},
+		{
+			description: "oversized message, truncated to default maximum",
+			msg:         strings.Repeat("a", 64<<10),
+			out:         strings.Repeat("a", defaultMaxErrorMessage-3) + "...",
+		},
+	}
+
+	for i, tt := range tests {
+		b := append([]byte{0, 5, 0, 0}, tt.msg...)
+		b = append(b, 0)
+
+		_, err := parseACKPacket(b)
+		p, ok := limitErrorMessage(err, tt.max).(*ErrorPacket)
+		if !ok {
+			t.Fatalf("[%02d] test %q, expected ERROR packet, but got: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.out, p.ErrorMsg; want != got {
+			t.Fatalf("[%02d] test %q, unexpected message:\n- want: %q\n-  got: %q",
+				i, tt.description, want, got)
+		}
+	}
+}
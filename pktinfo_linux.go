@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package tftp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// requestReader returns a readFunc which reads request packets from p.  If p
+// is a UDP socket, the local IP address and interface on which each packet
+// was received are reported using the IP_PKTINFO and IPV6_PKTINFO socket
+// options.
+func requestReader(p net.PacketConn) readFunc {
+	c, ok := p.(*net.UDPConn)
+	if !ok || !enablePktinfo(c) {
+		return readFrom(p)
+	}
+
+	oob := make([]byte, 128)
+	return func(b []byte) (int, net.Addr, packetInfo, error) {
+		n, oobn, _, addr, err := c.ReadMsgUDP(b, oob)
+		if err != nil {
+			return n, nil, packetInfo{}, err
+		}
+
+		return n, addr, parsePktinfo(oob[:oobn]), nil
+	}
+}
+
+// enablePktinfo requests that the kernel report the destination address of
+// each packet received by c.  Both IPv4 and IPv6 options are set, since an
+// IPv6 socket may also receive IPv4 packets.
+func enablePktinfo(c *net.UDPConn) bool {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var ok bool
+	err = rc.Control(func(fd uintptr) {
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1) == nil {
+			ok = true
+		}
+		if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1) == nil {
+			ok = true
+		}
+	})
+
+	return err == nil && ok
+}
+
+// parsePktinfo parses the local IP address from which a reply should be sent,
+// and the receiving interface index, from the control messages in oob.  For
+// IPv4, this is the specific destination chosen by the kernel, which is a
+// unicast address on the receiving interface even if the packet was sent to
+// a broadcast address, as is common with PXE relays.  If no address is
+// present, or the address is a multicast address or an IPv6 link-local
+// address which would require a zone to bind to, the returned IP address is
+// nil, but the interface index is still reported.
+func parsePktinfo(oob []byte) packetInfo {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return packetInfo{}
+	}
+
+	for _, m := range msgs {
+		var info packetInfo
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO:
+			if len(m.Data) < syscall.SizeofInet4Pktinfo {
+				continue
+			}
+			pi := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			info = packetInfo{
+				ip:      net.IP(pi.Spec_dst[:]),
+				ifIndex: int(pi.Ifindex),
+			}
+
+			// The specific destination is not computed for packets which
+			// were queued before IP_PKTINFO was enabled, so the packet's
+			// destination is used instead, unless it is a broadcast
+			// address which cannot be bound to
+			if info.ip.IsUnspecified() && !net.IP(pi.Addr[:]).Equal(net.IPv4bcast) {
+				info.ip = net.IP(pi.Addr[:])
+			}
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO:
+			if len(m.Data) < syscall.SizeofInet6Pktinfo {
+				continue
+			}
+			pi := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			info = packetInfo{
+				ip:      net.IP(pi.Addr[:]),
+				ifIndex: int(pi.Ifindex),
+			}
+		default:
+			continue
+		}
+
+		if info.ip.IsLinkLocalUnicast() || info.ip.IsMulticast() || info.ip.IsUnspecified() {
+			info.ip = nil
+			return info
+		}
+
+		if ip4 := info.ip.To4(); ip4 != nil {
+			info.ip = ip4
+		}
+
+		info.ip = append(net.IP(nil), info.ip...)
+		return info
+	}
+
+	return packetInfo{}
+}
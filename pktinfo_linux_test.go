@@ -0,0 +1,215 @@
+//go:build linux
+// +build linux
+
+package tftp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Test_requestReaderLocalIP verifies that requestReader reports the local IP
+// address and interface on which a packet was received by a socket bound to
+// a wildcard address.
+func Test_requestReaderLocalIP(t *testing.T) {
+	p, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, port, err := net.SplitHostPort(p.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := net.ResolveUDPAddr("udp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel only reports the interface for packets received after
+	// the socket options are set
+	read := requestReader(p)
+
+	if _, err := c.WriteTo([]byte("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 16)
+	n, addr, info, err := read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "hello", string(b[:n]); want != got {
+		t.Fatalf("unexpected packet: %q != %q", want, got)
+	}
+	if want, got := c.LocalAddr().String(), addr.String(); want != got {
+		t.Fatalf("unexpected remote address: %v != %v", want, got)
+	}
+	if want, got := net.IPv4(127, 0, 0, 1), info.ip; !want.Equal(got) {
+		t.Fatalf("unexpected local IP: %v != %v", want, got)
+	}
+	if want, got := testLoopbackIndex(t), info.ifIndex; want != got {
+		t.Fatalf("unexpected interface index: %v != %v", want, got)
+	}
+}
+
+// TestServerBindsLocalIP verifies that a Server listening on a wildcard
+// address binds each transfer socket to the address on which the request was
+// received.
+func TestServerBindsLocalIP(t *testing.T) {
+	p, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	local := make(chan net.Addr, 1)
+	s := &Server{
+		Addr: p.LocalAddr().String(),
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			bsw := w.(*response).bsw
+			if err := bsw.bind(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			local <- bsw.conn.LocalAddr()
+		}),
+	}
+	go func() {
+		_ = s.Serve(p)
+	}()
+
+	_, port, err := net.SplitHostPort(p.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := net.ResolveUDPAddr("udp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testRRQ("foo"), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case addr := <-local:
+		if want, got := net.IPv4(127, 0, 0, 1), addr.(*net.UDPAddr).IP; !want.Equal(got) {
+			t.Fatalf("unexpected transfer socket address: %v != %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+// testLoopbackIndex returns the index of the interface which is assigned
+// 127.0.0.1.
+func testLoopbackIndex(t *testing.T) int {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ifi := range ifis {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				return ifi.Index
+			}
+		}
+	}
+
+	t.Skip("no interface is assigned 127.0.0.1")
+	return 0
+}
+
+// Test_parsePktinfoBroadcast verifies that parsePktinfo reports the local
+// unicast address of the receiving interface, rather than the destination
+// address of the packet, when a request is sent to a broadcast address.
+func Test_parsePktinfoBroadcast(t *testing.T) {
+	var tests = []struct {
+		description string
+		specDst     [4]byte
+		dst         [4]byte
+		ip          net.IP
+	}{
+		{
+			description: "unicast",
+			specDst:     [4]byte{192, 168, 1, 10},
+			dst:         [4]byte{192, 168, 1, 10},
+			ip:          net.IPv4(192, 168, 1, 10),
+		},
+		{
+			description: "subnet broadcast",
+			specDst:     [4]byte{192, 168, 1, 10},
+			dst:         [4]byte{192, 168, 1, 255},
+			ip:          net.IPv4(192, 168, 1, 10),
+		},
+		{
+			description: "limited broadcast",
+			specDst:     [4]byte{192, 168, 1, 10},
+			dst:         [4]byte{255, 255, 255, 255},
+			ip:          net.IPv4(192, 168, 1, 10),
+		},
+		{
+			description: "no specific destination, unicast",
+			dst:         [4]byte{192, 168, 1, 10},
+			ip:          net.IPv4(192, 168, 1, 10),
+		},
+		{
+			description: "no specific destination, limited broadcast",
+			dst:         [4]byte{255, 255, 255, 255},
+		},
+	}
+
+	for i, tt := range tests {
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+
+		pi := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		pi.Ifindex = 2
+		pi.Spec_dst = tt.specDst
+		pi.Addr = tt.dst
+
+		info := parsePktinfo(oob)
+		if want, got := tt.ip, info.ip; !want.Equal(got) {
+			t.Fatalf("[%02d] test %q, unexpected local IP: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := 2, info.ifIndex; want != got {
+			t.Fatalf("[%02d] test %q, unexpected interface index: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package tftp
+
+import (
+	"net"
+)
+
+// requestReader returns a readFunc which reads request packets from p.  The
+// local IP address on which each packet was received is not reported on this
+// platform.
+func requestReader(p net.PacketConn) readFunc {
+	return readFrom(p)
+}
@@ -0,0 +1,107 @@
+package tftp
+
+import (
+	"io"
+)
+
+// readAhead is an io.Reader which reads blocks from an underlying io.Reader
+// in a separate goroutine, ahead of the blocks read from it, so that a slow
+// source may be read while earlier blocks are being sent.
+type readAhead struct {
+	blocks chan readAheadBlock
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+
+	// The block currently being read, its buffer, and the error which
+	// follows it, if any
+	cur []byte
+	buf []byte
+	err error
+}
+
+// readAheadBlock is a single block read by a readAhead, and the error which
+// ended reading, if any.
+type readAheadBlock struct {
+	b   []byte
+	err error
+}
+
+// newReadAhead creates a readAhead which reads up to n blocks of the
+// specified size from src ahead of the blocks read from it.  close must be
+// called once reading is complete.
+func newReadAhead(src io.Reader, n int, size int) *readAhead {
+	ra := &readAhead{
+		blocks: make(chan readAheadBlock, n),
+		free:   make(chan []byte, n+1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	// One buffer is held by the reader while the others are filled
+	for i := 0; i < n+1; i++ {
+		ra.free <- make([]byte, size)
+	}
+
+	go ra.fill(src)
+	return ra
+}
+
+// fill reads whole blocks from src until src returns an error, or close is
+// called.
+func (ra *readAhead) fill(src io.Reader) {
+	defer close(ra.exited)
+
+	for {
+		var b []byte
+		select {
+		case b = <-ra.free:
+		case <-ra.done:
+			return
+		}
+
+		// A short block can only occur at the end of src
+		n, err := io.ReadFull(src, b)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		select {
+		case ra.blocks <- readAheadBlock{b: b[:n], err: err}:
+		case <-ra.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.err != nil {
+			return 0, ra.err
+		}
+
+		// Return the exhausted buffer to be filled again
+		if ra.buf != nil {
+			ra.free <- ra.buf[:cap(ra.buf)]
+		}
+
+		blk := <-ra.blocks
+		ra.cur, ra.buf, ra.err = blk.b, blk.b, blk.err
+	}
+
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// close stops reading ahead, and waits until the underlying io.Reader is no
+// longer being read.
+func (ra *readAhead) close() {
+	close(ra.done)
+	<-ra.exited
+}
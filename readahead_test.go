@@ -0,0 +1,121 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestResponseReadFromReadAhead verifies that a response sends the same
+// packets when reading ahead as it does without reading ahead.
+func TestResponseReadFromReadAhead(t *testing.T) {
+	var tests = []struct {
+		description string
+		size        int
+	}{
+		{
+			description: "empty",
+		},
+		{
+			description: "partial block",
+			size:        100,
+		},
+		{
+			description: "exact blocks",
+			size:        4 * 512,
+		},
+		{
+			description: "more blocks than read ahead",
+			size:        20*512 + 100,
+		},
+	}
+
+	for i, tt := range tests {
+		p := make([]byte, tt.size)
+		for j := range p {
+			p[j] = byte(j)
+		}
+
+		var writes [2][][]byte
+		for j, blocks := range []int{0, 4} {
+			c := &ackPacketConn{}
+			w := newTestResponseWriter(c)
+			w.server = &Server{ReadAheadBlocks: blocks}
+			w.options[optionBlockSize] = "512"
+			r := &response{ResponseWriter: w, bsw: w}
+
+			src := struct{ io.Reader }{bytes.NewReader(p)}
+			n, err := r.ReadFrom(src)
+			if err != nil {
+				t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+			}
+			if want, got := int64(tt.size), n; want != got {
+				t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+					i, tt.description, want, got)
+			}
+
+			writes[j] = c.writes
+		}
+
+		if want, got := len(writes[0]), len(writes[1]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+		for j := range writes[0] {
+			if want, got := writes[0][j], writes[1][j]; !bytes.Equal(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected packet %d", i, tt.description, j)
+			}
+		}
+	}
+}
+
+// jitterReader is an io.Reader which pauses before some reads, simulating a
+// source which usually keeps up, but occasionally stalls.
+type jitterReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (j *jitterReader) Read(p []byte) (int, error) {
+	j.reads++
+	if j.reads%8 == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return j.r.Read(p)
+}
+
+// BenchmarkResponseReadFromJitter measures the sustained throughput of
+// sending content from a jittery source to a client which takes time to
+// acknowledge each block, with and without reading ahead.
+func BenchmarkResponseReadFromJitter(b *testing.B) {
+	p := make([]byte, 64*512)
+
+	for _, blocks := range []int{0, 16} {
+		b.Run(strconv.Itoa(blocks), func(b *testing.B) {
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c := &hookPacketConn{
+					ackPacketConn: ackPacketConn{discard: true},
+					hook: func(_ []byte) {
+						time.Sleep(500 * time.Microsecond)
+					},
+				}
+
+				w := newTestResponseWriter(c)
+				w.server = &Server{ReadAheadBlocks: blocks}
+				w.options[optionBlockSize] = "512"
+				r := &response{ResponseWriter: w, bsw: w}
+
+				src := &jitterReader{r: bytes.NewReader(p)}
+				if _, err := r.ReadFrom(src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// receiver is implemented by ResponseWriters which can receive content from
+// a client in response to a write request.
+type receiver interface {
+	receive(dst io.Writer) (int64, error)
+}
+
+// receive acknowledges a write request, and writes the data from each DATA
+// packet sent by a client to dst, until a block shorter than the block size
+// ends the transfer.  The number of bytes written to dst is returned.
+//
+// No acknowledgement is sent to the client until receive is called, so a
+// handler may reject a write request by calling WriteError instead.
+func (w *bufferedSocketResponseWriter) receive(dst io.Writer) (int64, error) {
+	if !w.acquire() {
+		return 0, ErrConcurrentWrite
+	}
+	defer w.release()
+
+	if w.state == stateClosed {
+		return 0, ErrWriteAfterClose
+	}
+	w.receiving = true
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+
+	// Acknowledge the request with block 0 to begin the transfer, or with
+	// an OACK if any options were accepted
+	b := w.ack(0)
+	if len(w.options) > 0 {
+		var err error
+		b, err = (&oackPacket{Options: w.options}).MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var n int64
+	for {
+		var data *dataPacket
+		err := w.exchange(b, w.block+1, func(p []byte) (bool, error) {
+			var err error
+			data, err = parseDATAPacket(p)
+			if err == errInvalidDATAPacket {
+				// The client sent a packet which cannot be parsed,
+				// so the transfer cannot continue
+				_ = w.WriteError(ErrorCodeIllegalOperation, "malformed DATA packet")
+				return false, err
+			}
+			if err != nil {
+				return false, err
+			}
+
+			// If client sends the previous block again, it did not receive
+			// the last ACK, so it must be sent again
+			return data.Block == w.block+1, nil
+		})
+		if err != nil {
+			return n, err
+		}
+		w.block++
+
+		payload := data.Data
+		if w.mode == ModeNetASCII {
+			payload = fromNetASCII(payload)
+		}
+
+		wn, err := dst.Write(payload)
+		n += int64(wn)
+		w.countBytes(wn)
+		if err != nil {
+			// Inform the client that the transfer cannot continue, such
+			// as when a disk is full
+			writeError(w, ErrorFromOS(err))
+			return n, err
+		}
+		w.checksum(data.Data)
+
+		b = w.ack(w.block)
+
+		// A block shorter than the block size signals the end of the
+		// transfer, and only needs to be acknowledged once
+		if len(data.Data) < w.size {
+			atomic.StoreInt32(&w.final, 1)
+			if _, err := w.conn.WriteTo(b, w.remoteAddr); err != nil {
+				return n, err
+			}
+
+			w.state = stateFlushed
+			w.complete = true
+			w.end()
+			return n, nil
+		}
+	}
+}
+
+// ack creates an ACK packet for the specified block in the write buffer,
+// so that it may be sent again while dallying.
+func (w *bufferedSocketResponseWriter) ack(block uint16) []byte {
+	binary.BigEndian.PutUint16(w.wb[0:2], uint16(opcodeACK))
+	binary.BigEndian.PutUint16(w.wb[2:4], block)
+	w.n = 4
+
+	return w.wb[:w.n]
+}
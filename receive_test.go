@@ -0,0 +1,179 @@
+package tftp
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Test_bufferedSocketResponseWriterReceive verifies that
+// bufferedSocketResponseWriter acknowledges each DATA packet received from a
+// client, and writes its data to the destination.
+func Test_bufferedSocketResponseWriterReceive(t *testing.T) {
+	block1 := append([]byte{0, 3, 0, 1}, bytes.Repeat([]byte{'a'}, DefaultBlockSize)...)
+	block2 := append([]byte{0, 3, 0, 2}, "bc"...)
+
+	var tests = []struct {
+		description string
+		reads       []testRead
+		writes      [][]byte
+	}{
+		{
+			description: "two blocks",
+			reads: []testRead{
+				{b: block1},
+				{b: block2},
+			},
+			writes: [][]byte{
+				{0, 4, 0, 0},
+				{0, 4, 0, 1},
+				{0, 4, 0, 2},
+			},
+		},
+		{
+			description: "two blocks, first block sent twice",
+			reads: []testRead{
+				{b: block1},
+				{b: block1},
+				{b: block2},
+			},
+			writes: [][]byte{
+				{0, 4, 0, 0},
+				{0, 4, 0, 1},
+				{0, 4, 0, 1},
+				{0, 4, 0, 2},
+			},
+		},
+		{
+			description: "two blocks, timeout waiting for second block",
+			reads: []testRead{
+				{b: block1},
+				{err: errTestTimeout},
+				{b: block2},
+			},
+			writes: [][]byte{
+				{0, 4, 0, 0},
+				{0, 4, 0, 1},
+				{0, 4, 0, 1},
+				{0, 4, 0, 2},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+
+		dst := bytes.NewBuffer(nil)
+		n, err := w.receive(dst)
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		want := append(bytes.Repeat([]byte{'a'}, DefaultBlockSize), "bc"...)
+		if got := dst.Bytes(); !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		if want, got := int64(len(want)), n; want != got {
+			t.Fatalf("[%02d] test %q, unexpected byte count: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterReceiveMalformed verifies that
+// bufferedSocketResponseWriter aborts a transfer with an illegal operation
+// ERROR packet if the client sends a DATA packet shorter than its header.
+func Test_bufferedSocketResponseWriterReceiveMalformed(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		{b: []byte{0, 3, 0}},
+	}}
+	w := newTestResponseWriter(c)
+
+	if _, err := w.receive(bytes.NewBuffer(nil)); err != errInvalidDATAPacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := [][]byte{
+		{0, 4, 0, 0},
+		append([]byte{0, 5, 0, 4}, "malformed DATA packet\x00"...),
+	}
+	if got := c.writes; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected packets:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterReceiveBlockSize verifies that
+// bufferedSocketResponseWriter receives full blocks without truncation
+// when a large block size is negotiated.
+func Test_bufferedSocketResponseWriterReceiveBlockSize(t *testing.T) {
+	const size = 4096
+	full := bytes.Repeat([]byte{'a'}, size)
+
+	c := &testPacketConn{reads: []testRead{
+		{b: append([]byte{0, 3, 0, 1}, full...)},
+		{b: append([]byte{0, 3, 0, 2}, full...)},
+		{b: append([]byte{0, 3, 0, 3}, "bc"...)},
+	}}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize] = "4096"
+
+	dst := bytes.NewBuffer(nil)
+	if _, err := w.receive(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append(full, full...), "bc"...)
+	if got := dst.Bytes(); !bytes.Equal(want, got) {
+		t.Fatalf("unexpected content: %d bytes != %d bytes", len(want), len(got))
+	}
+
+	wantWrites := [][]byte{
+		append([]byte{0, 6}, "blksize\x004096\x00"...),
+		{0, 4, 0, 1},
+		{0, 4, 0, 2},
+		{0, 4, 0, 3},
+	}
+	if got := c.writes; !reflect.DeepEqual(wantWrites, got) {
+		t.Fatalf("unexpected packets:\n- want: %v\n-  got: %v", wantWrites, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterReceiveDiskFull verifies that
+// bufferedSocketResponseWriter aborts a transfer with an ERROR packet when
+// its destination cannot be written.
+func Test_bufferedSocketResponseWriterReceiveDiskFull(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		{b: append([]byte{0, 3, 0, 1}, "abc"...)},
+	}}
+	w := newTestResponseWriter(c)
+
+	errDiskFull := &os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}
+	if _, err := w.receive(errWriter{errDiskFull}); err != errDiskFull {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := [][]byte{
+		{0, 4, 0, 0},
+		append([]byte{0, 5, 0, 3}, syscall.ENOSPC.Error()+"\x00"...),
+	}
+	if got := c.writes; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected packets:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// errWriter is an io.Writer which always returns an error.
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write(p []byte) (int, error) { return 0, w.err }
@@ -2,6 +2,7 @@ package tftp
 
 import (
 	"net"
+	"strings"
 )
 
 // Request represents a processed TFTP request received by a server.
@@ -19,30 +20,102 @@ type Request struct {
 	// octet.
 	Mode Mode
 
-	// Length of the TFTP request, in bytes.
+	// Options specifies any options requested by a client, as described in
+	// RFC 2347.  Option names are always lowercase.  Options is nil if no
+	// options were requested.
+	Options map[string]string
+
+	// Length of the TFTP request, in bytes, including any options.
 	Length int64
 
+	// OptionsLength is the number of bytes of the request consumed by
+	// options, including the NULL bytes which terminate each option name
+	// and value.  OptionsLength is 0 if no options were requested.
+	OptionsLength int64
+
+	// Raw contains a copy of the request packet as it was received, which
+	// is useful for debugging clients which send unusual requests.  Raw is
+	// only set if the server's CaptureRawRequest option is enabled.
+	Raw []byte
+
 	// Network address which was used to contact the TFTP server.  The server
 	// will automatically set up a socket to communicate with this address.
 	RemoteAddr string
+
+	// IfIndex is the index of the network interface on which the request
+	// was received, which may be used to serve different content to
+	// clients on different networks, such as VLANs.  IfIndex is 0 if the
+	// interface is not known, which is always the case on platforms other
+	// than Linux.
+	IfIndex int
+}
+
+// NewRequest creates a new Request using the specified parameters, as if it
+// had been received by a server from the client at remote.  NewRequest is
+// useful for testing Handler implementations without a running server.
+// Option names are converted to lowercase.  If remote is nil, RemoteAddr is
+// left empty.
+func NewRequest(op Opcode, filename string, mode Mode, opts map[string]string, remote net.Addr) *Request {
+	// Compute the length of an equivalent request packet:
+	//  - 2 bytes: opcode
+	//  - n bytes: filename and NULL
+	//  - n bytes: mode and NULL
+	//  - n bytes: option names and values, each with NULL
+	length := 2 + len(filename) + 1 + len(mode) + 1
+
+	var (
+		options       map[string]string
+		optionsLength int
+	)
+	if len(opts) > 0 {
+		options = make(map[string]string, len(opts))
+		for k, v := range opts {
+			options[strings.ToLower(k)] = v
+			optionsLength += len(k) + 1 + len(v) + 1
+		}
+	}
+	length += optionsLength
+
+	var remoteAddr string
+	if remote != nil {
+		remoteAddr = remote.String()
+	}
+
+	return &Request{
+		Opcode:        op,
+		Filename:      filename,
+		Mode:          mode,
+		Options:       options,
+		Length:        int64(length),
+		OptionsLength: int64(optionsLength),
+		RemoteAddr:    remoteAddr,
+	}
 }
 
 // parseRequest creates a new Request from an input byte slice and UDP address.
 // It populates the basic struct members which can be used in a TFTP handler.
 //
 // If the input byte slice is not a valid TFTP request packet, errInvalidRequestPacket
-// is returned.
+// is returned.  If the request contains an empty transfer mode, errEmptyMode is
+// returned.  If only the request's options are invalid, the Request is
+// returned without options, along with the error from parsing the options.
 func parseRequest(b []byte, remoteAddr net.Addr) (*Request, error) {
 	p, err := parseRequestPacket(b)
-	if err != nil {
+	if p == nil {
 		return nil, err
 	}
 
+	// Any bytes following the opcode, filename, mode, and their NULL bytes
+	// are options
+	base := 2 + len(p.Filename) + 1 + len(p.Mode) + 1
+
 	return &Request{
-		Opcode:     p.Opcode,
-		Filename:   p.Filename,
-		Mode:       p.Mode,
-		Length:     int64(len(b)),
-		RemoteAddr: remoteAddr.String(),
-	}, nil
+		Opcode:        p.Opcode,
+		Filename:      p.Filename,
+		Mode:          p.Mode,
+		Options:       p.Options,
+		Length:        int64(len(b)),
+		OptionsLength: int64(len(b) - base),
+		RemoteAddr:    remoteAddr.String(),
+	}, err
 }
@@ -0,0 +1,114 @@
+package tftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestNewRequest verifies that NewRequest creates a Request identical to one
+// parsed from an equivalent request packet.
+func TestNewRequest(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6969}
+	b := append([]byte{0, 1}, "boot.img\x00octet\x00blksize\x001428\x00"...)
+
+	want, err := parseRequest(b, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := NewRequest(OpcodeRead, "boot.img", ModeOctet, map[string]string{
+		"BlkSize": "1428",
+	}, addr)
+
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected Request:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// TestNewRequestNilAddr verifies that NewRequest leaves RemoteAddr empty when
+// no remote address is specified.
+func TestNewRequestNilAddr(t *testing.T) {
+	r := NewRequest(OpcodeRead, "boot.img", ModeOctet, nil, nil)
+	if want, got := "", r.RemoteAddr; want != got {
+		t.Fatalf("unexpected remote address: %q != %q", want, got)
+	}
+}
+
+// Test_parseRequestLength verifies that parseRequest reports the total length
+// of a request, and the number of bytes consumed by its options.
+func Test_parseRequestLength(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6969}
+
+	var tests = []struct {
+		description   string
+		b             []byte
+		length        int64
+		optionsLength int64
+	}{
+		{
+			description: "no options",
+			b:           append([]byte{0, 1}, "boot.img\x00octet\x00"...),
+			length:      17,
+		},
+		{
+			description:   "one option",
+			b:             append([]byte{0, 1}, "boot.img\x00octet\x00blksize\x001428\x00"...),
+			length:        30,
+			optionsLength: 13,
+		},
+		{
+			description:   "two options, mixed case mode",
+			b:             append([]byte{0, 1}, "boot.img\x00OcTeT\x00blksize\x001428\x00tsize\x000\x00"...),
+			length:        38,
+			optionsLength: 21,
+		},
+	}
+
+	for i, tt := range tests {
+		r, err := parseRequest(tt.b, addr)
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		if want, got := tt.length, r.Length; want != got {
+			t.Fatalf("[%02d] test %q, unexpected length: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.optionsLength, r.OptionsLength; want != got {
+			t.Fatalf("[%02d] test %q, unexpected options length: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestNewRequestHandler verifies that a Handler can be tested in isolation
+// using a Request created by NewRequest.
+func TestNewRequestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testWriteFile(t, filepath.Join(dir, "boot.img"), "hello world", time.Now())
+
+	b := bytes.NewBuffer(nil)
+	w := &captureResponseWriter{buf: b}
+	r := NewRequest(OpcodeRead, "boot.img", ModeOctet, nil, &net.UDPAddr{
+		IP:   net.IPv4(192, 168, 1, 1),
+		Port: 6969,
+	})
+
+	fs := &FileServer{Root: dir}
+	fs.ServeTFTP(w, r)
+
+	if want, got := "hello world", b.String(); want != got {
+		t.Fatalf("unexpected content: %q != %q", want, got)
+	}
+}
@@ -2,100 +2,471 @@ package tftp
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"math"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// blockSize is the RFC 1350 specified DATA packet size for a
-	// single read or write.
-	blockSize = 512
+	// timeout is the amount of time to wait for a reply from a client
+	// before retrying an operation.
+	timeout = 2 * time.Second
 )
 
+// ErrWriteAfterClose is returned when a ResponseWriter is written to or
+// flushed after it has been closed.
+var ErrWriteAfterClose = errors.New("tftp: write after close")
+
+// ErrWriteAfterFlush is returned when a ResponseWriter is written to after
+// the final block of the transfer has been sent, such as by a call to Flush.
+var ErrWriteAfterFlush = errors.New("tftp: write after flush")
+
+// ErrConcurrentWrite is returned when a ResponseWriter is written to or
+// flushed by more than one goroutine at a time, which is not permitted.
+var ErrConcurrentWrite = errors.New("tftp: concurrent write")
+
+// ErrIncompleteTransfer is passed to a server's OnComplete callback when a
+// transfer ends before its final block was exchanged with the client, and no
+// other error occurred, such as when a handler returns without calling
+// Flush.
+var ErrIncompleteTransfer = errors.New("tftp: transfer incomplete")
+
+// errTransferTimeout is returned when a transfer does not complete within a
+// server's TransferTimeout.
+var errTransferTimeout = errors.New("tftp: transfer timed out")
+
+// errIgnoreReply is returned by a function passed to exchange to indicate
+// that a reply should be ignored, without the packet being retransmitted.
+var errIgnoreReply = errors.New("tftp: ignore reply")
+
+// errTooManyRetries is returned when a packet is retransmitted more than a
+// server's MaxRetries without a reply from the client.
+var errTooManyRetries = errors.New("tftp: too many retries")
+
+// errTransferAborted is returned when a transfer is aborted by
+// Server.AbortClient.
+var errTransferAborted = errors.New("tftp: transfer aborted")
+
+// errRequestDuringTransfer is returned when a client sends a read or write
+// request to the socket of a transfer which is in progress, such as to
+// renegotiate options, which is not permitted.
+var errRequestDuringTransfer = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeIllegalOperation,
+	ErrorMsg:  "request received during transfer",
+}
+
+// errTransferSizeMismatch is returned when a handler sends a different
+// number of bytes than it advertised using the tsize option, and the server's
+// StrictTransferSize option is set.
+var errTransferSizeMismatch = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeUndefined,
+	ErrorMsg:  "transfer size does not match tsize",
+}
+
+// errUnsupportedMode is returned when a response is created for a request
+// whose transfer mode is neither netascii nor octet.
+var errUnsupportedMode = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeIllegalOperation,
+	ErrorMsg:  "unsupported transfer mode",
+}
+
 // response is the default ResponseWriter implementation.  It performs some
 // internal buffering, and if needed, netascii conversions, to write DATA
 // packets to a client.
 type response struct {
 	ResponseWriter
+
+	// Underlying writer, used to receive content from a client
+	bsw *bufferedSocketResponseWriter
 }
 
-// newResponse creates a new response, setting up a UDP socket to perform
-// communication for a single client.
-func newResponse(serverAddr string, remoteAddr net.Addr, mode Mode) (*response, error) {
-	host, _, err := net.SplitHostPort(serverAddr)
+// ReadFrom implements io.ReaderFrom, so that io.Copy can be used to send
+// the entire contents of an io.Reader to a client.  Once src returns io.EOF,
+// any remaining buffered data is flushed, ending the transfer, so that a
+// separate call to Flush is not required.
+//
+// Note that io.Copy prefers the WriteTo method of its source if one is
+// implemented, as is the case for *bytes.Reader, in which case Flush must
+// still be called.
+//
+// Data is read from src in chunks of the transfer's block size, so that each
+// read yields exactly one block, which can be sent without being buffered.
+// If the server's ReadAheadBlocks is set, src is read by another goroutine,
+// up to ReadAheadBlocks blocks ahead of the blocks sent to the client.
+func (r *response) ReadFrom(src io.Reader) (int64, error) {
+	if err := r.bsw.start(); err != nil {
+		return 0, err
+	}
+
+	if n := r.bsw.server.ReadAheadBlocks; n > 0 {
+		ra := newReadAhead(src, n, r.bsw.size)
+		defer ra.close()
+		src = ra
+	}
+
+	// Hide r's ReadFrom method to avoid infinite recursion
+	buf := make([]byte, r.bsw.size)
+	n, err := io.CopyBuffer(writerOnly{r.ResponseWriter}, src, buf)
 	if err != nil {
-		return nil, err
+		return n, err
 	}
 
-	// Bind to a system-assigned UDP port using the server's address
-	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	return n, r.Flush()
+}
+
+// writerOnly wraps an io.Writer, hiding any other methods it implements.
+type writerOnly struct {
+	io.Writer
+}
+
+// receive implements receiver.
+func (r *response) receive(dst io.Writer) (int64, error) {
+	return r.bsw.receive(dst)
+}
+
+// WriteBlocks implements BlockWriter.  If the underlying ResponseWriter
+// does not implement BlockWriter, as is the case for netascii mode
+// transfers, p is written and flushed normally.
+func (r *response) WriteBlocks(p []byte) error {
+	if bw, ok := r.ResponseWriter.(BlockWriter); ok {
+		return bw.WriteBlocks(p)
+	}
+
+	if _, err := r.Write(p); err != nil {
+		return err
+	}
+
+	return r.Flush()
+}
+
+// reportError implements errorReporter.
+func (r *response) reportError(err error) {
+	r.bsw.server.reportError(err)
+}
+
+// resume implements resumer.
+func (r *response) resume(off int64) error {
+	return r.bsw.resume(off)
+}
+
+// skip implements skipper.
+func (r *response) skip(off int64) {
+	r.bsw.skip(off)
+}
+
+// serveBlocks implements blockServer.  If the underlying ResponseWriter
+// performs netascii conversions, each block is written and flushed normally.
+func (r *response) serveBlocks(src BlockSource) error {
+	if bs, ok := r.ResponseWriter.(blockServer); ok {
+		return bs.serveBlocks(src)
+	}
+
+	return copyBlocks(src, DefaultBlockSize, r.Write, r.Flush)
+}
+
+// newResponse creates a new response, which sets up a UDP socket to perform
+// communication for a single client.  Any options in the request which are
+// handled by the server are accepted automatically.
+//
+// The socket is not bound until it is first needed to send or receive a
+// packet, so a request which a handler ignores does not consume a socket.
+//
+// If the server is listening on a wildcard address, and localIP is not nil,
+// the socket is bound to localIP, which should be the address on which the
+// request was received.  This ensures the client receives replies from the
+// same address it sent its request to.
+func newResponse(s *Server, remoteAddr net.Addr, localIP net.IP, r *Request) (*response, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
 	if err != nil {
 		return nil, err
 	}
+	if ip := net.ParseIP(host); localIP != nil && (host == "" || ip != nil && ip.IsUnspecified()) {
+		host = localIP.String()
+	}
 
+	// Bind to a system-assigned UDP port using the server's address
+	listen := func() (net.PacketConn, error) {
+		return s.listenTransfer(host, remoteAddr)
+	}
+
+	return newListenResponse(s, listen, remoteAddr, r)
+}
+
+// newConnResponse creates a new response which communicates with a single
+// client using conn.  Any options in the request which are handled by the
+// server are accepted automatically.
+func newConnResponse(s *Server, conn net.PacketConn, remoteAddr net.Addr, r *Request) (*response, error) {
+	listen := func() (net.PacketConn, error) {
+		return conn, nil
+	}
+
+	return newListenResponse(s, listen, remoteAddr, r)
+}
+
+// newListenResponse creates a new response which communicates with a single
+// client using the connection returned by listen, which is called once the
+// connection is first needed.  Any options in the request which are handled
+// by the server are accepted automatically.  If the request's transfer mode
+// is not supported, an ERROR packet is sent to the client, and
+// errUnsupportedMode is returned.
+func newListenResponse(s *Server, listen func() (net.PacketConn, error), remoteAddr net.Addr, r *Request) (*response, error) {
 	// Set up writer which communicates via socket and buffers input
 	// appropriately for TFTP
 	bsw := &bufferedSocketResponseWriter{
-		conn:       conn,
+		listen:     listen,
 		remoteAddr: remoteAddr,
+		server:     s,
+
+		buf:     bytes.NewBuffer(nil),
+		options: make(map[string]string),
+		mode:    r.Mode,
+		request: r,
+	}
+
+	if r.Mode != ModeNetASCII && r.Mode != ModeOctet {
+		writeError(bsw, errUnsupportedMode)
+		_ = bsw.Close()
+		return nil, errUnsupportedMode
+	}
+
+	if err := s.negotiate(r.Options, bsw.options); err != nil {
+		writeError(bsw, err)
+		_ = bsw.Close()
+		return nil, err
+	}
 
-		buf: bytes.NewBuffer(nil),
+	// Windowed and compressed transfers are only supported when sending
+	// content
+	if r.Opcode != OpcodeRead {
+		delete(bsw.options, optionWindowSize)
+		delete(bsw.options, optionDeflate)
+	}
 
-		rb: make([]byte, blockSize+4),
-		wb: make([]byte, blockSize+4),
+	if s.TransferTimeout > 0 {
+		bsw.deadline = time.Now().Add(s.TransferTimeout)
 	}
 
 	// If using netascii mode, wrap with ResponseWriter which seamlessly
 	// converts writes to netascii
 	var rw ResponseWriter = bsw
-	if mode == ModeNetASCII {
+	if r.Mode == ModeNetASCII {
 		rw = &netASCIIResponseWriter{bsw}
 	}
 
 	return &response{
 		ResponseWriter: rw,
+		bsw:            bsw,
 	}, nil
 }
 
 // bufferedSocketResponseWriter is a ResponseWriter which communicates with a
 // TFTP client over a socket, and buffers data internally.
 type bufferedSocketResponseWriter struct {
-	// Connection and address used to communicate with a client
+	// Number of bytes of content sent or received, which is accessed
+	// atomically, and must be the first field for 64-bit alignment
+	bytes int64
+
+	// Connection and address used to communicate with a client, and a
+	// function which creates the connection once it is first needed
 	conn       net.PacketConn
 	remoteAddr net.Addr
+	listen     func() (net.PacketConn, error)
+
+	// Server which created this writer, and its configuration
+	server *Server
+
+	// Block size and retransmission timeout for this transfer, and reusable
+	// read and write buffers which are allocated once the block size is
+	// known
+	size    int
+	timeout time.Duration
+	rb      []byte
+	wb      []byte
 
-	// Reusable read and write buffers
-	rb []byte
-	wb []byte
+	// Time by which the transfer must complete, if set
+	deadline time.Time
 
 	// Buffer to store blocks which are not large enough to be written
 	buf *bytes.Buffer
 
-	// Current block number
+	// Options accepted by a handler, sent to the client in an OACK
+	options map[string]string
+
+	// Transfer mode requested by the client, and the request itself
+	mode    Mode
+	request *Request
+
+	// Current block number, and length of the most recently sent DATA
+	// packet in the write buffer
 	block uint16
+	n     int
+
+	// Statistics about this transfer, the error which ended it, if any, and
+	// whether or not a warning about its size has been logged
+	stats       TransferStats
+	err         error
+	warnedLarge bool
+
+	// Transfer size advertised to the client using the tsize option, or -1
+	// if none was advertised, the number of bytes of content sent so far,
+	// and whether or not a mismatch between the two has been reported
+	tsize       int64
+	sent        int64
+	warnedTsize bool
+
+	// Optional hash of the content exchanged with the client
+	hash hash.Hash
+
+	// Optional limit on the rate at which packets are sent, and the time
+	// to wait for a reply during the current exchange, which is applied
+	// again whenever the limit delays a packet
+	limit *limiter
+	wait  time.Duration
+
+	// Number of DATA blocks which may be sent before waiting for an
+	// acknowledgement, as described in RFC 7440, the DATA packets in the
+	// current window which have not yet been acknowledged, and the number
+	// of those packets at the end of the window which have not yet been
+	// sent
+	window  int
+	unacked []windowPacket
+	unsent  int
+
+	// Optional compressor for the payload of each DATA block, and the
+	// buffer which holds each compressed payload
+	deflate *flate.Writer
+	zbuf    bytes.Buffer
+
+	// Optional minimum interval between DATA blocks set by a handler, and
+	// the time at which the most recent DATA block was first sent
+	minInterval time.Duration
+	lastBlock   time.Time
+
+	// Function which stops keepalives, if they are being sent, and whether
+	// or not the client acknowledged the OACK
+	stopKeepalive func()
+	oacked        bool
+
+	// Whether or not content is being received from the client, the state
+	// of the transfer, and whether or not its final block was exchanged
+	// with the client, which is retained once the transfer is closed
+	receiving bool
+	state     transferState
+	complete  bool
+
+	// Nonzero while a goroutine is writing, which is accessed atomically to
+	// detect concurrent writes
+	busy int32
+
+	// Nonzero once the transfer is aborted by another goroutine, which is
+	// accessed atomically, and a mutex which guards assignment of conn so
+	// that the aborting goroutine may interrupt or close it, along with
+	// whether conn was closed, after which no socket is bound
+	aborted    int32
+	connMu     sync.Mutex
+	connClosed bool
+
+	// Nonzero once the final block of the transfer has been sent, or the
+	// transfer has ended, which is accessed atomically so that the server
+	// can determine whether a client is still in a transfer
+	final int32
+}
+
+// transferState is the state of a transfer performed by a
+// bufferedSocketResponseWriter.  A transfer begins active, becomes flushed
+// once the final block has been exchanged with the client, and is closed once
+// Close or Cancel is called.
+type transferState int
+
+const (
+	// stateActive indicates that data may still be sent or received.
+	stateActive transferState = iota
+
+	// stateFlushed indicates that the final block of the transfer has been
+	// sent.  Flush has no effect, and Write returns ErrWriteAfterFlush.
+	stateFlushed
+
+	// stateClosed indicates that the transfer's socket has been closed.
+	// Close has no effect, and Write and Flush return ErrWriteAfterClose.
+	stateClosed
+)
+
+// acquire marks w as being written to by the calling goroutine, and reports
+// whether or not w was already in use.  If acquire returns true, release
+// must be called once the write is complete.
+func (w *bufferedSocketResponseWriter) acquire() bool {
+	return atomic.CompareAndSwapInt32(&w.busy, 0, 1)
+}
+
+// release marks w as no longer being written to.
+func (w *bufferedSocketResponseWriter) release() {
+	atomic.StoreInt32(&w.busy, 0)
 }
 
 // Write implements io.Writer, and performs internal buffering of data to
 // communicate with a client.  Write attempts to send as many available blocks
 // as possible when called, buffering any excess data for future writes.
 func (w *bufferedSocketResponseWriter) Write(p []byte) (int, error) {
-	// Store data in buffer to be output in blocks
+	if !w.acquire() {
+		return 0, ErrConcurrentWrite
+	}
+	defer w.release()
+
+	return w.write(p)
+}
+
+// write implements Write.
+func (w *bufferedSocketResponseWriter) write(p []byte) (int, error) {
+	switch w.state {
+	case stateFlushed:
+		return 0, ErrWriteAfterFlush
+	case stateClosed:
+		return 0, ErrWriteAfterClose
+	}
+
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+
+	// If no data is buffered, send any whole blocks directly from p,
+	// avoiding a copy into the buffer
+	var sent int
+	if w.buf.Len() == 0 {
+		for len(p)-sent >= w.size {
+			if err := w.writeBlock(p[sent : sent+w.size]); err != nil {
+				return sent, err
+			}
+			sent += w.size
+		}
+	}
+
+	// Store remaining data in buffer to be output in blocks
 	// (never returns an error, per documentation)
-	n, _ := w.buf.Write(p)
+	n, _ := w.buf.Write(p[sent:])
+	n += sent
 
 	// If buffer and input bytes cannot create an entire block, wait until
 	// next call or flush before performing any writes
-	if w.buf.Len() < blockSize {
+	if w.buf.Len() < w.size {
 		return n, nil
 	}
 
 	// Calculate how many blocks we can send with the data currently
 	// in the buffer
 	available := int(math.Floor(
-		float64(w.buf.Len()) / float64(blockSize),
+		float64(w.buf.Len()) / float64(w.size),
 	))
 
 	// Flush as many available blocks as possible
@@ -108,97 +479,1193 @@ func (w *bufferedSocketResponseWriter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-// Close closes the underlying socket used to communicate with a client.
-func (w *bufferedSocketResponseWriter) Close() error {
-	return w.conn.Close()
-}
+// WriteBlocks implements BlockWriter, and sends p to a client in blocks,
+// followed by a final short or empty block to end the transfer.  If data is
+// already buffered from a previous call to Write, p is written and flushed
+// through the buffer instead.
+func (w *bufferedSocketResponseWriter) WriteBlocks(p []byte) error {
+	if !w.acquire() {
+		return ErrConcurrentWrite
+	}
+	defer w.release()
 
-// Flush writes up to a single block of data to a client.  Flush should only
-// be called once an io.Reader returns EOF, in order to ensure that every byte
-// from the Reader is flushed to the client.
-func (w *bufferedSocketResponseWriter) Flush() error {
-	return w.writeOneBlock()
-}
+	switch w.state {
+	case stateFlushed:
+		return ErrWriteAfterFlush
+	case stateClosed:
+		return ErrWriteAfterClose
+	}
 
-// writeOneBlock attempts to write a single block of data to a client, and
-// waits for acknowledgement or an error in reply.
-//
-// BUG(mdlayher): break this up into smaller methods
-func (w *bufferedSocketResponseWriter) writeOneBlock() error {
-	// Write data header with incremented block number and send
-	// one block to client
-	w.block++
-	binary.BigEndian.PutUint16(w.wb[0:2], uint16(opcodeDATA))
-	binary.BigEndian.PutUint16(w.wb[2:4], w.block)
+	if w.buf.Len() > 0 {
+		if _, err := w.write(p); err != nil {
+			return err
+		}
 
-	// Copy up to blockSize bytes into write buffer for a single write
-	// transaction
-	cn := copy(w.wb[4:], w.buf.Next(blockSize))
+		return w.flush()
+	}
+
+	if err := w.start(); err != nil {
+		return err
+	}
 
 	for {
-		// Set timeouts for a reasonable amount of time before retrying
-		if err := w.conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		n := len(p)
+		if n > w.size {
+			n = w.size
+		}
+
+		if err := w.writeBlock(p[:n]); err != nil {
 			return err
 		}
+		p = p[n:]
 
-		// Write block to client using its connection, ensure that the
-		// correct number of bytes were written
-		wn, err := w.conn.WriteTo(w.wb[:cn+4], w.remoteAddr)
-		if err != nil {
-			// Allow retries on timeout
-			oerr, ok := err.(*net.OpError)
-			if !ok {
-				return err
-			}
+		if w.state == stateFlushed {
+			return nil
+		}
+	}
+}
 
-			if oerr.Timeout() {
-				continue
-			}
+// serveBlocks implements blockServer, and reads each block from src directly
+// into the write buffer before it is sent.  If the final block from src is a
+// full block, an empty block follows it to end the transfer.  If data is
+// already buffered from a previous call to Write, the blocks from src are
+// written and flushed through the buffer instead.
+func (w *bufferedSocketResponseWriter) serveBlocks(src BlockSource) error {
+	if !w.acquire() {
+		return ErrConcurrentWrite
+	}
+	defer w.release()
+
+	switch w.state {
+	case stateFlushed:
+		return ErrWriteAfterFlush
+	case stateClosed:
+		return ErrWriteAfterClose
+	}
+
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	if w.buf.Len() > 0 {
+		return copyBlocks(src, w.size, w.write, w.flush)
+	}
+
+	for block := uint16(1); w.state != stateFlushed; block++ {
+		// The write buffer may be replaced by a transform, so the block
+		// is read into its current payload area each time
+		buf := w.wb[4 : 4+w.size]
 
+		n, last, err := src.ReadBlock(block, buf)
+		if err != nil {
 			return err
 		}
-		if wn != cn+4 {
-			return io.ErrShortWrite
+
+		if err := w.writeBlock(buf[:n]); err != nil {
+			return err
 		}
 
-		// Wait for ACK or ERROR response from client
-		var readN int
-		for {
-			rn, addr, err := w.conn.ReadFrom(w.rb)
-			if err != nil {
-				// Allow retries on timeout
-				oerr, ok := err.(*net.OpError)
-				if !ok {
-					return err
-				}
+		// A full final block must be followed by an empty block
+		if last && w.state != stateFlushed {
+			return w.writeBlock(nil)
+		}
+	}
 
-				if oerr.Timeout() {
-					continue
-				}
+	return nil
+}
 
-				return err
-			}
+// resume prepares w to resume a transfer at byte offset off, so that the
+// first block sent is numbered as if the content before off had been sent in
+// the same transfer.  The offset must be a multiple of the accepted block
+// size, and resume must be called before the transfer starts, since the
+// offset must be acknowledged along with any other options.
+func (w *bufferedSocketResponseWriter) resume(off int64) error {
+	size := int64(acceptedBlockSize(w.options))
+	if w.size != 0 || off%size != 0 {
+		return errInvalidOffset
+	}
 
-			// BUG(mdlayher): send errors for wrong TID if an unknown
-			// client starts communicating on this port
-			_ = addr
+	// The block number wraps around along with the block numbers of the
+	// preceding content, and the preceding content counts towards any
+	// advertised transfer size
+	w.block = uint16(off / size)
+	w.sent = off
 
-			readN = rn
-			break
-		}
+	return nil
+}
 
-		// Parse ACK or ERROR packet
-		ack, err := parseACKPacket(w.rb[:readN])
+// skip records that the first off bytes of the content were skipped using
+// the offset option, so that they count towards any advertised transfer size.
+func (w *bufferedSocketResponseWriter) skip(off int64) {
+	w.sent += off
+}
+
+// Close closes the underlying socket used to communicate with a client.
+// Calling Close more than once has no effect.
+//
+// If the final block has been acknowledged by the client, Close dallies for
+// a single timeout period before closing the socket, so that the final block
+// can be retransmitted if the client requests it again.  Dallying is skipped
+// if the server's DisableDally option is set.
+func (w *bufferedSocketResponseWriter) Close() error {
+	if w.state == stateClosed {
+		return nil
+	}
+
+	w.endKeepalive()
+	w.end()
+	flushed := w.state == stateFlushed
+	w.state = stateClosed
+
+	// No socket was needed, so there is nothing to close
+	if w.conn == nil {
+		return nil
+	}
+
+	var err error
+	if flushed && !w.server.DisableDally {
+		err = w.dally()
+	}
+
+	if cerr := w.closeConn(false); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Cancel closes the underlying socket used to communicate with a client
+// immediately, without dallying or sending any further packets.  The socket
+// is closed even if the server's SocketReuseTTL or PrewarmSockets options
+// are set, rather than being reused by a later transfer.
+func (w *bufferedSocketResponseWriter) Cancel() error {
+	if w.state == stateClosed {
+		return nil
+	}
+
+	w.endKeepalive()
+	w.end()
+	w.state = stateClosed
+
+	if w.conn == nil {
+		return nil
+	}
+
+	// The client may still be sending packets for this transfer, so the
+	// socket is never reused by another transfer
+	return w.closeConn(true)
+}
+
+// closeConn closes the socket used to communicate with a client, or discards
+// it so that it is never reused if discard is set.  Calling closeConn more
+// than once has no effect.
+func (w *bufferedSocketResponseWriter) closeConn(discard bool) error {
+	w.connMu.Lock()
+	defer w.connMu.Unlock()
+
+	if w.connClosed || w.conn == nil {
+		w.connClosed = true
+		return nil
+	}
+	w.connClosed = true
+
+	if discard {
+		return discardConn(w.conn)
+	}
+
+	return w.conn.Close()
+}
+
+// dally waits for a single timeout period after the final block has been
+// acknowledged, and retransmits the final packet sent to the client if the
+// client indicates that it was not received.  Duplicates of the client's
+// final packet are ignored, and cannot extend the dally period.  An ERROR
+// packet from the client ends the dally period early.
+func (w *bufferedSocketResponseWriter) dally() error {
+	if err := w.conn.SetDeadline(time.Now().Add(w.timeout)); err != nil {
+		return err
+	}
+
+	for {
+		rn, err := w.read()
 		if err != nil {
+			// No more packets from client, or the client closed a
+			// stream transport, so dallying is complete
+			if isTimeout(err) || err == io.EOF {
+				return nil
+			}
+
 			return err
 		}
 
-		// If client reports the previous block as acknowledged again, we
-		// must repeat the process
-		if ack.Block == w.block-1 {
+		resend, err := w.resendFinal(w.rb[:rn])
+		switch err.(type) {
+		case nil:
+		case *ErrorPacket:
+			// The client abandoned the transfer, so it will not
+			// request the final packet again
+			return nil
+		default:
+			// Malformed or unexpected packets cannot affect a transfer
+			// which is already complete
+			continue
+		}
+		if !resend {
 			continue
 		}
 
+		w.stats.Retransmits++
+		if _, err := w.conn.WriteTo(w.wb[:w.n], w.remoteAddr); err != nil {
+			return err
+		}
+	}
+}
+
+// resendFinal reports whether or not packet p, received while dallying,
+// indicates that the final packet sent to the client should be sent again.
+func (w *bufferedSocketResponseWriter) resendFinal(p []byte) (bool, error) {
+	// If the client retransmits the final block, it did not receive the
+	// final ACK
+	if w.receiving {
+		data, err := parseDATAPacket(p)
+		if err != nil {
+			return false, err
+		}
+
+		return data.Block == w.block, nil
+	}
+
+	ack, err := parseACKPacket(p)
+	if err != nil {
+		return false, err
+	}
+
+	// Duplicate ACKs for the final block can be ignored, but if the
+	// client acknowledges the previous block, it is asking for the
+	// final block once more
+	return ack.Block == w.block-1, nil
+}
+
+// Options returns the options which will be acknowledged to the client
+// before the first block is sent.
+func (w *bufferedSocketResponseWriter) Options() map[string]string {
+	return w.options
+}
+
+// Stats returns statistics about the transfer performed by this writer.
+func (w *bufferedSocketResponseWriter) Stats() TransferStats {
+	stats := w.stats
+	stats.Bytes = atomic.LoadInt64(&w.bytes)
+	if w.hash != nil {
+		stats.Checksum = w.hash.Sum(nil)
+	}
+
+	return stats
+}
+
+// LocalAddr returns the local address of the socket used for this transfer,
+// binding the socket if needed.
+func (w *bufferedSocketResponseWriter) LocalAddr() net.Addr {
+	if err := w.bind(); err != nil {
+		return nil
+	}
+
+	return w.conn.LocalAddr()
+}
+
+// SetMinBlockInterval sets the minimum interval between the first
+// transmission of consecutive DATA blocks.
+func (w *bufferedSocketResponseWriter) SetMinBlockInterval(d time.Duration) {
+	w.minInterval = d
+}
+
+// Checksum attaches h to this transfer, so that h is updated with the content
+// of each DATA packet exchanged with the client.
+func (w *bufferedSocketResponseWriter) Checksum(h hash.Hash) {
+	w.hash = h
+}
+
+// checksum adds the content of an acknowledged DATA packet to the hash
+// attached using Checksum, if any.
+func (w *bufferedSocketResponseWriter) checksum(content []byte) {
+	if w.hash != nil {
+		_, _ = w.hash.Write(content)
+	}
+}
+
+// Flush writes up to a single block of data to a client.  Flush should only
+// be called once an io.Reader returns EOF, in order to ensure that every byte
+// from the Reader is flushed to the client.  Once the final block has been
+// acknowledged, Flush has no effect.
+func (w *bufferedSocketResponseWriter) Flush() error {
+	if !w.acquire() {
+		return ErrConcurrentWrite
+	}
+	defer w.release()
+
+	return w.flush()
+}
+
+// flush implements Flush.
+func (w *bufferedSocketResponseWriter) flush() error {
+	switch w.state {
+	case stateFlushed:
 		return nil
+	case stateClosed:
+		return ErrWriteAfterClose
+	}
+
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	return w.writeOneBlock()
+}
+
+// start binds the socket used to communicate with a client, determines the
+// block size for a transfer from the options accepted by a handler, and
+// allocates buffers of the appropriate size.  start must be called before any
+// blocks are sent or received, and has no effect after the first successful
+// call.
+func (w *bufferedSocketResponseWriter) start() error {
+	if err := w.bind(); err != nil {
+		return err
 	}
+
+	if w.size != 0 {
+		return nil
+	}
+
+	w.stats.StartTime = time.Now()
+	w.size = acceptedBlockSize(w.options)
+	w.tsize = -1
+	if v, ok := w.options[optionTransferSize]; ok && !w.receiving {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			w.tsize = n
+		}
+	}
+	w.window = acceptedWindowSize(w.options)
+	if w.options[optionDeflate] == "1" {
+		// The compression level is valid, so no error can occur
+		w.deflate, _ = flate.NewWriter(&w.zbuf, flate.DefaultCompression)
+	}
+
+	w.timeout = timeout
+	if d := w.server.RetransmitTimeout; d > 0 {
+		w.timeout = d
+	}
+	if v, ok := w.options[optionTimeout]; ok {
+		if d, ok := parseTimeout(v); ok {
+			w.timeout = d
+		}
+	}
+
+	w.rb = make([]byte, w.size+4)
+	w.wb = make([]byte, w.size+4)
+
+	if r := w.server.RateBytesPerSec; r > 0 {
+		w.limit = newLimiter(r)
+	}
+
+	return nil
+}
+
+// bind binds the socket used to communicate with a client, if it is not
+// already bound.
+func (w *bufferedSocketResponseWriter) bind() error {
+	if w.conn != nil {
+		return nil
+	}
+
+	conn, err := w.listen()
+	if err != nil {
+		w.server.reportError(fmt.Errorf("tftp: failed to bind transfer socket for %s: %w", w.remoteAddr, err))
+		return err
+	}
+
+	// Fall back to timers for a connection which does not support
+	// deadlines, so that timeouts and retransmissions still work
+	if !supportsDeadlines(conn) {
+		conn = newTimerConn(conn)
+	}
+
+	w.connMu.Lock()
+	defer w.connMu.Unlock()
+
+	// The transfer was shut down while the socket was bound
+	if w.connClosed {
+		_ = discardConn(conn)
+		return errTransferAborted
+	}
+	w.conn = conn
+
+	return nil
+}
+
+// abort aborts the transfer from another goroutine.  Any read waiting for a
+// reply from the client is interrupted, and the transfer sends an ERROR
+// packet to the client and ends the next time it exchanges a packet.
+func (w *bufferedSocketResponseWriter) abort() {
+	atomic.StoreInt32(&w.aborted, 1)
+
+	w.connMu.Lock()
+	defer w.connMu.Unlock()
+
+	if w.conn != nil {
+		_ = w.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// shut aborts the transfer from another goroutine, informs the client, and
+// closes the socket immediately, so that the socket is released even if the
+// handler never exchanges another packet with the client.
+func (w *bufferedSocketResponseWriter) shut() {
+	atomic.StoreInt32(&w.aborted, 1)
+
+	w.connMu.Lock()
+	conn := w.conn
+	closed := w.connClosed
+	w.connMu.Unlock()
+
+	if conn != nil && !closed {
+		if p, ok := w.customError(ErrorCodeUndefined, "transfer aborted"); ok {
+			if b, err := p.MarshalBinary(); err == nil {
+				_, _ = conn.WriteTo(b, w.remoteAddr)
+			}
+		}
+	}
+
+	_ = w.closeConn(true)
+}
+
+// checkAborted reports whether or not the transfer was aborted, and if so,
+// informs the client.
+func (w *bufferedSocketResponseWriter) checkAborted() bool {
+	if atomic.LoadInt32(&w.aborted) == 0 {
+		return false
+	}
+
+	_ = w.WriteError(ErrorCodeUndefined, "transfer aborted")
+	return true
+}
+
+// writeOneBlock attempts to write a single block of data to a client, and
+// waits for acknowledgement or an error in reply.
+//
+// The slice returned by w.buf.Next aliases the buffer's contents, and is
+// only valid until the buffer is next modified.  writeBlock copies it before
+// doing anything else, so it is never read after a later modification.
+func (w *bufferedSocketResponseWriter) writeOneBlock() error {
+	return w.writeBlock(w.buf.Next(w.size))
+}
+
+// writeBlock writes a single block containing up to w.size bytes of p to
+// a client, and waits for acknowledgement or an error in reply.  p is copied
+// into the write buffer before any other operation, and is not retained.
+func (w *bufferedSocketResponseWriter) writeBlock(p []byte) error {
+	// Copy up to w.size bytes into write buffer for a single write
+	// transaction
+	cn := copy(w.wb[4:], p)
+	w.n = cn + 4
+
+	w.endKeepalive()
+
+	if err := w.checkSize(cn); err != nil {
+		return err
+	}
+	w.sent += int64(cn)
+
+	// The content is added to any checksum only once the block is
+	// acknowledged, so it must be retained if the write buffer is
+	// transformed or reused before then
+	var content []byte
+	if w.hash != nil {
+		content = w.wb[4 : 4+cn]
+		if w.window > 1 || w.deflate != nil || w.server.BlockTransform != nil {
+			content = append([]byte(nil), content...)
+		}
+	}
+
+	// Acknowledge any accepted options before the first block is sent,
+	// unless the client already acknowledged them during keepalives.  The
+	// block number alone cannot be used to detect the first block, because
+	// it wraps around to zero during transfers of more than 65535 blocks.
+	if !w.oacked && len(w.options) > 0 {
+		if err := w.writeOACK(); err != nil {
+			return err
+		}
+		w.oacked = true
+	}
+
+	// Write data header with incremented block number and send
+	// one block to client
+	w.block++
+	binary.BigEndian.PutUint16(w.wb[0:2], uint16(opcodeDATA))
+	binary.BigEndian.PutUint16(w.wb[2:4], w.block)
+
+	if w.deflate != nil {
+		w.transform(w.compress, cn)
+	}
+	if t := w.server.BlockTransform; t != nil {
+		w.transform(t, w.n-4)
+	}
+
+	// The client may begin another transfer as soon as it receives the
+	// final block, before its acknowledgement is read
+	if cn < w.size {
+		atomic.StoreInt32(&w.final, 1)
+	}
+
+	if w.window > 1 {
+		if err := w.writeWindowed(cn, content); err != nil {
+			return err
+		}
+	} else {
+		w.pace()
+		if err := w.transmit(w.wb[:w.n], w.block); err != nil {
+			return err
+		}
+		w.countBytes(cn)
+		w.checksum(content)
+	}
+
+	// A block shorter than the block size signals the end of the transfer
+	if cn < w.size {
+		w.state = stateFlushed
+		w.complete = true
+		w.end()
+	}
+
+	return nil
+}
+
+// writeWindowed adds the DATA packet in the write buffer, which carries cn
+// bytes of content, to the current window, as described in RFC 7440.  Once
+// the window is full, or if the packet is the final packet, every packet in
+// the window is sent to the client, and writeWindowed waits for the client
+// to acknowledge the last of them.
+//
+// Packets are sent in bursts of the server's SendBurst packets.  Between
+// bursts, any acknowledgements which the client has already sent are read
+// without waiting, and the acknowledged blocks are removed from the window,
+// so that they are not sent again.  If the client acknowledges a block
+// before the end of the window once the window is sent, the acknowledged
+// blocks are removed from the window, and the remaining blocks are sent
+// again in order.
+//
+// Any minimum interval set by a handler is applied between the first
+// transmission of each packet in the window.
+func (w *bufferedSocketResponseWriter) writeWindowed(cn int, content []byte) error {
+	w.unacked = append(w.unacked, windowPacket{
+		b:       append([]byte(nil), w.wb[:w.n]...),
+		n:       cn,
+		content: content,
+	})
+	w.unsent++
+	if len(w.unacked) < w.window && cn == w.size {
+		return nil
+	}
+
+	// ack removes the blocks acknowledged by an ACK for block from the
+	// window, and reports whether the ACK acknowledged no more than the
+	// first sent packets in the window.  The block before the window
+	// acknowledges none of the window.  The subtraction wraps around along
+	// with the block number, so it is correct even if the window spans
+	// block 65535 and block 0.
+	ack := func(block uint16, sent int) bool {
+		n := int(block - (w.block - uint16(len(w.unacked))))
+		if n > sent {
+			return false
+		}
+
+		for _, wp := range w.unacked[:n] {
+			w.countBytes(wp.n)
+			w.checksum(wp.content)
+		}
+		w.unacked = w.unacked[n:]
+
+		return true
+	}
+
+	burst := w.server.SendBurst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	send := func() error {
+		var sent int
+		for i := 0; i < len(w.unacked); i++ {
+			if sent > 0 && sent%burst == 0 {
+				// Only the packets before i have been sent, so
+				// only they may be acknowledged early
+				n := len(w.unacked)
+				if err := w.poll(func(p []byte) error {
+					a, err := parseACKPacket(p)
+					if err != nil {
+						return err
+					}
+
+					ack(a.Block, i)
+					return nil
+				}); err != nil {
+					return err
+				}
+				i -= n - len(w.unacked)
+			}
+
+			// Packets which are sent for the first time are paced
+			wp := w.unacked[i]
+			first := i >= len(w.unacked)-w.unsent
+			if first && w.pace() {
+				if err := w.restartTimeout(); err != nil {
+					return err
+				}
+			}
+
+			if err := w.send(wp.b); err != nil {
+				return err
+			}
+			if first {
+				w.unsent--
+			}
+			sent++
+		}
+
+		return nil
+	}
+
+	return w.exchangeFunc(send, w.block, func(p []byte) (bool, error) {
+		a, err := parseACKPacket(p)
+		if err != nil {
+			return false, err
+		}
+
+		if !ack(a.Block, len(w.unacked)) {
+			// Acknowledgement of a block outside of the window, so
+			// the entire window must be sent again
+			return false, nil
+		}
+
+		return len(w.unacked) == 0, nil
+	})
+}
+
+// windowPacket is a DATA packet in the current window, along with the number
+// of bytes of content it carries before any compression or transformation,
+// and that content, if it is needed for a checksum.
+type windowPacket struct {
+	b       []byte
+	n       int
+	content []byte
+}
+
+// checkSize verifies that sending a block containing n bytes of content does
+// not cause the transfer to differ from the size advertised using the tsize
+// option.  A mismatch is logged once, and if the server's StrictTransferSize
+// option is set, an ERROR packet is sent to the client, and
+// errTransferSizeMismatch is returned.
+func (w *bufferedSocketResponseWriter) checkSize(n int) error {
+	if w.tsize < 0 || w.warnedTsize {
+		return nil
+	}
+
+	var filename string
+	if w.request != nil {
+		filename = w.request.Filename
+	}
+
+	total := w.sent + int64(n)
+	switch {
+	case total > w.tsize:
+		w.server.logf("tftp: transfer of %q to %s exceeded the advertised tsize of %d bytes",
+			filename, w.remoteAddr, w.tsize)
+	case n < w.size && total < w.tsize:
+		w.server.logf("tftp: transfer of %q to %s sent %d bytes, fewer than the advertised tsize of %d bytes",
+			filename, w.remoteAddr, total, w.tsize)
+	default:
+		return nil
+	}
+	w.warnedTsize = true
+
+	if !w.server.StrictTransferSize {
+		return nil
+	}
+
+	writeError(w, errTransferSizeMismatch)
+	return errTransferSizeMismatch
+}
+
+// transform applies t, such as the server's BlockTransform, to the payload of
+// length n in the write buffer, and replaces it with the transformed payload.
+// The write buffer grows if the transformed payload does not fit.
+func (w *bufferedSocketResponseWriter) transform(t func(block uint16, payload []byte) []byte, n int) {
+	p := t(w.block, w.wb[4:4+n])
+	if len(p) > len(w.wb)-4 {
+		wb := make([]byte, 4+len(p))
+		copy(wb[0:4], w.wb[0:4])
+		w.wb = wb
+	}
+
+	w.n = 4 + copy(w.wb[4:], p)
+}
+
+// compress compresses a single block's payload using DEFLATE.  The returned
+// slice is only valid until the next call to compress.
+func (w *bufferedSocketResponseWriter) compress(_ uint16, payload []byte) []byte {
+	w.zbuf.Reset()
+	w.deflate.Reset(&w.zbuf)
+
+	// Writes to a bytes.Buffer cannot fail
+	_, _ = w.deflate.Write(payload)
+	_ = w.deflate.Close()
+
+	return w.zbuf.Bytes()
+}
+
+// pace waits until at least w.minInterval has elapsed since the previous
+// DATA block was sent, if an interval is set, and records the time at which
+// the next block is sent.  It reports whether it waited.
+func (w *bufferedSocketResponseWriter) pace() bool {
+	if w.minInterval <= 0 {
+		return false
+	}
+
+	var waited bool
+	if !w.lastBlock.IsZero() {
+		if d := time.Until(w.lastBlock.Add(w.minInterval)); d > 0 {
+			time.Sleep(d)
+			waited = true
+		}
+	}
+	w.lastBlock = time.Now()
+
+	return waited
+}
+
+// writeOACK sends an OACK packet containing the options accepted by a
+// handler, and waits for the client to acknowledge it with block 0.
+func (w *bufferedSocketResponseWriter) writeOACK() error {
+	b, err := (&oackPacket{Options: w.options}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return w.transmit(b, 0)
+}
+
+// transmit sends a packet to a client, and waits for the client to
+// acknowledge the specified block number.  The packet is retransmitted on
+// timeout.  If the client acknowledges any other block, such as the previous
+// block again, the packet is retransmitted immediately if the server's
+// RetransmitOnDupAck option is set, and is otherwise not retransmitted until
+// the timeout expires.  For an OACK, block is 0, so the first DATA packet is
+// not sent until the client acknowledges the OACK with block 0.
+func (w *bufferedSocketResponseWriter) transmit(b []byte, block uint16) error {
+	return w.exchange(b, block, func(p []byte) (bool, error) {
+		// Parse ACK or ERROR packet
+		ack, err := parseACKPacket(p)
+		if err != nil {
+			return false, err
+		}
+
+		if ack.Block == block {
+			return true, nil
+		}
+
+		// Retransmitting for every duplicate ACK can cause each packet
+		// to be sent twice for the rest of the transfer, as described
+		// in RFC 1123, Section 4.2.3.1
+		if !w.server.RetransmitOnDupAck {
+			return false, errIgnoreReply
+		}
+
+		return false, nil
+	})
+}
+
+// exchange sends a packet to a client, and passes each packet received in
+// reply to function reply, until reply reports that the expected packet
+// has been received or returns an error.  The packet is retransmitted on
+// timeout, or if reply returns false.  If reply returns errIgnoreReply, the
+// reply is ignored, and the packet is not retransmitted until the timeout.
+// block is the block number which the transfer is waiting on, and is used to
+// report stalled transfers.
+//
+// The time to wait for a reply begins at w.timeout, and backs off after each
+// consecutive timeout, as described by backoff.
+func (w *bufferedSocketResponseWriter) exchange(b []byte, block uint16, reply func(p []byte) (bool, error)) error {
+	return w.exchangeFunc(func() error {
+		return w.send(b)
+	}, block, reply)
+}
+
+// exchangeFunc is like exchange, but calls send to send one or more packets
+// to a client each time packets are sent or retransmitted.
+func (w *bufferedSocketResponseWriter) exchangeFunc(send func() error, block uint16, reply func(p []byte) (bool, error)) error {
+	if err := w.doExchange(send, block, reply); err != nil {
+		w.fail(err)
+		return err
+	}
+
+	return nil
+}
+
+// send sends a single packet to a client, subject to the server's rate
+// limit, and ensures that the entire packet was written.  If the rate limit
+// delays the packet, the deadline for the current exchange is set again, so
+// that neither the packet nor the client's reply times out because of the
+// delay.
+func (w *bufferedSocketResponseWriter) send(b []byte) error {
+	if w.limit != nil && w.limit.wait(len(b)) {
+		if err := w.restartTimeout(); err != nil {
+			return err
+		}
+	}
+
+	wn, err := w.conn.WriteTo(b, w.remoteAddr)
+	if err != nil {
+		return err
+	}
+	if wn != len(b) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+// restartTimeout sets the deadline for the current exchange again, after a
+// packet was delayed by a rate limit or pacing, and checks whether the
+// transfer was aborted during the delay.
+func (w *bufferedSocketResponseWriter) restartTimeout() error {
+	if err := w.conn.SetDeadline(time.Now().Add(w.wait)); err != nil {
+		return err
+	}
+	if w.checkAborted() {
+		return errTransferAborted
+	}
+
+	return nil
+}
+
+// doExchange implements exchangeFunc.
+func (w *bufferedSocketResponseWriter) doExchange(send func() error, block uint16, reply func(p []byte) (bool, error)) error {
+	start := time.Now()
+	stalled := false
+	wait := w.timeout
+	retries := 0
+	resend := true
+
+	for {
+		// Abort the transfer if it has taken too long
+		if !w.deadline.IsZero() && time.Now().After(w.deadline) {
+			_ = w.WriteError(ErrorCodeUndefined, "transfer timed out")
+			return errTransferTimeout
+		}
+
+		// Packets are not sent again after an ignored reply, and the
+		// client has only the remainder of the current timeout to reply
+		if resend {
+			// Set timeouts for a reasonable amount of time before
+			// retrying.  An abort must be checked for afterward, so that
+			// an abort which interrupted a previous deadline is not
+			// missed.
+			w.wait = wait
+			if err := w.conn.SetDeadline(time.Now().Add(wait)); err != nil {
+				return err
+			}
+			if w.checkAborted() {
+				return errTransferAborted
+			}
+
+			// Write packets to client using its connection
+			if err := send(); err != nil {
+				// Allow retries on timeout.  The packet is not
+				// modified by a failed send, so it is sent unchanged
+				// on retry.
+				if isTimeout(err) {
+					if err := w.retry(&retries); err != nil {
+						return err
+					}
+
+					w.stats.Retransmits++
+					wait = w.backoff(wait)
+					continue
+				}
+
+				return err
+			}
+		}
+		resend = true
+
+		// Wait for reply or ERROR response from client
+		rn, err := w.read()
+		if err != nil {
+			// Retransmit the packet if no reply arrives in time, and
+			// report the transfer as stalled if the client has not made
+			// progress in a while
+			if isTimeout(err) {
+				if w.checkAborted() {
+					return errTransferAborted
+				}
+				if !stalled && w.stalled(start) {
+					stalled = true
+					w.server.OnStall(w.remoteAddr, block)
+				}
+				if err := w.retry(&retries); err != nil {
+					return err
+				}
+
+				w.stats.Retransmits++
+				wait = w.backoff(wait)
+				continue
+			}
+
+			return err
+		}
+
+		if isRequest(w.rb[:rn]) {
+			writeError(w, errRequestDuringTransfer)
+			return errRequestDuringTransfer
+		}
+
+		ok, err := reply(w.rb[:rn])
+		if err == errIgnoreReply {
+			resend = false
+			continue
+		}
+		if err != nil {
+			return limitErrorMessage(err, w.server.MaxErrorMessage)
+		}
+		if !ok {
+			w.stats.Retransmits++
+			continue
+		}
+
+		return nil
+	}
+}
+
+// retry counts a timeout against the server's MaxRetries, using the retry
+// count for the current packet stored in retries.  If MaxRetries is exceeded,
+// the transfer is aborted with an ERROR packet, and errTooManyRetries is
+// returned.
+func (w *bufferedSocketResponseWriter) retry(retries *int) error {
+	*retries++
+	if max := w.server.MaxRetries; max <= 0 || *retries <= max {
+		return nil
+	}
+
+	_ = w.WriteError(ErrorCodeUndefined, "too many retries")
+	return errTooManyRetries
+}
+
+// backoff returns the time to wait for a reply after waiting for d timed out.
+// If the server's MaxRetransmitTimeout is set, d is doubled, up to
+// MaxRetransmitTimeout.  Otherwise, d is returned unchanged.
+func (w *bufferedSocketResponseWriter) backoff(d time.Duration) time.Duration {
+	max := w.server.MaxRetransmitTimeout
+	if max <= d {
+		return d
+	}
+
+	if d *= 2; d > max {
+		d = max
+	}
+
+	return d
+}
+
+// read reads a single packet from the client into the read buffer.  Packets
+// from any other address are rejected with an ERROR packet, as described
+// in RFC 1350, Section 4, without disturbing the transfer.
+func (w *bufferedSocketResponseWriter) read() (int, error) {
+	for {
+		n, addr, err := w.conn.ReadFrom(w.rb)
+		if err != nil {
+			return n, err
+		}
+
+		if addr.String() == w.remoteAddr.String() {
+			return n, nil
+		}
+
+		if err := w.rejectUnknown(addr); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// poll passes each packet which the client has already sent to reply,
+// without waiting for any more packets to arrive, until none remain or reply
+// returns an error.  If the socket cannot be read without blocking, poll has
+// no effect.
+func (w *bufferedSocketResponseWriter) poll(reply func(p []byte) error) error {
+	for {
+		n, addr, err := readQueued(w.conn, w.rb)
+		if err == errDrainUnsupported {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if addr == nil {
+			return nil
+		}
+
+		if addr.String() != w.remoteAddr.String() {
+			if err := w.rejectUnknown(addr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if isRequest(w.rb[:n]) {
+			writeError(w, errRequestDuringTransfer)
+			return errRequestDuringTransfer
+		}
+
+		if err := reply(w.rb[:n]); err != nil {
+			return limitErrorMessage(err, w.server.MaxErrorMessage)
+		}
+	}
+}
+
+// rejectUnknown rejects a packet received from addr, which is not the
+// client's transfer ID, with an ERROR packet, and reports it.
+func (w *bufferedSocketResponseWriter) rejectUnknown(addr net.Addr) error {
+	if p, ok := w.customError(ErrorCodeUnknownTransferID, "unknown transfer ID"); ok {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		_, _ = w.conn.WriteTo(b, addr)
+	}
+	w.server.reportError(fmt.Errorf("tftp: rejected packet from %s with unknown transfer ID", addr))
+
+	return nil
+}
+
+// stalled reports whether or not a transfer should be considered stalled,
+// if a block sent at the specified time has not yet been acknowledged.
+func (w *bufferedSocketResponseWriter) stalled(start time.Time) bool {
+	s := w.server
+	if s.StallTimeout <= 0 || s.OnStall == nil {
+		return false
+	}
+
+	return time.Since(start) >= s.StallTimeout
+}
+
+// WriteError sends an ERROR packet with the specified code and message to
+// a client.
+func (w *bufferedSocketResponseWriter) WriteError(code ErrorCode, msg string) error {
+	if w.state == stateClosed {
+		return ErrWriteAfterClose
+	}
+
+	w.endKeepalive()
+
+	if err := w.bind(); err != nil {
+		return err
+	}
+
+	p, ok := w.customError(code, msg)
+	w.fail(p)
+	if !ok {
+		return nil
+	}
+
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.conn.WriteTo(b, w.remoteAddr)
+	return err
+}
+
+// countBytes adds n to the number of bytes of content transferred.  If the
+// transfer exceeds the server's LargeTransferThreshold without a block size
+// having been negotiated, a warning is logged once.
+func (w *bufferedSocketResponseWriter) countBytes(n int) {
+	total := atomic.AddInt64(&w.bytes, int64(n))
+
+	max := w.server.LargeTransferThreshold
+	if max <= 0 || total <= max || w.warnedLarge {
+		return
+	}
+	if _, ok := w.options[optionBlockSize]; ok {
+		return
+	}
+	if _, ok := w.options[optionBlockSize2]; ok {
+		return
+	}
+	w.warnedLarge = true
+
+	var filename string
+	if w.request != nil {
+		filename = w.request.Filename
+	}
+
+	w.server.logf("tftp: transfer of %q with %s exceeded %d bytes using the default block size of %d bytes; the client should request a larger block size using the blksize option",
+		filename, w.remoteAddr, max, DefaultBlockSize)
+}
+
+// customError creates an ERROR packet with the specified code and message,
+// as customized by the server's OnError hook, if set.  If customError returns
+// false, the packet should not be sent.
+func (w *bufferedSocketResponseWriter) customError(code ErrorCode, msg string) (*ErrorPacket, bool) {
+	send := true
+	if fn := w.server.OnError; fn != nil {
+		code, msg, send = fn(w.request, code, msg)
+	}
+
+	return &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: code,
+		ErrorMsg:  msg,
+	}, send
+}
+
+// fail records err as the error which ended the transfer, unless an error
+// was already recorded.
+func (w *bufferedSocketResponseWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+	w.end()
+}
+
+// end records the time at which the transfer ended, if it began and has not
+// already ended, and marks the transfer as ended.
+func (w *bufferedSocketResponseWriter) end() {
+	atomic.StoreInt32(&w.final, 1)
+
+	if w.stats.StartTime.IsZero() || !w.stats.EndTime.IsZero() {
+		return
+	}
+
+	w.stats.EndTime = time.Now()
+}
+
+// result returns the error which ended the transfer, ErrIncompleteTransfer if
+// the transfer ended early without an error, or nil if the transfer
+// completed.
+func (w *bufferedSocketResponseWriter) result() error {
+	switch {
+	case w.err != nil:
+		return w.err
+	case !w.complete:
+		return ErrIncompleteTransfer
+	default:
+		return nil
+	}
+}
+
+// isTimeout reports whether err is a network timeout, indicating that an
+// operation may be retried.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
 }
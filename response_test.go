@@ -0,0 +1,2104 @@
+package tftp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_bufferedSocketResponseWriterRetransmits verifies that
+// bufferedSocketResponseWriter counts a retransmission for each timeout
+// which occurs while waiting for an ACK.
+func Test_bufferedSocketResponseWriterRetransmits(t *testing.T) {
+	var tests = []struct {
+		description string
+		timeouts    int
+	}{
+		{
+			description: "no timeouts",
+			timeouts:    0,
+		},
+		{
+			description: "one timeout",
+			timeouts:    1,
+		},
+		{
+			description: "five timeouts",
+			timeouts:    5,
+		},
+	}
+
+	for i, tt := range tests {
+		var reads []testRead
+		for j := 0; j < tt.timeouts; j++ {
+			reads = append(reads, testRead{err: errTestTimeout})
+		}
+		reads = append(reads, testRead{b: []byte{0, 4, 0, 1}})
+
+		c := &testPacketConn{reads: reads}
+		w := newTestResponseWriter(c)
+
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.timeouts, w.Stats().Retransmits; want != got {
+			t.Fatalf("[%02d] test %q, unexpected retransmits: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		// Every retransmission results in the block being sent again
+		if want, got := tt.timeouts+1, len(c.writes); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterOACK verifies that a
+// bufferedSocketResponseWriter sends an OACK when options are accepted, and
+// does not send the first DATA packet until the client acknowledges the OACK
+// with block 0.
+func Test_bufferedSocketResponseWriterOACK(t *testing.T) {
+	oack := []byte("\x00\x06blksize\x008\x00")
+
+	var tests = []struct {
+		description string
+		reads       []testRead
+		writes      [][]byte
+		err         error
+	}{
+		{
+			description: "full handshake",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+				{b: []byte{0, 4, 0, 2}},
+			},
+			writes: [][]byte{
+				oack,
+				append([]byte{0, 3, 0, 1}, "abcdefgh"...),
+				append([]byte{0, 3, 0, 2}, "ij"...),
+			},
+		},
+		{
+			description: "stray ACK before ACK 0, ignored",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 1}},
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+				{b: []byte{0, 4, 0, 2}},
+			},
+			writes: [][]byte{
+				oack,
+				append([]byte{0, 3, 0, 1}, "abcdefgh"...),
+				append([]byte{0, 3, 0, 2}, "ij"...),
+			},
+		},
+		{
+			description: "options rejected by client, no data sent",
+			reads: []testRead{
+				{b: []byte("\x00\x05\x00\x08no\x00")},
+			},
+			writes: [][]byte{
+				oack,
+			},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeBadOptions,
+				ErrorMsg:  "no",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+		w.options[optionBlockSize] = "8"
+
+		_, err := w.Write([]byte("abcdefghij"))
+		if err == nil {
+			err = w.Flush()
+		}
+		if want, got := tt.err, err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected writes:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterDupAck verifies that a
+// bufferedSocketResponseWriter retransmits a block immediately after a
+// duplicate ACK only if the server's RetransmitOnDupAck option is set, and
+// otherwise waits for the retransmit timeout.
+func Test_bufferedSocketResponseWriterDupAck(t *testing.T) {
+	block := append([]byte{0, 3, 0, 1}, "hello"...)
+
+	var tests = []struct {
+		description string
+		aggressive  bool
+		reads       []testRead
+		writes      int
+		deadlines   int
+	}{
+		{
+			description: "conservative, duplicate ACK ignored",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes:    1,
+			deadlines: 1,
+		},
+		{
+			description: "conservative, block resent after timeout",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{err: errTestTimeout},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes:    2,
+			deadlines: 2,
+		},
+		{
+			description: "aggressive, block resent after duplicate ACK",
+			aggressive:  true,
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes:    2,
+			deadlines: 2,
+		},
+		{
+			description: "aggressive, block resent after duplicate ACK and timeout",
+			aggressive:  true,
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 0}},
+				{err: errTestTimeout},
+				{b: []byte{0, 4, 0, 1}},
+			},
+			writes:    3,
+			deadlines: 3,
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+		w.server.RetransmitOnDupAck = tt.aggressive
+
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		for _, b := range c.writes {
+			if want, got := block, b; !bytes.Equal(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected packet:\n- want: %v\n-  got: %v",
+					i, tt.description, want, got)
+			}
+		}
+		if want, got := tt.writes, len(c.writes); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		// A duplicate ACK which does not cause a retransmission must not
+		// extend the time the client has to reply
+		if want, got := tt.deadlines, len(c.deadlines); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of deadlines: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.writes-1, w.Stats().Retransmits; want != got {
+			t.Fatalf("[%02d] test %q, unexpected retransmits: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterBlockSize2 verifies that a block size
+// accepted using the blksize2 option is used for framing, and acknowledged
+// under the same name.
+func Test_bufferedSocketResponseWriterBlockSize2(t *testing.T) {
+	c := &ackPacketConn{}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize2] = "4096"
+
+	if _, err := w.Write(make([]byte, 4096+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 3, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+
+	oack, err := parseOACKPacket(c.writes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := map[string]string{"blksize2": "4096"}, oack.Options; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected OACK options: %v != %v", want, got)
+	}
+
+	if want, got := 4+4096, len(c.writes[1]); want != got {
+		t.Fatalf("unexpected DATA packet length: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterConcurrentWrite verifies that a
+// bufferedSocketResponseWriter detects a write by one goroutine while
+// another is already writing, rather than corrupting the transfer.
+func Test_bufferedSocketResponseWriterConcurrentWrite(t *testing.T) {
+	sending := make(chan struct{})
+	release := make(chan struct{})
+
+	c := &hookPacketConn{}
+	c.hook = func(p []byte) {
+		if Opcode(binary.BigEndian.Uint16(p[0:2])) == opcodeDATA && binary.BigEndian.Uint16(p[2:4]) == 1 {
+			close(sending)
+			<-release
+		}
+	}
+	w := newTestResponseWriter(c)
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, DefaultBlockSize))
+		errC <- err
+	}()
+
+	// Wait until the first block is being sent, and attempt to write and
+	// flush concurrently
+	<-sending
+	if _, err := w.Write([]byte("hello")); err != ErrConcurrentWrite {
+		t.Fatalf("unexpected concurrent Write error: %v", err)
+	}
+	if err := w.Flush(); err != ErrConcurrentWrite {
+		t.Fatalf("unexpected concurrent Flush error: %v", err)
+	}
+	close(release)
+
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+
+	// Sequential use may continue once the first write is complete
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterLargeTransferWarning verifies that a
+// bufferedSocketResponseWriter logs a warning once when a transfer exceeds
+// the server's LargeTransferThreshold using the default block size.
+func Test_bufferedSocketResponseWriterLargeTransferWarning(t *testing.T) {
+	var tests = []struct {
+		description string
+		options     map[string]string
+		size        int
+		warn        bool
+	}{
+		{
+			description: "small transfer, no warning",
+			size:        1024,
+		},
+		{
+			description: "large transfer, default block size, warning",
+			size:        4096,
+			warn:        true,
+		},
+		{
+			description: "large transfer, negotiated block size, no warning",
+			options:     map[string]string{"blksize": "512"},
+			size:        4096,
+		},
+	}
+
+	for i, tt := range tests {
+		buf := bytes.NewBuffer(nil)
+
+		w := newTestResponseWriter(&ackPacketConn{discard: true})
+		w.server = &Server{
+			LargeTransferThreshold: 1024,
+			ErrorLog:               log.New(buf, "", 0),
+		}
+		for k, v := range tt.options {
+			w.options[k] = v
+		}
+
+		if err := w.WriteBlocks(make([]byte, tt.size)); err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := tt.warn, strings.Count(buf.String(), "blksize") == 1; want != got {
+			t.Fatalf("[%02d] test %q, unexpected warning: %q",
+				i, tt.description, buf.String())
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterMaxRetries verifies that
+// bufferedSocketResponseWriter counts both write timeouts and timeouts while
+// waiting for an ACK against the server's MaxRetries, and sends the block
+// unchanged after a write timeout.
+func Test_bufferedSocketResponseWriterMaxRetries(t *testing.T) {
+	var tests = []struct {
+		description   string
+		writeTimeouts int
+		readTimeouts  int
+		err           error
+	}{
+		{
+			description:   "write timeouts within limit",
+			writeTimeouts: 3,
+		},
+		{
+			description:   "write timeouts exceed limit",
+			writeTimeouts: 4,
+			err:           errTooManyRetries,
+		},
+		{
+			description:  "read timeouts within limit",
+			readTimeouts: 3,
+		},
+		{
+			description:  "read timeouts exceed limit",
+			readTimeouts: 4,
+			err:          errTooManyRetries,
+		},
+		{
+			description:   "write and read timeouts exceed limit",
+			writeTimeouts: 2,
+			readTimeouts:  2,
+			err:           errTooManyRetries,
+		},
+	}
+
+	for i, tt := range tests {
+		var reads []testRead
+		for j := 0; j < tt.readTimeouts; j++ {
+			reads = append(reads, testRead{err: errTestTimeout})
+		}
+		reads = append(reads, testRead{b: []byte{0, 4, 0, 1}})
+
+		c := &testPacketConn{
+			reads:         reads,
+			writeTimeouts: tt.writeTimeouts,
+		}
+		w := newTestResponseWriter(c)
+		w.server = &Server{MaxRetries: 3}
+
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if want, got := tt.err, w.Flush(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if tt.err != nil {
+			continue
+		}
+
+		// Each successful write sends the complete block
+		for _, b := range c.writes {
+			if want, got := []byte("\x00\x03\x00\x01hello"), b; !bytes.Equal(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected packet:\n- want: %v\n-  got: %v",
+					i, tt.description, want, got)
+			}
+		}
+		if want, got := tt.readTimeouts+1, len(c.writes); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterChecksum verifies that a
+// bufferedSocketResponseWriter computes a checksum of the content sent to a
+// client, adding each block once even if it is retransmitted.
+func Test_bufferedSocketResponseWriterChecksum(t *testing.T) {
+	content := bytes.Repeat([]byte("abc"), 1000)
+
+	var tests = []struct {
+		description string
+		content     []byte
+		options     map[string]string
+		conn        net.PacketConn
+		acked       []byte
+		err         bool
+	}{
+		{
+			description: "empty",
+			conn:        &ackPacketConn{discard: true},
+		},
+		{
+			description: "several blocks",
+			content:     content,
+			conn:        &ackPacketConn{discard: true},
+		},
+		{
+			description: "several blocks, windowsize and deflate",
+			content:     content,
+			options:     map[string]string{"windowsize": "4", "deflate": "1"},
+			conn:        &ackPacketConn{discard: true},
+		},
+		{
+			description: "retransmitted block",
+			content:     []byte("hello"),
+			conn: &testPacketConn{reads: []testRead{
+				{err: errTestTimeout},
+				{b: []byte{0, 4, 0, 1}},
+			}},
+		},
+		{
+			description: "unacknowledged block",
+			content:     content,
+			conn: &testPacketConn{reads: []testRead{
+				{b: []byte{0, 4, 0, 1}},
+				{err: errors.New("read failed")},
+			}},
+			acked: content[:DefaultBlockSize],
+			err:   true,
+		},
+	}
+
+	for i, tt := range tests {
+		w := newTestResponseWriter(tt.conn)
+		for k, v := range tt.options {
+			w.options[k] = v
+		}
+		w.Checksum(sha256.New())
+
+		if err := w.WriteBlocks(tt.content); (err != nil) != tt.err {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		acked := tt.content
+		if tt.acked != nil {
+			acked = tt.acked
+		}
+
+		want := sha256.Sum256(acked)
+		if got := w.Stats().Checksum; !bytes.Equal(want[:], got) {
+			t.Fatalf("[%02d] test %q, unexpected checksum:\n- want: %x\n-  got: %x",
+				i, tt.description, want, got)
+		}
+	}
+
+	// No checksum is reported unless a hash is attached
+	w := newTestResponseWriter(&ackPacketConn{discard: true})
+	if err := w.WriteBlocks([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Stats().Checksum; got != nil {
+		t.Fatalf("unexpected checksum: %x", got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterTransferSizeMismatch verifies that a
+// bufferedSocketResponseWriter reports a handler which sends a different
+// number of bytes than it advertised using the tsize option, and aborts the
+// transfer if the server's StrictTransferSize option is set.
+func Test_bufferedSocketResponseWriterTransferSizeMismatch(t *testing.T) {
+	var tests = []struct {
+		description string
+		size        int
+		strict      bool
+		warn        bool
+		err         error
+	}{
+		{
+			description: "matching size, no warning",
+			size:        1000,
+		},
+		{
+			description: "matching size, strict, no warning",
+			size:        1000,
+			strict:      true,
+		},
+		{
+			description: "fewer bytes, warning",
+			size:        900,
+			warn:        true,
+		},
+		{
+			description: "fewer bytes, strict, abort",
+			size:        900,
+			strict:      true,
+			warn:        true,
+			err:         errTransferSizeMismatch,
+		},
+		{
+			description: "more bytes, warning",
+			size:        1100,
+			warn:        true,
+		},
+		{
+			description: "more bytes, strict, abort",
+			size:        1100,
+			strict:      true,
+			warn:        true,
+			err:         errTransferSizeMismatch,
+		},
+	}
+
+	for i, tt := range tests {
+		buf := bytes.NewBuffer(nil)
+
+		w := newTestResponseWriter(&ackPacketConn{discard: true})
+		w.server = &Server{
+			StrictTransferSize: tt.strict,
+			ErrorLog:           log.New(buf, "", 0),
+		}
+		w.options[optionTransferSize] = "1000"
+
+		if want, got := tt.err, w.WriteBlocks(make([]byte, tt.size)); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		if want, got := tt.warn, strings.Count(buf.String(), "tsize") == 1; want != got {
+			t.Fatalf("[%02d] test %q, unexpected warning: %q",
+				i, tt.description, buf.String())
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterTransferSizeOffset verifies that a
+// bufferedSocketResponseWriter counts content skipped using the offset option
+// towards the size advertised using the tsize option.
+func Test_bufferedSocketResponseWriterTransferSizeOffset(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+
+	w := newTestResponseWriter(&ackPacketConn{discard: true})
+	w.server = &Server{
+		StrictTransferSize: true,
+		ErrorLog:           log.New(buf, "", 0),
+	}
+
+	r := NewRequest(OpcodeRead, "foo", ModeOctet, map[string]string{
+		"offset": "100",
+		"tsize":  "0",
+	}, &net.UDPAddr{})
+
+	if err := ServeContent(w, r, bytes.NewReader(make([]byte, 1000))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want, got := "1000", w.options[optionTransferSize]; want != got {
+		t.Fatalf("unexpected tsize: %q != %q", want, got)
+	}
+	if buf.Len() > 0 {
+		t.Fatalf("unexpected warning: %q", buf.String())
+	}
+}
+
+// Test_newResponseUnsupportedMode verifies that newResponse rejects a request
+// with a transfer mode other than netascii or octet, and informs the client.
+func Test_newResponseUnsupportedMode(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := &Server{Addr: "127.0.0.1:0"}
+	r := &Request{Mode: "mail"}
+
+	if _, err := newResponse(s, c.LocalAddr(), nil, r); err != errUnsupportedMode {
+		t.Fatalf("unexpected error: %v != %v", errUnsupportedMode, err)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 128)
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok := parseErrorPacket(b[:n]).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeIllegalOperation {
+		t.Fatalf("expected illegal operation ERROR packet, but got: %v", b[:n])
+	}
+}
+
+// Test_bufferedSocketResponseWriterState verifies that a
+// bufferedSocketResponseWriter behaves consistently regardless of how a
+// handler ends a transfer.
+func Test_bufferedSocketResponseWriterState(t *testing.T) {
+	var tests = []struct {
+		description string
+		fn          func(w *bufferedSocketResponseWriter) error
+		err         error
+		writes      int
+	}{
+		{
+			description: "Flush once",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_, _ = w.Write([]byte("hello"))
+				return w.Flush()
+			},
+			writes: 1,
+		},
+		{
+			description: "Flush twice",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_, _ = w.Write([]byte("hello"))
+				_ = w.Flush()
+				return w.Flush()
+			},
+			writes: 1,
+		},
+		{
+			description: "Write after Flush",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_, _ = w.Write([]byte("hello"))
+				_ = w.Flush()
+				_, err := w.Write([]byte("world"))
+				return err
+			},
+			err:    ErrWriteAfterFlush,
+			writes: 1,
+		},
+		{
+			description: "WriteBlocks after Flush",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_ = w.Flush()
+				return w.WriteBlocks([]byte("world"))
+			},
+			err:    ErrWriteAfterFlush,
+			writes: 1,
+		},
+		{
+			description: "Close twice",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_ = w.Flush()
+				_ = w.Close()
+				return w.Close()
+			},
+			writes: 1,
+		},
+		{
+			description: "Flush after Close",
+			fn: func(w *bufferedSocketResponseWriter) error {
+				_ = w.Close()
+				return w.Flush()
+			},
+			err: ErrWriteAfterClose,
+		},
+	}
+
+	for i, tt := range tests {
+		c := &ackPacketConn{}
+		w := newTestResponseWriter(c)
+		w.server.DisableDally = true
+
+		if want, got := tt.err, tt.fn(w); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.writes, len(c.writes); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterWriteAfterClose verifies that
+// bufferedSocketResponseWriter returns ErrWriteAfterClose when Write or
+// Flush is called after Close.
+func Test_bufferedSocketResponseWriterWriteAfterClose(t *testing.T) {
+	c := &testPacketConn{}
+	w := newTestResponseWriter(c)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.closed {
+		t.Fatal("underlying connection was not closed")
+	}
+
+	if _, err := w.Write([]byte("hello")); err != ErrWriteAfterClose {
+		t.Fatalf("unexpected Write error: %v != %v", ErrWriteAfterClose, err)
+	}
+	if err := w.Flush(); err != ErrWriteAfterClose {
+		t.Fatalf("unexpected Flush error: %v != %v", ErrWriteAfterClose, err)
+	}
+
+	if want, got := 0, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterCancel verifies that
+// bufferedSocketResponseWriter.Cancel closes the underlying connection
+// without sending any packets, even if data is buffered.
+func Test_bufferedSocketResponseWriterCancel(t *testing.T) {
+	c := &testPacketConn{}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize] = "1024"
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.closed {
+		t.Fatal("underlying connection was not closed")
+	}
+	if want, got := 0, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+
+	if want, got := ErrWriteAfterClose, w.Flush(); want != got {
+		t.Fatalf("unexpected error after cancel: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterDally verifies that
+// bufferedSocketResponseWriter dallies after the final block is acknowledged,
+// unless dallying is disabled by the server.
+func Test_bufferedSocketResponseWriterDally(t *testing.T) {
+	var tests = []struct {
+		description string
+		disable     bool
+		writes      int
+		unread      int
+	}{
+		{
+			description: "dally enabled, final block resent once",
+			writes:      2,
+			unread:      0,
+		},
+		{
+			description: "dally disabled, socket closed immediately",
+			disable:     true,
+			writes:      1,
+			unread:      3,
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: []testRead{
+			// Final block acknowledged
+			{b: []byte{0, 4, 0, 1}},
+			// Duplicate final ACK, ignored
+			{b: []byte{0, 4, 0, 1}},
+			// Previous block acknowledged, final block resent
+			{b: []byte{0, 4, 0, 0}},
+			// Dally period ends
+			{err: errTestTimeout},
+		}}
+		w := newTestResponseWriter(c)
+		w.server.DisableDally = tt.disable
+
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.writes, len(c.writes); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of writes: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.unread, len(c.reads); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of unread packets: %v != %v",
+				i, tt.description, want, got)
+		}
+		if !c.closed {
+			t.Fatalf("[%02d] test %q, underlying connection was not closed",
+				i, tt.description)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterDallyPackets verifies that
+// bufferedSocketResponseWriter responds to each kind of packet a client may
+// send while dallying, resending the final packet only when the client has
+// not received it.
+func Test_bufferedSocketResponseWriterDallyPackets(t *testing.T) {
+	final := append([]byte{0, 3, 0, 2}, "hello"...)
+
+	var tests = []struct {
+		description string
+		receive     bool
+		reads       []testRead
+		writes      [][]byte
+		unread      int
+	}{
+		{
+			description: "duplicate final ACKs ignored",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 2}},
+				{b: []byte{0, 4, 0, 2}},
+				{err: errTestTimeout},
+			},
+		},
+		{
+			description: "previous block ACKed, final block resent",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 1}},
+				{err: errTestTimeout},
+			},
+			writes: [][]byte{final},
+		},
+		{
+			description: "final block requested twice, resent twice",
+			reads: []testRead{
+				{b: []byte{0, 4, 0, 1}},
+				{b: []byte{0, 4, 0, 2}},
+				{b: []byte{0, 4, 0, 1}},
+				{err: errTestTimeout},
+			},
+			writes: [][]byte{final, final},
+		},
+		{
+			description: "malformed packet ignored",
+			reads: []testRead{
+				{b: []byte{0, 4}},
+				{b: []byte{0, 4, 0, 1}},
+				{err: errTestTimeout},
+			},
+			writes: [][]byte{final},
+		},
+		{
+			description: "ERROR ends dally",
+			reads: []testRead{
+				{b: append([]byte{0, 5, 0, 0}, "bye\x00"...)},
+				{b: []byte{0, 4, 0, 1}},
+				{err: errTestTimeout},
+			},
+			unread: 2,
+		},
+		{
+			description: "receive, duplicate final DATA, final ACK resent",
+			receive:     true,
+			reads: []testRead{
+				{b: final},
+				{err: errTestTimeout},
+			},
+			writes: [][]byte{{0, 4, 0, 2}},
+		},
+		{
+			description: "receive, earlier DATA ignored",
+			receive:     true,
+			reads: []testRead{
+				{b: append([]byte{0, 3, 0, 1}, "hello"...)},
+				{err: errTestTimeout},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &testPacketConn{reads: tt.reads}
+		w := newTestResponseWriter(c)
+		w.receiving = tt.receive
+		w.block = 2
+		w.state = stateFlushed
+
+		// The final packet sent to the client
+		w.rb = make([]byte, 4+DefaultBlockSize)
+		w.wb = make([]byte, 4+DefaultBlockSize)
+		w.n = copy(w.wb, final)
+		if tt.receive {
+			w.n = copy(w.wb, []byte{0, 4, 0, 2})
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := tt.writes, c.writes; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.unread, len(c.reads); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of unread packets: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterStall verifies that
+// bufferedSocketResponseWriter reports a stalled transfer once per block,
+// and continues the transfer when the client resumes.
+func Test_bufferedSocketResponseWriterStall(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		// Client pauses, and the transfer stalls
+		{err: errTestTimeout},
+		{err: errTestTimeout},
+		// Client resumes
+		{b: []byte{0, 4, 0, 1}},
+	}}
+	w := newTestResponseWriter(c)
+
+	var blocks []uint16
+	w.server.StallTimeout = 1 * time.Nanosecond
+	w.server.OnStall = func(addr net.Addr, block uint16) {
+		if want, got := w.remoteAddr, addr; want != got {
+			t.Fatalf("unexpected stalled client address: %v != %v", want, got)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []uint16{1}, blocks; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected stalled blocks: %v != %v", want, got)
+	}
+	if want, got := 3, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterBackoff verifies that a
+// bufferedSocketResponseWriter waits longer for a reply after each
+// consecutive timeout, up to a maximum, and waits for the initial timeout
+// again once a reply is received.
+func Test_bufferedSocketResponseWriterBackoff(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		{err: errTestTimeout},
+		{err: errTestTimeout},
+		{err: errTestTimeout},
+		{b: []byte{0, 4, 0, 1}},
+		{err: errTestTimeout},
+		{b: []byte{0, 4, 0, 2}},
+	}}
+	w := newTestResponseWriter(c)
+	w.server.RetransmitTimeout = 1 * time.Second
+	w.server.MaxRetransmitTimeout = 3 * time.Second
+
+	if _, err := w.Write(make([]byte, DefaultBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []time.Duration
+	for _, d := range c.deadlines {
+		got = append(got, d.Round(time.Second))
+	}
+
+	want := []time.Duration{
+		// Block 1
+		1 * time.Second,
+		2 * time.Second,
+		3 * time.Second,
+		3 * time.Second,
+		// Block 2
+		1 * time.Second,
+		2 * time.Second,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected deadlines:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterLargeTransfer verifies that a
+// bufferedSocketResponseWriter can send more than 4 GiB of content, with
+// block numbers wrapping around, and reports the number of bytes sent
+// without overflow.
+func Test_bufferedSocketResponseWriterLargeTransfer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large transfer in short mode")
+	}
+
+	var (
+		oacks  int
+		blocks int64
+	)
+	c := &hookPacketConn{
+		ackPacketConn: ackPacketConn{discard: true},
+		hook: func(p []byte) {
+			switch Opcode(binary.BigEndian.Uint16(p[0:2])) {
+			case opcodeOACK:
+				oacks++
+			case opcodeDATA:
+				blocks++
+			}
+		},
+	}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize] = strconv.Itoa(MaxBlockSize)
+
+	const size int64 = 5 << 30
+	chunk := make([]byte, 1<<20)
+	for n := int64(0); n < size; n += int64(len(chunk)) {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := size, w.Stats().Bytes; want != got {
+		t.Fatalf("unexpected number of bytes: %v != %v", want, got)
+	}
+	if want, got := size/MaxBlockSize+1, blocks; want != got {
+		t.Fatalf("unexpected number of blocks: %v != %v", want, got)
+	}
+	if want, got := 1, oacks; want != got {
+		t.Fatalf("unexpected number of OACKs: %v != %v", want, got)
+	}
+	if want, got := 0, w.Stats().Retransmits; want != got {
+		t.Fatalf("unexpected number of retransmits: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterTransferTimeout verifies that a
+// bufferedSocketResponseWriter aborts a transfer which does not complete
+// before its deadline, and informs the client.
+func Test_bufferedSocketResponseWriterTransferTimeout(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		{err: errTestTimeout},
+	}}
+	w := newTestResponseWriter(c)
+	w.deadline = time.Now().Add(-1 * time.Second)
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := errTransferTimeout, w.Flush(); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	if want, got := 1, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+	if e, ok := parseErrorPacket(c.writes[0]).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeUndefined {
+		t.Fatalf("expected ERROR packet, but got: %v", c.writes[0])
+	}
+}
+
+// Test_bufferedSocketResponseWriterRequestDuringTransfer verifies that a
+// bufferedSocketResponseWriter aborts a transfer with an illegal operation
+// ERROR packet if the client sends a new request, such as to renegotiate the
+// block size, instead of an ACK.
+func Test_bufferedSocketResponseWriterRequestDuringTransfer(t *testing.T) {
+	rrq := append(testRRQ("foo"), "blksize\x001024\x00"...)
+
+	c := &testPacketConn{reads: []testRead{
+		{b: rrq},
+	}}
+	w := newTestResponseWriter(c)
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := error(errRequestDuringTransfer), w.Flush(); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	if want, got := 2, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+	if e, ok := parseErrorPacket(c.writes[1]).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeIllegalOperation {
+		t.Fatalf("expected illegal operation ERROR packet, but got: %v", c.writes[1])
+	}
+}
+
+// Test_bufferedSocketResponseWriterUnexpectedOACK verifies that a
+// bufferedSocketResponseWriter fails a transfer with a distinct error if it
+// receives an OACK while waiting for an ACK, rather than treating the OACK as
+// a malformed ERROR packet.
+func Test_bufferedSocketResponseWriterUnexpectedOACK(t *testing.T) {
+	c := &testPacketConn{reads: []testRead{
+		{b: []byte{0, 6, 'b', 'l', 'k', 's', 'i', 'z', 'e', 0, '5', '1', '2', 0}},
+	}}
+	w := newTestResponseWriter(c)
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := errUnexpectedOACK, w.Flush(); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	if want, got := 1, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterBufferAliasing verifies that a block taken
+// from a bufferedSocketResponseWriter's buffer is copied before any other
+// operation which could modify the buffer, such as a write interleaved with
+// sending the OACK which precedes the first block.
+func Test_bufferedSocketResponseWriterBufferAliasing(t *testing.T) {
+	c := &hookPacketConn{}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize] = strconv.Itoa(DefaultBlockSize)
+
+	a := bytes.Repeat([]byte{'a'}, DefaultBlockSize)
+	b := bytes.Repeat([]byte{'b'}, DefaultBlockSize/4)
+
+	c.hook = func(p []byte) {
+		// Buffer more data while the OACK is in flight
+		if Opcode(binary.BigEndian.Uint16(p[0:2])) == opcodeOACK {
+			_, _ = w.buf.Write(b)
+		}
+	}
+
+	if _, err := w.Write(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for _, p := range c.writes {
+		if Opcode(binary.BigEndian.Uint16(p[0:2])) == opcodeDATA {
+			got = append(got, p[4:]...)
+		}
+	}
+
+	if want := append(a, b...); !bytes.Equal(want, got) {
+		t.Fatalf("unexpected content:\n- want: %q\n-  got: %q", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterWriteBlocks verifies that
+// bufferedSocketResponseWriter.WriteBlocks sends content in blocks, ending
+// with a short or empty block.
+func Test_bufferedSocketResponseWriterWriteBlocks(t *testing.T) {
+	var tests = []struct {
+		description string
+		size        int
+		blocks      []int
+	}{
+		{
+			description: "empty content",
+			size:        0,
+			blocks:      []int{0},
+		},
+		{
+			description: "one short block",
+			size:        100,
+			blocks:      []int{100},
+		},
+		{
+			description: "one full block, one empty block",
+			size:        DefaultBlockSize,
+			blocks:      []int{DefaultBlockSize, 0},
+		},
+		{
+			description: "two full blocks, one short block",
+			size:        DefaultBlockSize*2 + 1,
+			blocks:      []int{DefaultBlockSize, DefaultBlockSize, 1},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &ackPacketConn{}
+		w := newTestResponseWriter(c)
+
+		if err := w.WriteBlocks(make([]byte, tt.size)); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		var blocks []int
+		for _, b := range c.writes {
+			blocks = append(blocks, len(b)-4)
+		}
+
+		if want, got := tt.blocks, blocks; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected block sizes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterServeBlocks verifies that
+// bufferedSocketResponseWriter sends each block from a BlockSource in its own
+// DATA packet, and ends the transfer after the last block.
+func Test_bufferedSocketResponseWriterServeBlocks(t *testing.T) {
+	var tests = []struct {
+		description string
+		last        int
+		blocks      []int
+	}{
+		{
+			description: "short last block",
+			last:        100,
+			blocks:      []int{DefaultBlockSize, DefaultBlockSize, 100},
+		},
+		{
+			description: "full last block, one empty block",
+			last:        DefaultBlockSize,
+			blocks:      []int{DefaultBlockSize, DefaultBlockSize, DefaultBlockSize, 0},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &ackPacketConn{}
+		w := newTestResponseWriter(c)
+
+		src := &testBlockSource{sizes: []int{DefaultBlockSize, DefaultBlockSize, tt.last}}
+		if err := ServeBlocks(w, src); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v",
+				i, tt.description, err)
+		}
+
+		if want, got := []uint16{1, 2, 3}, src.reads; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected blocks read: %v != %v",
+				i, tt.description, want, got)
+		}
+
+		var blocks []int
+		for j, b := range c.writes {
+			if want, got := uint16(j+1), binary.BigEndian.Uint16(b[2:4]); want != got {
+				t.Fatalf("[%02d] test %q, unexpected block number: %d != %d",
+					i, tt.description, want, got)
+			}
+			if want, got := bytes.Repeat([]byte{byte(j + 1)}, len(b)-4), b[4:]; !bytes.Equal(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected content in block %d",
+					i, tt.description, j+1)
+			}
+
+			blocks = append(blocks, len(b)-4)
+		}
+
+		if want, got := tt.blocks, blocks; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected block sizes: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := stateFlushed, w.state; want != got {
+			t.Fatalf("[%02d] test %q, unexpected state: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// testBlockSource is a BlockSource which returns blocks of the specified
+// sizes, each filled with its block number, and records the blocks read.
+type testBlockSource struct {
+	sizes []int
+	reads []uint16
+}
+
+func (s *testBlockSource) ReadBlock(block uint16, buf []byte) (int, bool, error) {
+	s.reads = append(s.reads, block)
+
+	n := s.sizes[block-1]
+	for i := range buf[:n] {
+		buf[i] = byte(block)
+	}
+
+	return n, int(block) == len(s.sizes), nil
+}
+
+// Test_bufferedSocketResponseWriterRateLimit verifies that
+// bufferedSocketResponseWriter does not send packets faster than the rate
+// configured by the server.
+func Test_bufferedSocketResponseWriterRateLimit(t *testing.T) {
+	c := &ackPacketConn{}
+	w := newTestResponseWriter(c)
+	w.server.RateBytesPerSec = 8192
+
+	start := time.Now()
+
+	// 4 full blocks and 1 empty block: 2068 bytes on the wire
+	if _, err := w.Write(make([]byte, DefaultBlockSize*4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first packet is sent immediately, but the remaining packets must
+	// wait for the bytes of the previous packets to be accounted for
+	if want, got := time.Duration(float64(2064)/8192*float64(time.Second)), time.Since(start); got < want {
+		t.Fatalf("transfer completed too quickly: %v < %v", got, want)
+	}
+	if want, got := 5, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// TestServerRateLimitBelowTimeout verifies that a transfer completes when the
+// server's rate limit delays each packet for longer than the retransmit
+// timeout.
+func TestServerRateLimitBelowTimeout(t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, DefaultBlockSize*2+100)
+
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+			_ = ServeContent(w, r, bytes.NewReader(content))
+		}),
+		// Each full DATA packet is delayed by about 126ms, more than
+		// twice the retransmit timeout
+		RateBytesPerSec:   4096,
+		RetransmitTimeout: 50 * time.Millisecond,
+		MaxRetries:        3,
+		DisableDally:      true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b, err := testGet(t, addr, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := content, b; !bytes.Equal(want, got) {
+		t.Fatalf("unexpected content: %d bytes != %d bytes", len(want), len(got))
+	}
+}
+
+// Test_bufferedSocketResponseWriterMinBlockInterval verifies that
+// bufferedSocketResponseWriter waits at least the interval set by a handler
+// between each DATA block.
+func Test_bufferedSocketResponseWriterMinBlockInterval(t *testing.T) {
+	c := &ackPacketConn{}
+	w := newTestResponseWriter(c)
+	w.SetMinBlockInterval(20 * time.Millisecond)
+
+	start := time.Now()
+
+	// 4 full blocks and 1 empty block
+	const blocks = 5
+	if _, err := w.Write(make([]byte, DefaultBlockSize*4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := (blocks-1)*20*time.Millisecond, time.Since(start); got < want {
+		t.Fatalf("transfer completed too quickly: %v < %v", got, want)
+	}
+	if want, got := blocks, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterMinBlockIntervalWindow verifies that
+// bufferedSocketResponseWriter waits at least the interval set by a handler
+// between each DATA block within a window.
+func Test_bufferedSocketResponseWriterMinBlockIntervalWindow(t *testing.T) {
+	var times []time.Time
+	c := &hookPacketConn{hook: func(b []byte) {
+		if Opcode(binary.BigEndian.Uint16(b[0:2])) == opcodeDATA {
+			times = append(times, time.Now())
+		}
+	}}
+	w := newTestResponseWriter(c)
+	w.server.DisableDally = true
+	w.options[optionWindowSize] = "4"
+	w.SetMinBlockInterval(20 * time.Millisecond)
+
+	// 4 full blocks and 1 empty block, sent in two windows
+	if _, err := w.Write(make([]byte, DefaultBlockSize*4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 5, len(times); want != got {
+		t.Fatalf("unexpected number of DATA packets: %v != %v", want, got)
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < 20*time.Millisecond {
+			t.Fatalf("block %d sent too quickly after block %d: %v", i+1, i, d)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterSendBurstEarlyACK verifies that
+// bufferedSocketResponseWriter reads acknowledgements which a client sends
+// before the end of a window between bursts, and removes the acknowledged
+// blocks from the window instead of sending them again.
+func Test_bufferedSocketResponseWriterSendBurstEarlyACK(t *testing.T) {
+	srv, cli := testSocketPair(t)
+	defer srv.Close()
+	defer cli.Close()
+
+	w := newTestResponseWriter(srv)
+	w.remoteAddr = cli.LocalAddr()
+	w.server.DisableDally = true
+	w.options[optionWindowSize] = "4"
+	w.oacked = true
+
+	// The acknowledgement of block 1 is already queued when the window is
+	// sent, and block 4 is acknowledged once it arrives
+	if _, err := cli.WriteTo([]byte{0, 4, 0, 1}, srv.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	blockC := make(chan []uint16, 1)
+	go func() {
+		var blocks []uint16
+		defer func() { blockC <- blocks }()
+
+		buf := make([]byte, 4+DefaultBlockSize)
+		for {
+			if err := cli.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				return
+			}
+
+			_, addr, err := cli.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			block := binary.BigEndian.Uint16(buf[2:4])
+			blocks = append(blocks, block)
+			if block == 4 {
+				_, _ = cli.WriteTo([]byte{0, 4, 0, 4}, addr)
+				return
+			}
+		}
+	}()
+
+	// 3 full blocks and 1 empty block fill a single window
+	if err := w.WriteBlocks(make([]byte, DefaultBlockSize*3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []uint16{1, 2, 3, 4}, <-blockC; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected blocks sent:\n- want: %v\n-  got: %v", want, got)
+	}
+	if want, got := 0, w.Stats().Retransmits; want != got {
+		t.Fatalf("unexpected number of retransmits: %v != %v", want, got)
+	}
+	if want, got := int64(DefaultBlockSize*3), w.Stats().Bytes; want != got {
+		t.Fatalf("unexpected number of bytes: %v != %v", want, got)
+	}
+}
+
+// Test_bufferedSocketResponseWriterWindow verifies that
+// bufferedSocketResponseWriter sends a window of blocks before waiting for an
+// acknowledgement, and that when a client acknowledges a block within the
+// window, exactly the blocks which follow it are sent again, in order.
+func Test_bufferedSocketResponseWriterWindow(t *testing.T) {
+	var tests = []struct {
+		description string
+		start       uint16
+		acks        []uint16
+		blocks      []uint16
+		retransmits int
+	}{
+		{
+			description: "full window acknowledged",
+			acks:        []uint16{4},
+			blocks:      []uint16{1, 2, 3, 4},
+		},
+		{
+			description: "mid-window block acknowledged",
+			acks:        []uint16{2, 4},
+			blocks:      []uint16{1, 2, 3, 4, 3, 4},
+			retransmits: 1,
+		},
+		{
+			description: "block before window acknowledged",
+			acks:        []uint16{0, 4},
+			blocks:      []uint16{1, 2, 3, 4, 1, 2, 3, 4},
+			retransmits: 1,
+		},
+		{
+			description: "block after window acknowledged",
+			acks:        []uint16{9, 4},
+			blocks:      []uint16{1, 2, 3, 4, 1, 2, 3, 4},
+			retransmits: 1,
+		},
+		{
+			description: "mid-window block acknowledged, block number wraps",
+			start:       65533,
+			acks:        []uint16{65535, 0, 1},
+			blocks:      []uint16{65534, 65535, 0, 1, 0, 1, 1},
+			retransmits: 2,
+		},
+	}
+
+	for i, tt := range tests {
+		// Acknowledge the OACK, and then each window as scripted
+		reads := []testRead{{b: []byte{0, 4, 0, 0}}}
+		for _, a := range tt.acks {
+			reads = append(reads, testRead{b: []byte{0, 4, byte(a >> 8), byte(a)}})
+		}
+
+		c := &testPacketConn{reads: reads}
+		w := newTestResponseWriter(c)
+		w.server.DisableDally = true
+		w.options[optionWindowSize] = "4"
+		w.block = tt.start
+
+		// 3 full blocks and 1 empty block fill a single window
+		if _, err := w.Write(make([]byte, DefaultBlockSize*3)); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		// Skip the OACK
+		var blocks []uint16
+		for _, b := range c.writes[1:] {
+			blocks = append(blocks, binary.BigEndian.Uint16(b[2:4]))
+		}
+
+		if want, got := tt.blocks, blocks; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected blocks sent:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.retransmits, w.Stats().Retransmits; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of retransmits: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := int64(DefaultBlockSize*3), w.Stats().Bytes; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterBlockTransform verifies that
+// bufferedSocketResponseWriter applies the server's BlockTransform to the
+// payload of each DATA block, and sends the transformed payload.
+func Test_bufferedSocketResponseWriterBlockTransform(t *testing.T) {
+	content := append(bytes.Repeat([]byte{'a'}, DefaultBlockSize), "hello"...)
+
+	var tests = []struct {
+		description string
+		fn          func(block uint16, payload []byte) []byte
+		window      string
+		packets     [][]byte
+	}{
+		{
+			description: "identity",
+			fn: func(block uint16, payload []byte) []byte {
+				return payload
+			},
+			packets: [][]byte{
+				append([]byte{0, 3, 0, 1}, content[:DefaultBlockSize]...),
+				append([]byte{0, 3, 0, 2}, "hello"...),
+			},
+		},
+		{
+			description: "append block number",
+			fn: func(block uint16, payload []byte) []byte {
+				return append(payload, byte(block))
+			},
+			packets: [][]byte{
+				append(append([]byte{0, 3, 0, 1}, content[:DefaultBlockSize]...), 1),
+				append([]byte{0, 3, 0, 2}, "hello\x02"...),
+			},
+		},
+		{
+			description: "append block number, windowsize",
+			fn: func(block uint16, payload []byte) []byte {
+				return append(payload, byte(block))
+			},
+			window: "4",
+			packets: [][]byte{
+				append(append([]byte{0, 3, 0, 1}, content[:DefaultBlockSize]...), 1),
+				append([]byte{0, 3, 0, 2}, "hello\x02"...),
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		c := &ackPacketConn{}
+		w := newTestResponseWriter(c)
+		w.server.BlockTransform = tt.fn
+
+		writes := func() [][]byte { return c.writes }
+		if tt.window != "" {
+			w.options[optionWindowSize] = tt.window
+
+			// Skip the OACK
+			writes = func() [][]byte { return c.writes[1:] }
+		}
+
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		if want, got := tt.packets, writes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected packets:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		if want, got := int64(len(content)), w.Stats().Bytes; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Test_bufferedSocketResponseWriterDeflate verifies that
+// bufferedSocketResponseWriter compresses the payload of each DATA block if
+// the deflate option is accepted, so that a cooperating client which
+// decompresses each payload receives the original content.
+func Test_bufferedSocketResponseWriterDeflate(t *testing.T) {
+	var tests = []struct {
+		description string
+		content     []byte
+		window      string
+	}{
+		{
+			description: "compressible content",
+			content:     bytes.Repeat([]byte("hello, world\n"), 300),
+		},
+		{
+			description: "incompressible content",
+			content:     testRandomBytes(t, 3*DefaultBlockSize),
+		},
+		{
+			description: "exactly one block",
+			content:     bytes.Repeat([]byte{'a'}, DefaultBlockSize),
+		},
+		{
+			description: "compressible content, windowsize",
+			content:     bytes.Repeat([]byte("hello, world\n"), 300),
+			window:      "4",
+		},
+	}
+
+	for i, tt := range tests {
+		c := &ackPacketConn{}
+		w := newTestResponseWriter(c)
+		w.options[optionDeflate] = "1"
+		if tt.window != "" {
+			w.options[optionWindowSize] = tt.window
+		}
+
+		if _, err := w.Write(tt.content); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		// Act as a cooperating client: skip the OACK, decompress each
+		// payload, and stop at the first short decompressed payload
+		var got []byte
+		for j, p := range c.writes[1:] {
+			b, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(p[4:])))
+			if err != nil {
+				t.Fatalf("[%02d] test %q, failed to decompress block %d: %v",
+					i, tt.description, j+1, err)
+			}
+			got = append(got, b...)
+
+			if len(b) < DefaultBlockSize {
+				if want, got := len(c.writes)-2, j; want != got {
+					t.Fatalf("[%02d] test %q, transfer ended early at block %d",
+						i, tt.description, j+1)
+				}
+				break
+			}
+		}
+
+		if want := tt.content; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected decompressed content",
+				i, tt.description)
+		}
+		if want, got := int64(len(tt.content)), w.Stats().Bytes; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// testRandomBytes returns n bytes of random data.
+func testRandomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// Test_bufferedSocketResponseWriterStatsTimes verifies that
+// bufferedSocketResponseWriter records the times at which a transfer begins
+// and ends.
+func Test_bufferedSocketResponseWriterStatsTimes(t *testing.T) {
+	c := &ackPacketConn{}
+	w := newTestResponseWriter(c)
+	w.server.DisableDally = true
+	w.SetMinBlockInterval(20 * time.Millisecond)
+
+	if stats := w.Stats(); !stats.StartTime.IsZero() || !stats.EndTime.IsZero() {
+		t.Fatalf("transfer times set before transfer began: %v, %v",
+			stats.StartTime, stats.EndTime)
+	}
+
+	// 4 full blocks and 1 empty block
+	if _, err := w.Write(make([]byte, DefaultBlockSize*4)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := w.Stats(); stats.StartTime.IsZero() || !stats.EndTime.IsZero() {
+		t.Fatalf("unexpected transfer times during transfer: %v, %v",
+			stats.StartTime, stats.EndTime)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := w.Stats()
+	if !stats.EndTime.After(stats.StartTime) {
+		t.Fatalf("transfer end time %v is not after start time %v",
+			stats.EndTime, stats.StartTime)
+	}
+
+	d := stats.EndTime.Sub(stats.StartTime)
+	if min, max := 80*time.Millisecond, 2*time.Second; d < min || d > max {
+		t.Fatalf("unexpected transfer duration: %v, want between %v and %v",
+			d, min, max)
+	}
+
+	// Closing the transfer does not change its end time
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := stats.EndTime, w.Stats().EndTime; !want.Equal(got) {
+		t.Fatalf("transfer end time changed after close: %v != %v", want, got)
+	}
+}
+
+// Test_responseReadFrom verifies that io.Copy to a response sends every
+// block to a client and ends the transfer, without a call to Flush.
+func Test_responseReadFrom(t *testing.T) {
+	c := &ackPacketConn{}
+	w := newTestResponseWriter(c)
+	w.options[optionBlockSize] = "1428"
+	r := &response{ResponseWriter: w, bsw: w}
+
+	// Hide bytes.Reader's WriteTo method, which io.Copy would otherwise
+	// prefer over ReadFrom
+	src := struct{ io.Reader }{bytes.NewReader(make([]byte, 2*1428+1))}
+
+	if _, err := io.Copy(r, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the OACK; each DATA block is of the negotiated size
+	var blocks []int
+	for _, b := range c.writes[1:] {
+		blocks = append(blocks, len(b)-4)
+	}
+
+	if want, got := []int{1428, 1428, 1}, blocks; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected block sizes: %v != %v", want, got)
+	}
+
+	// Flush after the transfer ends has no effect
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, len(c.writes); want != got {
+		t.Fatalf("unexpected number of writes after Flush: %v != %v", want, got)
+	}
+}
+
+// BenchmarkBufferedSocketResponseWriterCopy measures the performance of
+// sending in-memory content to a client using io.Copy.
+func BenchmarkBufferedSocketResponseWriterCopy(b *testing.B) {
+	p := make([]byte, 1<<20)
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w := newTestResponseWriter(&ackPacketConn{discard: true})
+		if _, err := io.Copy(w, bytes.NewReader(p)); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBufferedSocketResponseWriterWriteBlocks measures the performance
+// of sending in-memory content to a client using WriteBlocks.
+func BenchmarkBufferedSocketResponseWriterWriteBlocks(b *testing.B) {
+	p := make([]byte, 1<<20)
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w := newTestResponseWriter(&ackPacketConn{discard: true})
+		if err := w.WriteBlocks(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBufferedSocketResponseWriterSendBurst measures the performance of
+// sending in-memory content to a client on the loopback interface in windows
+// of 16 blocks, with varying numbers of packets sent in each burst.
+func BenchmarkBufferedSocketResponseWriterSendBurst(b *testing.B) {
+	const window = 16
+	p := make([]byte, 1<<20)
+
+	for _, burst := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(burst), func(b *testing.B) {
+			srv, cli := testSocketPair(b)
+			defer srv.Close()
+			defer cli.Close()
+
+			// Acknowledge the last block of each window, and the final
+			// block of each transfer
+			go func() {
+				buf := make([]byte, 4+DefaultBlockSize)
+				for {
+					n, addr, err := cli.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+
+					block := binary.BigEndian.Uint16(buf[2:4])
+					if block%window == 0 || n < len(buf) {
+						ack := []byte{0, 4, byte(block >> 8), byte(block)}
+						_, _ = cli.WriteTo(ack, addr)
+					}
+				}
+			}()
+
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				w := newTestResponseWriter(srv)
+				w.remoteAddr = cli.LocalAddr()
+				w.server.SendBurst = burst
+				w.options[optionWindowSize] = strconv.Itoa(window)
+				w.oacked = true
+
+				if err := w.WriteBlocks(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// testSocketPair binds two UDP sockets on the loopback interface, for use as
+// the server and client sides of a transfer.
+func testSocketPair(tb testing.TB) (net.PacketConn, net.PacketConn) {
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	cli, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		_ = srv.Close()
+		tb.Fatal(err)
+	}
+
+	return srv, cli
+}
+
+// BenchmarkResponseReadFrom measures the performance of sending content
+// from an io.Reader to a client using ReadFrom, with varying block sizes.
+func BenchmarkResponseReadFrom(b *testing.B) {
+	p := make([]byte, 1<<20)
+
+	for _, size := range []int{512, 1428, 8192} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				w := newTestResponseWriter(&ackPacketConn{discard: true})
+				w.options[optionBlockSize] = strconv.Itoa(size)
+				r := &response{ResponseWriter: w, bsw: w}
+
+				// Hide bytes.Reader's WriteTo method so that ReadFrom
+				// performs its own reads
+				src := struct{ io.Reader }{bytes.NewReader(p)}
+				if _, err := r.ReadFrom(src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newTestResponseWriter creates a bufferedSocketResponseWriter which
+// communicates using the input net.PacketConn.
+func newTestResponseWriter(c net.PacketConn) *bufferedSocketResponseWriter {
+	return &bufferedSocketResponseWriter{
+		conn:       c,
+		remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969},
+		server:     &Server{},
+
+		buf:     bytes.NewBuffer(nil),
+		options: make(map[string]string),
+	}
+}
+
+// errTestTimeout is a timeout error returned by testPacketConn.
+var errTestTimeout = &net.OpError{
+	Op:  "read",
+	Err: testTimeoutError{},
+}
+
+// testTimeoutError is an error which reports itself as a timeout.
+type testTimeoutError struct{}
+
+func (testTimeoutError) Error() string   { return "i/o timeout" }
+func (testTimeoutError) Timeout() bool   { return true }
+func (testTimeoutError) Temporary() bool { return true }
+
+// testRead is the result of a single testPacketConn.ReadFrom call.
+type testRead struct {
+	b   []byte
+	err error
+}
+
+// testPacketConn is a net.PacketConn which returns scripted reads and
+// captures any packets written to it.
+type testPacketConn struct {
+	reads  []testRead
+	writes [][]byte
+	closed bool
+
+	// Number of writes which time out before writes succeed
+	writeTimeouts int
+
+	// Time remaining until each deadline passed to SetDeadline
+	deadlines []time.Duration
+}
+
+var _ net.PacketConn = &testPacketConn{}
+
+func (c *testPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.reads) == 0 {
+		return 0, nil, errors.New("no more reads")
+	}
+
+	r := c.reads[0]
+	c.reads = c.reads[1:]
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	return copy(b, r.b), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}, nil
+}
+
+func (c *testPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.writeTimeouts > 0 {
+		c.writeTimeouts--
+		return 0, errTestTimeout
+	}
+
+	p := make([]byte, len(b))
+	copy(p, b)
+	c.writes = append(c.writes, p)
+
+	return len(b), nil
+}
+
+func (c *testPacketConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *testPacketConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (c *testPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *testPacketConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, time.Until(t))
+	return nil
+}
+
+// ackPacketConn is a net.PacketConn which immediately acknowledges each
+// packet written to it, and captures the packets unless discard is set.
+type ackPacketConn struct {
+	testPacketConn
+	discard bool
+	block   uint16
+}
+
+func (c *ackPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	binary.BigEndian.PutUint16(b[0:2], uint16(opcodeACK))
+	binary.BigEndian.PutUint16(b[2:4], c.block)
+
+	return 4, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}, nil
+}
+
+func (c *ackPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// OACK packets are acknowledged with block 0
+	c.block = 0
+	if Opcode(binary.BigEndian.Uint16(b[0:2])) == opcodeDATA {
+		c.block = binary.BigEndian.Uint16(b[2:4])
+	}
+
+	if c.discard {
+		return len(b), nil
+	}
+
+	return c.testPacketConn.WriteTo(b, addr)
+}
+
+// hookPacketConn is an ackPacketConn which calls hook with each packet
+// before it is written.
+type hookPacketConn struct {
+	ackPacketConn
+	hook func(b []byte)
+}
+
+func (c *hookPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.hook(b)
+	return c.ackPacketConn.WriteTo(b, addr)
+}
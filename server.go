@@ -1,7 +1,17 @@
 package tftp
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // Server represents a TFTP server, and is used to configure a TFTP server's
@@ -11,9 +21,382 @@ type Server struct {
 	// default value is :69, as specified in RFC 1350, Section 4.
 	Addr string
 
+	// FreeBind specifies whether or not ListenAndServe may bind to an IP
+	// address which is not yet assigned to the host, such as a virtual IP
+	// address which is assigned later by a high availability daemon.  This
+	// uses the IP_FREEBIND socket option, and is only supported on Linux;
+	// on other platforms, ListenAndServe returns an error if FreeBind is
+	// set.
+	FreeBind bool
+
 	// Handler is the handler to use while serving TFP requests.
 	// Handler must not be nil.
 	Handler Handler
+
+	// DisableDally specifies whether or not the server should skip waiting
+	// for retransmission requests after the final block of a transfer is
+	// acknowledged, closing the transfer socket immediately instead.  By
+	// default, the server dallies as recommended by RFC 1350, Section 6.
+	DisableDally bool
+
+	// MaxBlockSize is the largest block size which the server will accept
+	// when a client requests a block size using the blksize option from
+	// RFC 2348.  If a client requests a larger block size, MaxBlockSize is
+	// acknowledged instead.  The default value is 1468, which avoids IP
+	// fragmentation on Ethernet networks.
+	MaxBlockSize int
+
+	// Deflate enables the non-standard deflate option for read requests.
+	// If a client requests the deflate option with a value of 1, the
+	// option is acknowledged, and the payload of each DATA block is
+	// compressed independently using DEFLATE, as described in RFC 1951.
+	//
+	// The deflate option is not supported by standard clients, and is
+	// only acknowledged to clients which request it.  A cooperating client
+	// must decompress each payload before checking its length, because
+	// the end of a transfer is signaled by a decompressed payload shorter
+	// than the block size.  A compressed payload may be larger than the
+	// block size if a block cannot be compressed, so the client must accept
+	// packets slightly larger than the negotiated block size.
+	Deflate bool
+
+	// MaxWindowSize, if greater than one, enables the windowsize option from
+	// RFC 7440 for read requests.  A client which requests a window size may
+	// be sent that many DATA blocks before each acknowledgement.  If a
+	// client requests a larger window size, MaxWindowSize is acknowledged
+	// instead.  By default, the windowsize option is ignored, and each block
+	// is acknowledged before the next is sent.
+	MaxWindowSize int
+
+	// SendBurst is the number of DATA packets in a window from RFC 7440
+	// which are handed to the socket in a tight loop before the sender
+	// checks, without waiting, for acknowledgements which the client has
+	// already sent.  Blocks which are acknowledged early are removed from
+	// the window, so that they are not sent again if the window must be
+	// retransmitted.  Larger bursts make fewer system calls, and may
+	// improve throughput on some network stacks, but react more slowly to
+	// acknowledgements.  SendBurst does not change when the client is
+	// expected to acknowledge the window.  The default value is 1, which
+	// checks for acknowledgements after every packet.  On platforms where
+	// a socket cannot be read without blocking, each window is sent in a
+	// single burst.
+	SendBurst int
+
+	// ReadAheadBlocks, if greater than zero, is the number of blocks of
+	// content which are read ahead of the blocks sent to a client when
+	// content is copied from an io.Reader, as is done by ServeContent for
+	// content which does not implement io.WriterTo.  Reading ahead smooths
+	// over jitter in slow sources, since content is read while earlier
+	// blocks are waiting to be acknowledged.  Unlike the windowsize option,
+	// read-ahead does not affect the packets sent to the client.
+	ReadAheadBlocks int
+
+	// RateBytesPerSec, if greater than zero, limits the rate at which
+	// packets are sent to a client during each transfer, in bytes per
+	// second.  Retransmitted packets count against the limit.
+	RateBytesPerSec int64
+
+	// BlockTransform, if not nil, is called with the block number and
+	// payload of each DATA block sent to a client, and the payload it
+	// returns is sent instead, such as to append a checksum to each block.
+	// The payload passed to BlockTransform is only valid until it returns,
+	// and may be modified in place.
+	//
+	// Standard clients cannot decode transformed blocks, so both ends of a
+	// transfer must agree on the transform.  The end of a transfer is
+	// determined by the length of each payload before it is transformed,
+	// but a client may only detect the end of a transfer if the final
+	// payload is still shorter than the block size once transformed.
+	BlockTransform func(block uint16, payload []byte) []byte
+
+	// SocketReuseTTL, if greater than zero, enables reuse of transfer
+	// sockets.  When a transfer completes, its socket is retained for up to
+	// SocketReuseTTL, and may be reused by a later transfer with a client
+	// at the same IP address.
+	SocketReuseTTL time.Duration
+
+	// PrewarmSockets, if greater than zero, is the number of transfer
+	// sockets which are bound in advance, so that a socket is ready as
+	// soon as a request arrives, rather than being bound before the first
+	// packet of a transfer can be sent.  When a transfer completes, its
+	// socket is returned to the pool if the pool is not full.
+	PrewarmSockets int
+
+	// HealthFilename, if set, specifies a filename which is served by the
+	// server itself as a liveness check, without invoking Handler.  A read
+	// request for HealthFilename is answered with a small, constant
+	// payload.
+	HealthFilename string
+
+	// VersionFilename and VersionString, if VersionFilename is set, specify
+	// a filename which is served by the server itself for diagnostics,
+	// without invoking Handler.  A read request for VersionFilename is
+	// answered with VersionString, such as the server's build version.
+	VersionFilename string
+	VersionString   string
+
+	// CaptureRawRequest specifies whether or not a copy of each request
+	// packet is stored in the Request passed to Handler, as Request.Raw.
+	CaptureRawRequest bool
+
+	// MaxOptions is the largest number of options from RFC 2347 which a
+	// client may send in a single request.  Requests with more options are
+	// rejected with ErrorCodeBadOptions.  The default value is 16.
+	MaxOptions int
+
+	// MaxFilenameLength is the longest filename, in bytes, which a client
+	// may request.  Requests with longer filenames are logged using
+	// ErrorLog and rejected with ErrorCodeAccessViolation.  The default
+	// value is 255.
+	MaxFilenameLength int
+
+	// RejectDuplicateRequests specifies how a request is handled when it is
+	// received from a client address which already has a transfer in
+	// progress, such as a late retransmission of the request which began
+	// the transfer.  Such requests never start a competing transfer, and
+	// are reported by Errors.  By default, they are discarded.  If
+	// RejectDuplicateRequests is set, the client is also sent an ERROR
+	// packet with ErrorCodeIllegalOperation.
+	RejectDuplicateRequests bool
+
+	// RequestBufferSize is the size of the buffer used to receive request
+	// packets, and so the largest request which may be received.  Requests
+	// which exceed it are discarded, and reported by Errors.  The default
+	// value is 1500, and values below 512 are raised to 512.
+	RequestBufferSize int
+
+	// AllowedNets, if not empty, restricts the clients which may make
+	// requests to those whose IP addresses are within one of the networks.
+	// Requests from any other client are discarded without a reply before
+	// they are parsed, and reported by Errors.
+	AllowedNets []*net.IPNet
+
+	// EmptyFilenameHandler, if not nil, is used to serve requests with an
+	// empty filename, instead of Handler.  By default, such requests are
+	// rejected with ErrorCodeFileNotFound.
+	EmptyFilenameHandler Handler
+
+	// TrimFilename, if true, removes trailing whitespace, including carriage
+	// returns and line feeds, from the filename of each incoming request,
+	// as is appended by some clients.  Trimming occurs before the filename
+	// is rewritten, validated, or passed to Handler.  By default, filenames
+	// are used exactly as requested.
+	TrimFilename bool
+
+	// RewriteFilename, if not nil, is called with the filename of each
+	// incoming request, and its result replaces the request's filename
+	// before the filename is validated or passed to Handler.  This allows
+	// filenames to be normalized in one place, such as by replacing the
+	// backslashes used by some PXE clients with slashes.
+	RewriteFilename func(filename string) string
+
+	// ValidateFilename, if not nil, is called to validate the filename of
+	// each incoming request before it is passed to Handler.  If an error is
+	// returned, an ERROR packet with ErrorCodeAccessViolation is sent to the
+	// client.  By default, filenames containing control characters are
+	// rejected.
+	ValidateFilename func(filename string) error
+
+	// StallTimeout and OnStall, if both are set, enable detection of stalled
+	// transfers.  If a client does not acknowledge a block within
+	// StallTimeout, OnStall is called once with the client's address and the
+	// unacknowledged block number.  The transfer is not aborted, and the
+	// block continues to be retransmitted.
+	StallTimeout time.Duration
+	OnStall      func(addr net.Addr, block uint16)
+
+	// RetransmitTimeout is the amount of time to wait for a reply from a
+	// client before retransmitting a packet.  The default value is 2
+	// seconds.  A client may negotiate a different value using the timeout
+	// option from RFC 2349.
+	//
+	// MaxRetransmitTimeout, if greater than the retransmit timeout, enables
+	// exponential backoff.  The time to wait for a reply doubles after each
+	// consecutive timeout, up to MaxRetransmitTimeout, and is reset once a
+	// reply is received.
+	RetransmitTimeout    time.Duration
+	MaxRetransmitTimeout time.Duration
+
+	// RetransmitOnDupAck specifies whether or not a block is retransmitted
+	// as soon as a client acknowledges the previous block again.  By
+	// default, duplicate ACKs are ignored, and a block is only
+	// retransmitted once the retransmit timeout expires, which avoids the
+	// "Sorcerer's Apprentice" problem described in RFC 1123, where every
+	// block after a delayed ACK is sent twice.
+	RetransmitOnDupAck bool
+
+	// MaxRetries, if greater than zero, limits the number of times a packet
+	// is retransmitted.  Both a timeout while sending a packet and a timeout
+	// while waiting for the client's reply count as a retry.  A transfer
+	// which exceeds MaxRetries for a single packet is aborted with an ERROR
+	// packet.  By default, packets are retransmitted until the transfer
+	// completes or exceeds TransferTimeout.
+	MaxRetries int
+
+	// TransferTimeout, if greater than zero, limits the total duration of
+	// each transfer.  A transfer which does not complete within
+	// TransferTimeout is aborted with an ERROR packet.  Requests which
+	// negotiate a timeout option from RFC 2349 which could allow a transfer
+	// to exceed TransferTimeout are rejected with ErrorCodeBadOptions.
+	TransferTimeout time.Duration
+
+	// KeepaliveInterval, if greater than zero, enables keepalives for read
+	// requests which negotiate options using RFC 2347.  The OACK is sent to
+	// the client before Handler is invoked, and is sent again every
+	// KeepaliveInterval until Handler sends data or an error, so that the
+	// client does not time out while Handler prepares content.  Options set
+	// by Handler are not sent to the client when keepalives are enabled.
+	KeepaliveInterval time.Duration
+
+	// ErrorLog specifies an optional logger for errors which occur while
+	// serving requests, such as a panicking Handler.  If nil, logging is
+	// done using the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// PanicHandler, if not nil, is called with the request and the
+	// recovered value whenever Handler panics.  The panic is always logged,
+	// and an ERROR packet is sent to the client before PanicHandler is
+	// called.
+	PanicHandler func(r *Request, v interface{})
+
+	// LargeTransferThreshold, if greater than zero, is the number of bytes
+	// after which a transfer is considered large.  If a large transfer uses
+	// the default block size of 512 bytes because the client did not
+	// negotiate a block size, a warning is logged using ErrorLog, so that
+	// operators may configure the client to request a larger block size.
+	LargeTransferThreshold int64
+
+	// StrictTransferSize specifies whether or not a transfer is aborted
+	// if Handler sends a different number of bytes than it advertised to
+	// the client using the tsize option from RFC 2349.  A mismatch is
+	// always logged using ErrorLog.  If StrictTransferSize is set, an
+	// ERROR packet is sent to the client instead of the block which would
+	// exceed the advertised size, or instead of a final block which would
+	// end the transfer before the advertised size is reached.
+	StrictTransferSize bool
+
+	// MaxErrorMessage is the largest number of bytes of the message in an
+	// ERROR packet received from a client which is retained.  Longer
+	// messages are truncated and end with "...", so that a client cannot
+	// fill logs with an arbitrarily large message.  The default value is
+	// 256.
+	MaxErrorMessage int
+
+	// OnError, if not nil, is called with the request, code, and message of
+	// each ERROR packet before it is sent to a client, whether the ERROR
+	// packet is sent by the server itself or by Handler.  The code and
+	// message which OnError returns are sent instead, and if OnError
+	// returns false, the ERROR packet is not sent at all.
+	OnError func(r *Request, code ErrorCode, msg string) (ErrorCode, string, bool)
+
+	// OnComplete, if not nil, is called with the request, statistics, and
+	// result of each transfer handled by Handler once Handler returns.  err
+	// is nil only if the final block of the transfer was exchanged with the
+	// client.  If the transfer failed, such as when the client stops
+	// responding or an ERROR packet is exchanged, err is the cause.  If the
+	// transfer ended early for any other reason, err is
+	// ErrIncompleteTransfer.
+	OnComplete func(r *Request, stats TransferStats, err error)
+
+	// TransferLog, if not nil, receives a record of each transfer handled
+	// by Handler once it is complete, written as a single line of JSON.
+	// Each record contains the filename, mode, opcode, remote address,
+	// number of bytes transferred, duration, number of retransmits, and
+	// result of the transfer.
+	TransferLog io.Writer
+
+	// logMu serializes writes to TransferLog.
+	logMu sync.Mutex
+
+	// mu guards boundAddr, sockets, pool, transfers, reserved, errs,
+	// listeners, and closing.
+	mu sync.Mutex
+
+	// listeners are the listeners passed to Serve and ServeStream, which
+	// are closed by Shutdown, and closing is set once Shutdown is called.
+	listeners map[io.Closer]struct{}
+	closing   bool
+
+	// active is the number of requests being served, accessed atomically.
+	active int32
+
+	// boundAddr is the address of the PacketConn passed to Serve.
+	boundAddr net.Addr
+
+	// sockets retains idle transfer sockets if SocketReuseTTL is set.
+	sockets *socketCache
+
+	// pool retains sockets bound in advance if PrewarmSockets is set.
+	pool *socketPool
+
+	// transfers is the registry of active transfers.
+	transfers map[*transfer]struct{}
+
+	// reserved maps each client address with a request which is being
+	// prepared, but not yet tracked as a transfer, to that request's conn.
+	reserved map[string]*conn
+
+	// errs receives non-fatal errors, once Errors is called.
+	errs chan error
+}
+
+// errorsBuffer is the number of errors buffered by the channel returned by
+// Server.Errors.
+const errorsBuffer = 64
+
+// Errors returns a channel which receives non-fatal errors which occur while
+// serving requests, such as malformed requests, failures to bind a transfer
+// socket, and packets rejected for using an unknown transfer ID.  The server
+// continues serving after each of these errors.
+//
+// Only errors which occur after Errors is first called are reported.  The
+// channel is buffered, and if it is full, the oldest error is discarded to
+// make room for a new one, so a slow consumer never blocks the server.
+func (s *Server) Errors() <-chan error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errs == nil {
+		s.errs = make(chan error, errorsBuffer)
+	}
+
+	return s.errs
+}
+
+// reportError sends err to the channel returned by Errors, if it has been
+// called, discarding the oldest error if the channel is full.
+func (s *Server) reportError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errs == nil {
+		return
+	}
+
+	for {
+		select {
+		case s.errs <- err:
+			return
+		default:
+		}
+
+		select {
+		case <-s.errs:
+		default:
+		}
+	}
+}
+
+// BoundAddr returns the network address which this server is listening on,
+// once Serve or ListenAndServe has been called.  BoundAddr is useful for
+// discovering the port assigned by the operating system when s.Addr
+// specifies port 0.  If the server is not yet listening, BoundAddr returns
+// nil.
+func (s *Server) BoundAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.boundAddr
 }
 
 // ListenAndServe listens for UDP connections on the specified address, using
@@ -30,7 +413,7 @@ func ListenAndServe(addr string, handler Handler) error {
 // to handle serving TFTP traffic once ListenAndServe opens a UDP packet
 // connection.
 func (s *Server) ListenAndServe() error {
-	conn, err := net.ListenPacket("udp", s.Addr)
+	conn, err := s.listenPacket()
 	if err != nil {
 		return err
 	}
@@ -39,24 +422,118 @@ func (s *Server) ListenAndServe() error {
 	return s.Serve(conn)
 }
 
+// listenPacket binds the UDP socket on which s receives requests, applying
+// the FreeBind option if it is set.
+func (s *Server) listenPacket() (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if s.FreeBind {
+		lc.Control = freeBindControl
+	}
+
+	return lc.ListenPacket(context.Background(), "udp", s.Addr)
+}
+
 // Serve configures and accepts incoming connections on PacketConn p, creating a
 // new goroutine for each.
 //
 // The service goroutine reads requests, generate the appropriate Request and
 // ResponseWriter values, then calls s.Handler to handle the request.
+//
+// Once Shutdown is called, Serve returns ErrServerClosed.
 func (s *Server) Serve(p net.PacketConn) error {
+	if !s.trackListener(p) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(p)
+
+	s.mu.Lock()
+	s.boundAddr = p.LocalAddr()
+	s.mu.Unlock()
+
+	// Bind transfer sockets in advance on the server's address, and close
+	// them once the server stops
+	if pool := s.socketPool(); pool != nil {
+		if host, _, err := net.SplitHostPort(s.Addr); err == nil {
+			pool.warm(host)
+		}
+		defer pool.close()
+	}
+
+	// Close idle transfer sockets retained for reuse once the server stops
+	defer s.closeSockets()
+
 	// RRQ and WRQ packets are received here before creating a goroutine to
 	// handle data transfer.  There appears to be no maximum limit for the
-	// size of one of these packets, so we will go with the Ethernet MTU,
-	// since TFTP packets must fit inside one, unfragmented IP packet.
-	buf := make([]byte, 1500)
+	// size of one of these packets, so by default we will go with the
+	// Ethernet MTU, since TFTP packets must fit inside one, unfragmented IP
+	// packet.  One extra byte is used to detect requests which are too large
+	// for the buffer, rather than handling them truncated.
+	size := s.requestBufferSize()
+	buf := make([]byte, size+1)
+	read := requestReader(p)
 	for {
-		n, addr, err := p.ReadFrom(buf)
+		n, addr, info, err := read(buf)
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
 			return err
 		}
+		if n > size {
+			s.reportError(fmt.Errorf("tftp: request from %s exceeds %d bytes: %w", addr, size, errRequestTooLarge))
+			continue
+		}
+
+		s.goServe(s.newConn(addr, info, n, buf).serve)
+	}
+}
+
+const (
+	// defaultRequestBufferSize and minRequestBufferSize are the default and
+	// smallest sizes of the buffer a Server uses to receive requests.
+	defaultRequestBufferSize = 1500
+	minRequestBufferSize     = 512
+)
+
+// errRequestTooLarge is returned when a request packet is larger than a
+// server's RequestBufferSize.
+var errRequestTooLarge = errors.New("request too large")
 
-		go s.newConn(addr, n, buf).serve()
+// requestBufferSize returns the size of the buffer used to receive request
+// packets.
+func (s *Server) requestBufferSize() int {
+	switch n := s.RequestBufferSize; {
+	case n <= 0:
+		return defaultRequestBufferSize
+	case n < minRequestBufferSize:
+		return minRequestBufferSize
+	default:
+		return n
+	}
+}
+
+// readFunc reads a single request packet into b, returning the number of bytes
+// read, the client's address, and if known, where the packet was received.
+type readFunc func(b []byte) (int, net.Addr, packetInfo, error)
+
+// packetInfo describes where a request packet was received.
+type packetInfo struct {
+	// The local IP address on which the packet was received, or nil if
+	// unknown
+	ip net.IP
+
+	// The index of the interface on which the packet was received, or 0
+	// if unknown
+	ifIndex int
+}
+
+// readFrom returns a readFunc which reads from p, without reporting where
+// each packet was received.
+func readFrom(p net.PacketConn) readFunc {
+	return func(b []byte) (int, net.Addr, packetInfo, error) {
+		n, addr, err := p.ReadFrom(b)
+		return n, addr, packetInfo{}, err
 	}
 }
 
@@ -65,8 +542,14 @@ func (s *Server) Serve(p net.PacketConn) error {
 type conn struct {
 	conn       net.PacketConn
 	remoteAddr net.Addr
+	localIP    net.IP
+	ifIndex    int
 	server     *Server
 	buf        []byte
+
+	// stream, if set, is a stream transport which carries both the request
+	// and the transfer, instead of a new UDP socket
+	stream net.PacketConn
 }
 
 // newConn creates a new conn using information received in a single TFTP
@@ -75,9 +558,11 @@ type conn struct {
 //
 // BUG(mdlayher): consider using a sync.Pool with many buffers available to avoid
 // allocating a new one on each request.
-func (s *Server) newConn(addr net.Addr, n int, buf []byte) *conn {
+func (s *Server) newConn(addr net.Addr, info packetInfo, n int, buf []byte) *conn {
 	c := &conn{
 		remoteAddr: addr,
+		localIP:    info.ip,
+		ifIndex:    info.ifIndex,
 		server:     s,
 		buf:        make([]byte, n),
 	}
@@ -89,25 +574,239 @@ func (s *Server) newConn(addr net.Addr, n int, buf []byte) *conn {
 // serve handles serving an individual TFTP request, and is invoked in a
 // goroutine.
 func (c *conn) serve() {
+	if !c.server.allowed(c.remoteAddr) {
+		c.server.reportError(fmt.Errorf("tftp: request from %s: %w", c.remoteAddr, errClientNotAllowed))
+		return
+	}
+
 	// Attempt to parse a Request from a raw packet, providing a nicer
 	// API for callers to implement their own TFTP request handlers
 	r, err := parseRequest(c.buf, c.remoteAddr)
 	if err != nil {
-		// BUG(mdlayher): send ERROR response on invalid request
-		if err == errInvalidRequestPacket {
+		// BUG(mdlayher): requests which are invalid for any reason other
+		// than their options are discarded without an ERROR response.
+		c.server.reportError(fmt.Errorf("tftp: invalid request from %s: %w", c.remoteAddr, err))
+
+		// If only the options were invalid, let the client know, so that
+		// it may retry without them
+		if r != nil {
+			c.writeError(r, ErrorCodeBadOptions, err.Error())
+		}
+		return
+	}
+
+	r.IfIndex = c.ifIndex
+
+	// Never start a competing transfer with a client which already has a
+	// transfer in progress.  The client's address remains reserved until
+	// this request is tracked as a transfer, or is rejected.
+	if !c.server.reserveClient(c) {
+		c.server.reportError(fmt.Errorf("tftp: request from %s: %w", c.remoteAddr, errDuplicateRequest))
+		if c.server.RejectDuplicateRequests {
+			c.writeError(r, ErrorCodeIllegalOperation, "transfer already in progress")
+		}
+		return
+	}
+	defer c.server.releaseClient(c)
+
+	// Reject requests with implausibly long filenames, which are most likely
+	// the result of an attack or a misbehaving client
+	maxName := c.server.MaxFilenameLength
+	if maxName <= 0 {
+		maxName = defaultMaxFilenameLength
+	}
+	if len(r.Filename) > maxName {
+		c.server.logf("tftp: request from %s: filename length %d exceeds maximum %d",
+			c.remoteAddr, len(r.Filename), maxName)
+		c.writeError(r, ErrorCodeAccessViolation, "filename too long")
+		return
+	}
+
+	// The connection's buffer is already a copy of the request packet, and
+	// is not used for anything else
+	if c.server.CaptureRawRequest {
+		r.Raw = c.buf
+	}
+
+	// Reject requests which contain an excessive number of options
+	max := c.server.MaxOptions
+	if max <= 0 {
+		max = defaultMaxOptions
+	}
+	if len(r.Options) > max {
+		r.Options = nil
+		c.writeError(r, ErrorCodeBadOptions, "too many options")
+		return
+	}
+
+	if c.server.TrimFilename {
+		r.Filename = strings.TrimRightFunc(r.Filename, unicode.IsSpace)
+	}
+
+	if rewrite := c.server.RewriteFilename; rewrite != nil {
+		r.Filename = rewrite(r.Filename)
+	}
+
+	// Requests with an empty filename are rejected, unless a handler is
+	// configured to serve them
+	h := c.server.Handler
+	if r.Filename == "" {
+		if c.server.EmptyFilenameHandler == nil {
+			c.writeError(r, ErrorCodeFileNotFound, "empty filename")
 			return
 		}
 
+		h = c.server.EmptyFilenameHandler
+	}
+
+	// Reject any filenames which do not pass validation
+	validate := c.server.ValidateFilename
+	if validate == nil {
+		validate = validateFilename
+	}
+	if err := validate(r.Filename); err != nil {
+		c.writeError(r, ErrorCodeAccessViolation, err.Error())
 		return
 	}
 
 	// Set up response by binding a new UDP socket to handle this request
-	w, err := newResponse(c.server.Addr, c.remoteAddr, r.Mode)
+	w, err := c.newResponse(r)
 	if err != nil {
 		return
 	}
 
+	// Answer liveness checks and version queries without involving the
+	// handler
+	if h := c.server.HealthFilename; h != "" && r.Opcode == OpcodeRead && r.Filename == h {
+		_ = w.WriteBlocks(healthPayload)
+		_ = w.Close()
+		return
+	}
+	if v := c.server.VersionFilename; v != "" && r.Opcode == OpcodeRead && r.Filename == v {
+		_ = w.WriteBlocks([]byte(c.server.VersionString))
+		_ = w.Close()
+		return
+	}
+
+	// Register the transfer before keepalives begin, so that it can be
+	// observed and aborted while the handler prepares content
+	defer c.server.track(r, w.bsw)()
+	c.server.releaseClient(c)
+
+	// Keep the client waiting while the handler prepares content
+	if d := c.server.KeepaliveInterval; d > 0 && r.Opcode == OpcodeRead && len(w.bsw.options) > 0 {
+		if err := w.bsw.keepalive(d); err != nil {
+			_ = w.Close()
+			return
+		}
+	}
+
+	// Recover from a panicking handler, so that it does not crash the entire
+	// server, and inform the client that the transfer failed
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		buf := make([]byte, 64<<10)
+		buf = buf[:runtime.Stack(buf, false)]
+		c.server.logf("tftp: panic serving %s: %v\n%s", c.remoteAddr, v, buf)
+
+		_ = w.WriteError(ErrorCodeUndefined, "internal server error")
+		_ = w.Close()
+
+		if ph := c.server.PanicHandler; ph != nil {
+			ph(r, v)
+		}
+	}()
+
 	// This will panic if Handler is nil.
 	// TODO(mdlayher): determine if a ServeMux type would be useful.
-	c.server.Handler.ServeTFTP(w, r)
+	h.ServeTFTP(w, r)
+}
+
+// logf logs a message using s.ErrorLog, or the log package's standard logger
+// if s.ErrorLog is nil.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+
+	log.Printf(format, v...)
+}
+
+// newResponse creates a response to request r, which uses the stream transport
+// the request arrived on if there is one, or a new UDP socket otherwise.
+func (c *conn) newResponse(r *Request) (*response, error) {
+	if c.stream != nil {
+		return newConnResponse(c.server, c.stream, c.remoteAddr, r)
+	}
+
+	return newResponse(c.server, c.remoteAddr, c.localIP, r)
+}
+
+// healthPayload is the content served in reply to a request for a server's
+// HealthFilename.
+var healthPayload = []byte("ok\n")
+
+// writeError sends an ERROR packet to the client which sent request r, using
+// a new UDP socket.
+func (c *conn) writeError(r *Request, code ErrorCode, msg string) {
+	w, err := c.newResponse(r)
+	if err != nil {
+		return
+	}
+
+	_ = w.WriteError(code, msg)
+	_ = w.Close()
+}
+
+// errClientNotAllowed is returned when a request is received from a client
+// whose IP address is not within a server's AllowedNets.
+var errClientNotAllowed = errors.New("client not allowed")
+
+// errDuplicateRequest is returned when a request is received from a client
+// address which already has a transfer in progress.
+var errDuplicateRequest = errors.New("transfer already in progress")
+
+// allowed reports whether a client at addr may make requests, according to
+// the server's AllowedNets.
+func (s *Server) allowed(addr net.Addr) bool {
+	if len(s.AllowedNets) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+
+	for _, n := range s.AllowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errInvalidFilename is returned when a filename contains control characters.
+var errInvalidFilename = errors.New("invalid filename")
+
+// validateFilename is the default filename validation function used by a
+// Server.  It rejects any filename which contains control characters, such
+// as NULL, carriage return, or line feed.
+func validateFilename(filename string) error {
+	for _, r := range filename {
+		if unicode.IsControl(r) {
+			return errInvalidFilename
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,1197 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerBoundAddr verifies that Server.BoundAddr reports the address
+// assigned by the operating system when listening on port 0.
+func TestServerBoundAddr(t *testing.T) {
+	s := &Server{
+		Addr:    "127.0.0.1:0",
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {}),
+	}
+
+	if addr := s.BoundAddr(); addr != nil {
+		t.Fatalf("unexpected bound address before listening: %v", addr)
+	}
+
+	p, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Serve(p)
+	}()
+
+	addr := waitBoundAddr(t, s)
+
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		t.Fatalf("unexpected bound address type: %T", addr)
+	}
+	if uaddr.Port == 0 {
+		t.Fatal("bound address must report a non-zero port")
+	}
+
+	_ = p.Close()
+	if err := <-errC; err == nil {
+		t.Fatal("expected error from Serve after closing listener")
+	}
+}
+
+// TestServerErrors verifies that a Server reports a malformed request on the
+// channel returned by Errors, and continues serving requests.
+func TestServerErrors(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+		}),
+	}
+	errC := s.Errors()
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Request with an invalid mode
+	if _, err := c.WriteTo([]byte("\x00\x01foo\x00bar\x00"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errC:
+		if !errors.Is(err, errInvalidRequestPacket) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// Server continues to serve requests
+	b := testExchange(t, addr, testRRQ("foo"))
+	if e, ok := parseErrorPacket(b).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeFileNotFound {
+		t.Fatalf("unexpected reply: %v", b)
+	}
+}
+
+// TestServerErrorsDropOldest verifies that a Server discards the oldest error
+// when the channel returned by Errors is full.
+func TestServerErrorsDropOldest(t *testing.T) {
+	s := &Server{}
+	errC := s.Errors()
+
+	for i := 0; i < errorsBuffer+1; i++ {
+		s.reportError(fmt.Errorf("%d", i))
+	}
+
+	if want, got := errorsBuffer, len(errC); want != got {
+		t.Fatalf("unexpected number of buffered errors: %v != %v", want, got)
+	}
+	if want, got := "1", (<-errC).Error(); want != got {
+		t.Fatalf("unexpected oldest error: %q != %q", want, got)
+	}
+}
+
+// TestServerRequestBufferSize verifies that a Server discards requests which
+// exceed its RequestBufferSize, and handles requests which fit within it.
+func TestServerRequestBufferSize(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+		}),
+		RequestBufferSize: 1024,
+		MaxFilenameLength: 1024,
+	}
+	errC := s.Errors()
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A request which is exactly one byte too large must not be handled,
+	// even though its first 1024 bytes are a valid request
+	large := testRRQ(strings.Repeat("a", 1024-len(testRRQ(""))))
+	large = append(large, "x\x00"...)
+	if _, err := c.WriteTo(large[:1025], addr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errC:
+		if !errors.Is(err, errRequestTooLarge) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// A request which fits exactly is handled
+	b := testExchange(t, addr, testRRQ(strings.Repeat("a", 1024-len(testRRQ("")))))
+	if e, ok := parseErrorPacket(b).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeFileNotFound {
+		t.Fatalf("unexpected reply: %v", b)
+	}
+}
+
+// TestServer_requestBufferSize verifies that a Server applies the default
+// and minimum sizes for its request buffer.
+func TestServer_requestBufferSize(t *testing.T) {
+	var tests = []struct {
+		size int
+		want int
+	}{
+		{size: 0, want: 1500},
+		{size: 100, want: 512},
+		{size: 9000, want: 9000},
+	}
+
+	for i, tt := range tests {
+		s := &Server{RequestBufferSize: tt.size}
+		if want, got := tt.want, s.requestBufferSize(); want != got {
+			t.Fatalf("[%02d] unexpected request buffer size: %v != %v",
+				i, want, got)
+		}
+	}
+}
+
+// TestServerLocalAddr verifies that ResponseWriter.LocalAddr reports the
+// address of the transfer socket, from which the client receives replies.
+func TestServerLocalAddr(t *testing.T) {
+	addrC := make(chan net.Addr, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			addrC <- w.LocalAddr()
+			_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+			_ = w.Close()
+		}),
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, raddr, err := c.ReadFrom(make([]byte, 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, ok := (<-addrC).(*net.UDPAddr)
+	if !ok || local.Port == 0 {
+		t.Fatalf("unexpected local address: %v", local)
+	}
+	if want, got := raddr.String(), local.String(); want != got {
+		t.Fatalf("unexpected local address: %v != %v", want, got)
+	}
+}
+
+// TestServerAllowedNets verifies that a Server only handles requests from
+// clients within its AllowedNets.
+func TestServerAllowedNets(t *testing.T) {
+	var tests = []struct {
+		description string
+		cidr        string
+		ok          bool
+	}{
+		{
+			description: "client in subnet, allowed",
+			cidr:        "127.0.0.0/8",
+			ok:          true,
+		},
+		{
+			description: "client outside subnet, rejected",
+			cidr:        "192.0.2.0/24",
+		},
+	}
+
+	for i, tt := range tests {
+		_, ipn, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+			}),
+			AllowedNets: []*net.IPNet{ipn},
+		}
+		errC := s.Errors()
+
+		addr, done := testServe(t, s)
+		if tt.ok {
+			b := testExchange(t, addr, testRRQ("foo"))
+			if e, ok := parseErrorPacket(b).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeFileNotFound {
+				t.Fatalf("[%02d] test %q, unexpected reply: %v", i, tt.description, b)
+			}
+
+			done()
+			continue
+		}
+
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errC:
+			if !errors.Is(err, errClientNotAllowed) {
+				t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, timed out waiting for error", i, tt.description)
+		}
+
+		// No reply is sent
+		if err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadFrom(make([]byte, 512)); !isTimeout(err) {
+			t.Fatalf("[%02d] test %q, expected timeout, but got: %v", i, tt.description, err)
+		}
+
+		_ = c.Close()
+		done()
+	}
+}
+
+// TestServerTrimFilename verifies that a Server removes trailing whitespace
+// from requested filenames only if TrimFilename is set.
+func TestServerTrimFilename(t *testing.T) {
+	var tests = []struct {
+		description string
+		trim        bool
+		found       bool
+	}{
+		{
+			description: "trimming off, not found",
+		},
+		{
+			description: "trimming on, found",
+			trim:        true,
+			found:       true,
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				if r.Filename != "foo" {
+					_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+					return
+				}
+
+				_ = ServeContent(w, r, strings.NewReader("hello"))
+			}),
+			TrimFilename: tt.trim,
+			DisableDally: true,
+		}
+
+		addr, done := testServe(t, s)
+		b := testExchange(t, addr, testRRQ("foo \r"))
+		done()
+
+		_, err := parseDATAPacket(b)
+		if want, got := tt.found, err == nil; want != got {
+			t.Fatalf("[%02d] test %q, unexpected reply: %v", i, tt.description, b)
+		}
+	}
+}
+
+// TestServerOnError verifies that a Server allows ERROR packets to be
+// customized or suppressed by its OnError hook.
+func TestServerOnError(t *testing.T) {
+	var tests = []struct {
+		description string
+		fn          func(r *Request, code ErrorCode, msg string) (ErrorCode, string, bool)
+		err         *ErrorPacket
+	}{
+		{
+			description: "file not found rewritten as undefined",
+			fn: func(r *Request, code ErrorCode, msg string) (ErrorCode, string, bool) {
+				if r.Filename != "foo" || code != ErrorCodeFileNotFound {
+					return code, msg, true
+				}
+
+				return ErrorCodeUndefined, "unavailable", true
+			},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeUndefined,
+				ErrorMsg:  "unavailable",
+			},
+		},
+		{
+			description: "suppressed",
+			fn: func(r *Request, code ErrorCode, msg string) (ErrorCode, string, bool) {
+				return code, msg, false
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+				_ = w.Close()
+			}),
+			OnError: tt.fn,
+		}
+
+		addr, done := testServe(t, s)
+
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 512)
+		n, _, err := c.ReadFrom(b)
+		_ = c.Close()
+		done()
+
+		if tt.err == nil {
+			if !isTimeout(err) {
+				t.Fatalf("[%02d] test %q, expected no reply, but got: %v",
+					i, tt.description, b[:n])
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := error(tt.err), parseErrorPacket(b[:n]); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// waitBoundAddr waits for s to begin listening, returning its bound address.
+func waitBoundAddr(t *testing.T, s *Server) net.Addr {
+	for i := 0; i < 100; i++ {
+		if addr := s.BoundAddr(); addr != nil {
+			return addr
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timed out waiting for server to listen")
+	return nil
+}
+
+// TestServerValidateFilename verifies that a Server rejects requests whose
+// filename fails validation, without invoking its Handler.
+func TestServerValidateFilename(t *testing.T) {
+	var tests = []struct {
+		description string
+		filename    string
+		validate    func(string) error
+		ok          bool
+	}{
+		{
+			description: "default validation, clean filename",
+			filename:    "pxelinux.0",
+			ok:          true,
+		},
+		{
+			description: "default validation, line feed in filename",
+			filename:    "foo\nbar",
+		},
+		{
+			description: "custom validation, filename rejected",
+			filename:    "pxelinux.0",
+			validate: func(string) error {
+				return errInvalidFilename
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		calledC := make(chan struct{}, 1)
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				calledC <- struct{}{}
+				_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+				_ = w.Close()
+			}),
+			ValidateFilename: tt.validate,
+		}
+
+		addr, done := testServe(t, s)
+		b := testExchange(t, addr, testRRQ(tt.filename))
+		done()
+
+		code := ErrorCodeAccessViolation
+		if tt.ok {
+			code = ErrorCodeFileNotFound
+			<-calledC
+		}
+
+		_, err := parseACKPacket(b)
+		e, ok := err.(*ErrorPacket)
+		if !ok {
+			t.Fatalf("[%02d] test %q, expected ERROR packet, but got: %v",
+				i, tt.description, b)
+		}
+
+		if want, got := code, e.ErrorCode; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error code: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServerCaptureRawRequest verifies that a Server stores a copy of each
+// request packet in a Request only when CaptureRawRequest is set.
+func TestServerCaptureRawRequest(t *testing.T) {
+	b := append(testRRQ("foo"), "BlkSize\x00512\x00"...)
+
+	for i, capture := range []bool{false, true} {
+		raw := make(chan []byte, 1)
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				raw <- r.Raw
+				_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+				_ = w.Close()
+			}),
+			CaptureRawRequest: capture,
+		}
+
+		addr, done := testServe(t, s)
+		_ = testExchange(t, addr, b)
+		done()
+
+		var want []byte
+		if capture {
+			want = b
+		}
+
+		if got := <-raw; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] unexpected raw request:\n- want: %v\n-  got: %v",
+				i, want, got)
+		}
+	}
+}
+
+// TestServerRequestIfIndex verifies that a Server reports the index of the
+// interface on which a request was received in the Request passed to its
+// Handler.
+func TestServerRequestIfIndex(t *testing.T) {
+	var got int
+	s := &Server{
+		Addr: "127.0.0.1:0",
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			got = r.IfIndex
+			_ = w.Close()
+		}),
+	}
+
+	b := testRRQ("foo")
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}
+	s.newConn(addr, packetInfo{ifIndex: 3}, len(b), b).serve()
+
+	if want := 3; want != got {
+		t.Fatalf("unexpected interface index: %v != %v", want, got)
+	}
+}
+
+// TestServerMaxOptions verifies that a Server rejects requests containing
+// more options than its MaxOptions limit.
+func TestServerMaxOptions(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			panic("handler should not be called")
+		}),
+		MaxOptions: 2,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b := append(testRRQ("foo"), "a\x001\x00b\x002\x00c\x003\x00"...)
+
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeBadOptions,
+		ErrorMsg:  "too many options",
+	}
+	if got := parseErrorPacket(testExchange(t, addr, b)); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected reply:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// TestServerMalformedOptions verifies that a Server rejects an otherwise
+// valid request whose options are malformed with ErrorCodeBadOptions.
+func TestServerMalformedOptions(t *testing.T) {
+	var tests = []struct {
+		description string
+		options     string
+		msg         string
+	}{
+		{
+			description: "odd number of option fields",
+			options:     "blksize\x001024\x00tsize\x00",
+			msg:         "malformed options",
+		},
+		{
+			description: "option not NULL terminated",
+			options:     "blksize\x001024",
+			msg:         "malformed options",
+		},
+		{
+			description: "duplicate option",
+			options:     "blksize\x001024\x00BLKSIZE\x00512\x00",
+			msg:         "duplicate option",
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				panic("handler should not be called")
+			}),
+		}
+
+		addr, done := testServe(t, s)
+
+		b := testExchange(t, addr, append(testRRQ("foo"), tt.options...))
+		done()
+
+		want := &ErrorPacket{
+			Opcode:    OpcodeError,
+			ErrorCode: ErrorCodeBadOptions,
+			ErrorMsg:  tt.msg,
+		}
+		if got := parseErrorPacket(b); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected reply:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServerMaxFilenameLength verifies that a Server rejects requests whose
+// filename exceeds its MaxFilenameLength limit.
+func TestServerMaxFilenameLength(t *testing.T) {
+	var tests = []struct {
+		description string
+		filename    string
+		b           []byte
+		err         error
+	}{
+		{
+			description: "normal filename",
+			filename:    "foo",
+			b:           []byte("foo"),
+		},
+		{
+			description: "1000 byte filename",
+			filename:    strings.Repeat("a", 1000),
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeAccessViolation,
+				ErrorMsg:  "filename too long",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		lw := make(chanWriter, 1)
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				defer w.Close()
+				_ = ServeContent(w, r, strings.NewReader(r.Filename))
+			}),
+			ErrorLog: log.New(lw, "", 0),
+		}
+
+		addr, done := testServe(t, s)
+
+		b, err := testGet(t, addr, tt.filename)
+		done()
+
+		if want, got := tt.err, err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.b, b; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+
+		// The rejection is logged before the ERROR packet is sent
+		var logged bool
+		select {
+		case l := <-lw:
+			logged = strings.Contains(string(l), "filename length")
+		default:
+		}
+		if want, got := tt.err != nil, logged; want != got {
+			t.Fatalf("[%02d] test %q, unexpected log output: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServerEmptyFilename verifies that a Server rejects requests with an
+// empty filename, unless its EmptyFilenameHandler is set.
+func TestServerEmptyFilename(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer w.Close()
+		_ = ServeContent(w, r, strings.NewReader("default"))
+	})
+
+	var tests = []struct {
+		description string
+		s           *Server
+		b           []byte
+		err         error
+	}{
+		{
+			description: "rejected",
+			s: &Server{
+				Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+					panic("handler should not be called")
+				}),
+			},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeFileNotFound,
+				ErrorMsg:  "empty filename",
+			},
+		},
+		{
+			description: "routed to EmptyFilenameHandler",
+			s: &Server{
+				Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+					panic("handler should not be called")
+				}),
+				EmptyFilenameHandler: handler,
+			},
+			b: []byte("default"),
+		},
+	}
+
+	for i, tt := range tests {
+		addr, done := testServe(t, tt.s)
+
+		b, err := testGet(t, addr, "")
+		done()
+
+		if want, got := tt.err, err; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.b, b; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content: %q != %q",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServerRewriteFilename verifies that a Server's RewriteFilename function
+// transforms the filename seen by its Handler.
+func TestServerRewriteFilename(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+			_ = ServeContent(w, r, strings.NewReader(r.Filename))
+		}),
+		RewriteFilename: func(filename string) string {
+			return strings.Replace(filename, `\`, "/", -1)
+		},
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b, err := testGet(t, addr, `\boot\file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "/boot/file", string(b); want != got {
+		t.Fatalf("unexpected filename: %q != %q", want, got)
+	}
+}
+
+// TestServerPanic verifies that a Server recovers from a panicking Handler,
+// sends an ERROR packet to the client, and continues serving requests.
+func TestServerPanic(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.Filename == "panic" {
+				panic("boom")
+			}
+
+			defer w.Close()
+			_ = ServeContent(w, r, strings.NewReader("ok"))
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+		PanicHandler: func(r *Request, v interface{}) {
+			panics <- v
+		},
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeUndefined,
+		ErrorMsg:  "internal server error",
+	}
+	if _, err := testGet(t, addr, "panic"); !reflect.DeepEqual(want, err) {
+		t.Fatalf("unexpected error:\n- want: %v\n-  got: %v", want, err)
+	}
+
+	select {
+	case v := <-panics:
+		if want, got := "boom", v; want != got {
+			t.Fatalf("unexpected panic value: %v != %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PanicHandler was not called")
+	}
+
+	// The server is still serving requests
+	b, err := testGet(t, addr, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "ok", string(b); want != got {
+		t.Fatalf("unexpected content: %q != %q", want, got)
+	}
+}
+
+// TestServerLazySocket verifies that a Server does not bind a transfer socket
+// for a request which its Handler ignores without responding.
+func TestServerLazySocket(t *testing.T) {
+	bound := make(chan bool, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.Close()
+			bound <- w.(*response).bsw.conn != nil
+		}),
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-bound:
+		if b {
+			t.Fatal("transfer socket was bound for ignored request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+// TestServerRejectWriteRequest verifies that a Handler can reject a write
+// request before any data is received, and that the client receives only an
+// ERROR packet in reply.
+func TestServerRejectWriteRequest(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.WriteError(ErrorCodeFileExists, "file exists")
+			_ = w.Close()
+		}),
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testWRQ("foo"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeFileExists,
+		ErrorMsg:  "file exists",
+	}
+	if got := parseErrorPacket(buf[:n]); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected reply:\n- want: %v\n-  got: %v", want, got)
+	}
+
+	// No further packets, such as an ACK, should be sent
+	if err := c.SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := c.ReadFrom(buf); !isTimeout(err) {
+		t.Fatalf("expected timeout, but got packet %v and error: %v", buf[:n], err)
+	}
+}
+
+// TestServerHealthFilename verifies that a Server answers requests for its
+// HealthFilename without invoking its Handler.
+func TestServerHealthFilename(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			panic("handler should not be called")
+		}),
+		HealthFilename: ".health",
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b, err := testGet(t, addr, ".health")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "ok\n", string(b); want != got {
+		t.Fatalf("unexpected health payload: %q != %q", want, got)
+	}
+}
+
+// TestServerVersionFilename verifies that a Server answers requests for its
+// VersionFilename with its VersionString, without invoking its Handler.
+func TestServerVersionFilename(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			panic("handler should not be called")
+		}),
+		VersionFilename: ".version",
+		VersionString:   "tftpd v1.2.3",
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b, err := testGet(t, addr, ".version")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "tftpd v1.2.3", string(b); want != got {
+		t.Fatalf("unexpected version payload: %q != %q", want, got)
+	}
+}
+
+// TestServerHandleErrors verifies that an error returned by a HandlerError
+// wrapped with HandleErrors is sent to the client.
+func TestServerHandleErrors(t *testing.T) {
+	errNotHere := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeFileNotFound,
+		ErrorMsg:  "not here",
+	}
+
+	s := &Server{
+		Handler: HandleErrors(HandlerErrorFunc(func(w ResponseWriter, r *Request) error {
+			return errNotHere
+		})),
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	_, err := testGet(t, addr, "foo")
+	if want, got := errNotHere, err; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected error:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// TestServerKeepalive verifies that a Server sends keepalives to a client
+// which negotiates options while a slow Handler prepares content, so that
+// the client does not time out.
+func TestServerKeepalive(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			time.Sleep(500 * time.Millisecond)
+			_, _ = w.Write([]byte("hello"))
+			_ = w.Flush()
+		}),
+		DisableDally:      true,
+		KeepaliveInterval: 50 * time.Millisecond,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(append(testRRQ("foo"), "blksize\x00512\x00"...), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client gives up if it does not receive a packet within a period
+	// much shorter than the time taken by the handler
+	buf := make([]byte, 1500)
+	for {
+		if err := c.SetDeadline(time.Now().Add(250 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("client timed out: %v", err)
+		}
+
+		if _, err := parseOACKPacket(buf[:n]); err == nil {
+			if _, err := c.WriteTo([]byte{0, 4, 0, 0}, raddr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		data, err := parseDATAPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := "hello", string(data.Data); want != got {
+			t.Fatalf("unexpected data: %q != %q", want, got)
+		}
+
+		if _, err := c.WriteTo([]byte{0, 4, 0, 1}, raddr); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+}
+
+// TestServerTransferTimeoutRejectsOptions verifies that a Server rejects a
+// request which negotiates a timeout exceeding its TransferTimeout, without
+// invoking its Handler.
+func TestServerTransferTimeoutRejectsOptions(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			panic("handler should not be called")
+		}),
+		TransferTimeout: 10 * time.Second,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	b := append(testRRQ("foo"), "timeout\x00255\x00"...)
+
+	want := &ErrorPacket{
+		Opcode:    OpcodeError,
+		ErrorCode: ErrorCodeBadOptions,
+		ErrorMsg:  "timeout exceeds transfer timeout",
+	}
+	if got := parseErrorPacket(testExchange(t, addr, b)); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected reply:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+// Test_validateFilename verifies that validateFilename rejects filenames
+// containing control characters.
+func Test_validateFilename(t *testing.T) {
+	var tests = []struct {
+		description string
+		filename    string
+		err         error
+	}{
+		{
+			description: "clean filename, OK",
+			filename:    "boot/pxelinux.0",
+		},
+		{
+			description: "line feed, invalid filename",
+			filename:    "foo\nbar",
+			err:         errInvalidFilename,
+		},
+		{
+			description: "NULL byte, invalid filename",
+			filename:    "foo\x00bar",
+			err:         errInvalidFilename,
+		},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.err, validateFilename(tt.filename); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// testServe starts s on a loopback address, returning the address it is
+// listening on and a function which stops it.
+func testServe(t *testing.T, s *Server) (net.Addr, func()) {
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = p.LocalAddr().String()
+
+	go func() {
+		_ = s.Serve(p)
+	}()
+
+	return p.LocalAddr(), func() {
+		_ = p.Close()
+	}
+}
+
+// testExchange sends a single packet to the server at addr, and returns the
+// first packet received in reply.
+func testExchange(t *testing.T, addr net.Addr, b []byte) []byte {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(b, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf[:n]
+}
+
+// testGet performs a read request for filename in octet mode against the
+// server at addr, and returns the content received.  If the server replies
+// with an ERROR packet, it is returned.
+func testGet(t *testing.T, addr net.Addr, filename string) ([]byte, error) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testRRQ(filename), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	var content []byte
+	buf := make([]byte, 65536)
+	for {
+		if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := parseDATAPacket(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, data.Data...)
+
+		ack := []byte{0, byte(opcodeACK), byte(data.Block >> 8), byte(data.Block)}
+		if _, err := c.WriteTo(ack, raddr); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data.Data) < DefaultBlockSize {
+			return content, nil
+		}
+	}
+}
+
+// testRRQ creates a read request packet for filename in octet mode.
+func testRRQ(filename string) []byte {
+	return testRequest(OpcodeRead, filename)
+}
+
+// testWRQ creates a write request packet for filename in octet mode.
+func testWRQ(filename string) []byte {
+	return testRequest(OpcodeWrite, filename)
+}
+
+// testRequest creates a request packet with the specified opcode for
+// filename in octet mode.
+func testRequest(op Opcode, filename string) []byte {
+	b := []byte{0, byte(op)}
+	b = append(b, filename...)
+	b = append(b, 0)
+	b = append(b, ModeOctet...)
+	return append(b, 0)
+}
@@ -0,0 +1,126 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ServeStream once Shutdown is
+// called.
+var ErrServerClosed = errors.New("tftp: server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all requests
+// have been served.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully shuts down the server.  Shutdown closes the listeners
+// passed to Serve and ServeStream, so that no new requests are accepted, and
+// then waits for the requests already received to be served.  Idle transfer
+// sockets retained for reuse are closed once Shutdown returns.
+//
+// If ctx is done before every request has been served, every transfer still
+// in progress is aborted and its transfer socket is closed immediately, even
+// if its handler is not exchanging packets with the client.  The handler's
+// next call to its ResponseWriter fails.  Shutdown then returns ctx.Err()
+// without waiting further.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	s.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+
+	for {
+		if s.activeRequests() == 0 {
+			s.closeSockets()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.abortAll()
+			s.closeSockets()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// abortAll aborts every transfer in progress, and closes its transfer
+// socket.
+func (s *Server) abortAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for t := range s.transfers {
+		t.w.shut()
+	}
+}
+
+// closeSockets closes any idle transfer sockets retained for reuse, and any
+// socket which is later returned to be reused.
+func (s *Server) closeSockets() {
+	s.mu.Lock()
+	cache := s.sockets
+	s.mu.Unlock()
+
+	if cache != nil {
+		cache.close()
+	}
+}
+
+// goServe calls fn in a new goroutine, counting it as an active request until
+// it returns.
+func (s *Server) goServe(fn func()) {
+	atomic.AddInt32(&s.active, 1)
+	go func() {
+		defer atomic.AddInt32(&s.active, -1)
+		fn()
+	}()
+}
+
+// trackListener registers l to be closed by Shutdown.  If Shutdown was
+// already called, l is not registered, and trackListener returns false.
+func (s *Server) trackListener(l io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[io.Closer]struct{})
+	}
+	s.listeners[l] = struct{}{}
+
+	return true
+}
+
+// untrackListener removes l from the listeners closed by Shutdown.
+func (s *Server) untrackListener(l io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, l)
+}
+
+// shuttingDown reports whether or not Shutdown has been called.
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// activeRequests returns the number of requests being served.
+func (s *Server) activeRequests() int {
+	return int(atomic.LoadInt32(&s.active))
+}
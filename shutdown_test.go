@@ -0,0 +1,219 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServerShutdown verifies that Shutdown waits for a transfer in progress
+// to complete, and that Serve then returns ErrServerClosed.
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			<-release
+			_ = ServeContent(w, r, bytes.NewReader([]byte("hello")))
+			_ = w.Close()
+		}),
+		DisableDally: true,
+	}
+
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = p.LocalAddr().String()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(p)
+	}()
+
+	got := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = (&Client{}).Get(p.LocalAddr().String(), "foo", &buf)
+		got <- buf.Bytes()
+	}()
+
+	// Wait for the request to be received before shutting down
+	for i := 0; s.activeRequests() == 0; i++ {
+		if i == 500 {
+			t.Fatal("request was not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-served:
+		if want, got := ErrServerClosed, err; want != got {
+			t.Fatalf("unexpected Serve error: %v != %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("unexpected Shutdown error: %v", err)
+	}
+	if want, got := []byte("hello"), <-got; !bytes.Equal(want, got) {
+		t.Fatalf("unexpected content: %q != %q", want, got)
+	}
+
+	if want, got := ErrServerClosed, s.Serve(p); want != got {
+		t.Fatalf("unexpected Serve error after Shutdown: %v != %v", want, got)
+	}
+}
+
+// TestServerShutdownDeadline verifies that Shutdown aborts a transfer which
+// does not complete before the context expires, and informs the client.
+func TestServerShutdownDeadline(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = ServeContent(w, r, bytes.NewReader(make([]byte, 10*DefaultBlockSize)))
+			_ = w.Close()
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Request a file, but never acknowledge the first block
+	if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if _, _, err := c.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if want, got := context.DeadlineExceeded, s.Shutdown(ctx); want != got {
+		t.Fatalf("unexpected Shutdown error: %v != %v", want, got)
+	}
+	if d := time.Since(start); d > 1*time.Second {
+		t.Fatalf("Shutdown did not return promptly: %v", d)
+	}
+
+	// The block may be retransmitted before the transfer is aborted
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := parseDATAPacket(buf[:n]); err != nil {
+			if p, ok := err.(*ErrorPacket); !ok || p.ErrorMsg != "transfer aborted" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			break
+		}
+	}
+
+	for i := 0; len(s.ActiveTransfers()) > 0; i++ {
+		if i == 500 {
+			t.Fatal("aborted transfer did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestServerShutdownDeadlineBlockedHandler verifies that Shutdown closes the
+// socket of a transfer whose handler is not exchanging packets with the
+// client when the context expires.
+func TestServerShutdownDeadlineBlockedHandler(t *testing.T) {
+	release := make(chan struct{})
+	errC := make(chan error, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			<-release
+			errC <- ServeContent(w, r, bytes.NewReader([]byte("hello")))
+		}),
+		DisableDally:      true,
+		KeepaliveInterval: 50 * time.Millisecond,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Negotiate an option so that keepalives are sent while the handler
+	// is blocked
+	if _, err := c.WriteTo(append(testRRQ("foo"), "blksize\x00512\x00"...), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if _, _, err := c.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if want, got := context.DeadlineExceeded, s.Shutdown(ctx); want != got {
+		t.Fatalf("unexpected Shutdown error: %v != %v", want, got)
+	}
+
+	// Keepalives may be received before the transfer is aborted, but none
+	// are sent once the socket is closed
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := parseOACKPacket(buf[:n]); err != nil {
+			if p, ok := parseErrorPacket(buf[:n]).(*ErrorPacket); !ok || p.ErrorMsg != "transfer aborted" {
+				t.Fatalf("unexpected packet: %v", buf[:n])
+			}
+			break
+		}
+	}
+
+	if err := c.SetDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := c.ReadFrom(buf); err == nil {
+		t.Fatalf("unexpected packet after abort: %v", buf[:n])
+	}
+
+	close(release)
+	if err := <-errC; err == nil {
+		t.Fatal("expected an error from aborted transfer")
+	}
+}
@@ -0,0 +1,225 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// socketCache retains idle transfer sockets for a period of time, so that
+// they can be reused by later transfers with the same client.
+type socketCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*idleSocket
+	closed bool
+}
+
+// idleSocket is a transfer socket which is not in use, and a timer which
+// closes it once it has been idle for too long.
+type idleSocket struct {
+	conn  net.PacketConn
+	timer *time.Timer
+}
+
+// newSocketCache creates a socketCache which retains idle sockets for ttl.
+func newSocketCache(ttl time.Duration) *socketCache {
+	return &socketCache{
+		ttl:  ttl,
+		idle: make(map[string][]*idleSocket),
+	}
+}
+
+// get retrieves an idle socket for the specified key, or returns nil if none
+// are available.
+//
+// Packets may arrive on a socket while it is idle, such as retransmissions
+// from the client's previous transfer.  Because a client may reuse its
+// transfer ID (port) for a later transfer, these packets are discarded
+// before the socket is reused, and a socket which cannot be drained is
+// closed instead.
+func (c *socketCache) get(key string) net.PacketConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	for len(c.idle[key]) > 0 {
+		ss := c.idle[key]
+		s := ss[len(ss)-1]
+		c.idle[key] = ss[:len(ss)-1]
+
+		// If the timer already fired, the socket is being closed
+		if !s.timer.Stop() {
+			continue
+		}
+
+		if err := drain(s.conn); err != nil {
+			_ = s.conn.Close()
+			continue
+		}
+
+		return s.conn
+	}
+
+	delete(c.idle, key)
+	return nil
+}
+
+// put stores an idle socket for the specified key, closing it if it is not
+// retrieved by get within the cache's TTL, or if the cache is closed.
+func (c *socketCache) put(key string, conn net.PacketConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		_ = conn.Close()
+		return
+	}
+
+	s := &idleSocket{conn: conn}
+	s.timer = time.AfterFunc(c.ttl, func() {
+		c.remove(key, s)
+		_ = conn.Close()
+	})
+
+	c.idle[key] = append(c.idle[key], s)
+}
+
+// remove removes an idle socket from the cache.
+func (c *socketCache) remove(key string, s *idleSocket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ss := c.idle[key]
+	for i := range ss {
+		if ss[i] == s {
+			c.idle[key] = append(ss[:i], ss[i+1:]...)
+			break
+		}
+	}
+
+	if len(c.idle[key]) == 0 {
+		delete(c.idle, key)
+	}
+}
+
+// close closes all idle sockets in the cache, and closes any socket which is
+// later returned to the cache.
+func (c *socketCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for key, ss := range c.idle {
+		for _, s := range ss {
+			// If the timer already fired, the socket is being closed
+			if s.timer.Stop() {
+				_ = s.conn.Close()
+			}
+		}
+		delete(c.idle, key)
+	}
+}
+
+// cachedConn is a net.PacketConn which returns itself to a socketCache when
+// closed, instead of closing the underlying socket.
+type cachedConn struct {
+	net.PacketConn
+	cache *socketCache
+	key   string
+}
+
+// Close returns the underlying socket to the socketCache.
+func (c *cachedConn) Close() error {
+	c.cache.put(c.key, c.PacketConn)
+	return nil
+}
+
+// discard implements discarder.
+func (c *cachedConn) discard() error {
+	return discardConn(c.PacketConn)
+}
+
+// SyscallConn implements syscall.Conn using the underlying socket, so that
+// replies from a client can be read without blocking during a transfer.
+func (c *cachedConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return nil, errDrainUnsupported
+	}
+
+	return sc.SyscallConn()
+}
+
+// discarder is implemented by sockets which are reused by later transfers
+// when closed.  discard closes the underlying socket instead, so that it is
+// never reused.
+type discarder interface {
+	discard() error
+}
+
+// discardConn closes c without allowing it to be reused by another transfer,
+// such as when a transfer is canceled and packets from the client may still
+// be in flight.
+func discardConn(c net.PacketConn) error {
+	if d, ok := c.(discarder); ok {
+		return d.discard()
+	}
+
+	return c.Close()
+}
+
+// listenTransfer binds a UDP socket on host, for a transfer with the client
+// at remoteAddr.  If s.SocketReuseTTL is set, an idle socket previously bound
+// on host for a transfer with the same client IP address is reused if
+// possible.
+func (s *Server) listenTransfer(host string, remoteAddr net.Addr) (net.PacketConn, error) {
+	if s.SocketReuseTTL <= 0 {
+		return s.bindTransfer(host)
+	}
+
+	cache := s.socketCache()
+
+	ip := remoteAddr.String()
+	if ua, ok := remoteAddr.(*net.UDPAddr); ok {
+		ip = ua.IP.String()
+	}
+	key := net.JoinHostPort(host, ip)
+
+	conn := cache.get(key)
+	if conn == nil {
+		var err error
+		conn, err = s.bindTransfer(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &cachedConn{
+		PacketConn: conn,
+		cache:      cache,
+		key:        key,
+	}, nil
+}
+
+// socketCache returns the server's cache of idle transfer sockets, creating
+// it if necessary, or nil if s.SocketReuseTTL is not set.
+func (s *Server) socketCache() *socketCache {
+	if s.SocketReuseTTL <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sockets == nil {
+		s.sockets = newSocketCache(s.SocketReuseTTL)
+	}
+
+	return s.sockets
+}
@@ -0,0 +1,310 @@
+package tftp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerSocketReuse verifies that a Server reuses idle transfer sockets
+// for later transfers with the same client, if SocketReuseTTL is set.
+func TestServerSocketReuse(t *testing.T) {
+	s := &Server{
+		Addr:           "127.0.0.1:0",
+		SocketReuseTTL: 1 * time.Minute,
+	}
+	r := &Request{Mode: ModeOctet}
+
+	w1 := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, r)
+	addr1 := w1.bsw.conn.LocalAddr().String()
+
+	// Send a stray packet to the socket from another transfer ID, which
+	// must not be received by the next transfer to use the socket
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo([]byte{0, 4, 0, 1}, w1.bsw.conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same client IP address, different port
+	w2 := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}, r)
+	defer w2.Close()
+
+	if want, got := addr1, w2.bsw.conn.LocalAddr().String(); want != got {
+		t.Fatalf("socket was not reused: %v != %v", want, got)
+	}
+
+	if err := w2.bsw.start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.bsw.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.bsw.read(); !isTimeout(err) {
+		t.Fatalf("expected timeout reading stray packet, but got: %v", err)
+	}
+
+	// The stray packet was discarded before the socket was reused, so its
+	// sender receives no reply
+	if err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadFrom(make([]byte, 32)); !isTimeout(err) {
+		t.Fatalf("expected timeout waiting for reply to stray packet, but got: %v", err)
+	}
+
+	// Different client IP address must not reuse the socket
+	w3 := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}, r)
+	defer w3.Close()
+
+	if addr := w3.bsw.conn.LocalAddr().String(); addr == addr1 {
+		t.Fatalf("socket in use was reused for another client: %v", addr)
+	}
+}
+
+// TestServerSocketReuseExpired verifies that idle transfer sockets are
+// closed once SocketReuseTTL elapses.
+func TestServerSocketReuseExpired(t *testing.T) {
+	s := &Server{
+		Addr:           "127.0.0.1:0",
+		SocketReuseTTL: 10 * time.Millisecond,
+	}
+
+	w := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, &Request{Mode: ModeOctet})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if conn := s.sockets.get(net.JoinHostPort("127.0.0.1", "127.0.0.1")); conn != nil {
+		t.Fatalf("expired socket was not closed: %v", conn.LocalAddr())
+	}
+}
+
+// TestServerSocketReuseShutdown verifies that idle transfer sockets are
+// closed once Shutdown completes, and that sockets returned afterward are
+// closed rather than retained.
+func TestServerSocketReuseShutdown(t *testing.T) {
+	s := &Server{
+		Addr:           "127.0.0.1:0",
+		SocketReuseTTL: 1 * time.Minute,
+	}
+	r := &Request{Mode: ModeOctet}
+
+	w1 := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, r)
+	w2 := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}, r)
+	conn1 := w1.bsw.conn.(*cachedConn).PacketConn
+	conn2 := w2.bsw.conn.(*cachedConn).PacketConn
+
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transfer which outlives Shutdown does not return its socket
+	if err := w2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []net.PacketConn{conn1, conn2} {
+		if err := c.SetReadDeadline(time.Now()); err == nil {
+			t.Fatalf("[%02d] socket was not closed: %v", i, c.LocalAddr())
+		}
+	}
+}
+
+// TestServerSocketReuseServeReturns verifies that idle transfer sockets are
+// closed once Serve returns.
+func TestServerSocketReuseServeReturns(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = ServeContent(w, r, strings.NewReader("hello"))
+			_ = w.Close()
+		}),
+		DisableDally:   true,
+		SocketReuseTTL: 1 * time.Minute,
+	}
+
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = p.LocalAddr().String()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = s.Serve(p)
+	}()
+
+	if _, err := (&Client{}).Get(p.LocalAddr().String(), "foo", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the transfer socket to be returned to the cache
+	var idle []*idleSocket
+	for i := 0; len(idle) == 0; i++ {
+		if i == 100 {
+			t.Fatal("transfer socket was not retained")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		cache := s.socketCache()
+		cache.mu.Lock()
+		for _, ss := range cache.idle {
+			idle = append(idle, ss...)
+		}
+		cache.mu.Unlock()
+	}
+
+	_ = p.Close()
+	<-served
+
+	if err := idle[0].conn.SetReadDeadline(time.Now()); err == nil {
+		t.Fatalf("socket was not closed: %v", idle[0].conn.LocalAddr())
+	}
+}
+
+// TestServerSocketReuseCancel verifies that the socket of a canceled transfer
+// is closed, rather than being reused by a later transfer.
+func TestServerSocketReuseCancel(t *testing.T) {
+	s := &Server{
+		Addr:           "127.0.0.1:0",
+		SocketReuseTTL: 1 * time.Minute,
+		PrewarmSockets: 1,
+	}
+	r := &Request{Mode: ModeOctet}
+
+	w := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, r)
+	addr := w.bsw.conn.LocalAddr().String()
+
+	if err := w.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn := s.sockets.get(net.JoinHostPort("127.0.0.1", "127.0.0.1")); conn != nil {
+		t.Fatalf("canceled socket was cached for reuse: %v", conn.LocalAddr())
+	}
+
+	s.pool.mu.Lock()
+	idle := append([]net.PacketConn(nil), s.pool.idle["127.0.0.1"]...)
+	s.pool.mu.Unlock()
+	for _, c := range idle {
+		if c.LocalAddr().String() == addr {
+			t.Fatalf("canceled socket was returned to the pool: %v", addr)
+		}
+	}
+
+	// The socket is closed, so its port may be bound again
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("canceled socket was not closed: %v", err)
+	}
+	_ = c.Close()
+}
+
+// Test_socketCacheDrain verifies that packets which arrive on an idle socket
+// are discarded before the socket is reused, so that a stale ACK from a
+// client's previous transfer is not received by its next transfer.
+func Test_socketCacheDrain(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cache := newSocketCache(1 * time.Minute)
+	cache.put("key", conn)
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Queue stale ACKs from the client's transfer ID while the socket is idle
+	for i := 0; i < 2; i++ {
+		if _, err := c.WriteTo([]byte{0, 4, 0, 1}, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	got := cache.get("key")
+	if got != conn {
+		t.Fatalf("idle socket was not reused: %v", got)
+	}
+
+	if err := got.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := got.ReadFrom(make([]byte, 32)); !isTimeout(err) {
+		t.Fatalf("expected timeout reading stale packet, but got: %v", err)
+	}
+}
+
+// BenchmarkNewResponse measures the cost of setting up a transfer socket,
+// with and without socket reuse.
+func BenchmarkNewResponse(b *testing.B) {
+	var tests = []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{name: "no reuse"},
+		{name: "reuse", ttl: 1 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			s := &Server{
+				Addr:           "127.0.0.1:0",
+				SocketReuseTTL: tt.ttl,
+			}
+			addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+			r := &Request{Mode: ModeOctet}
+
+			for i := 0; i < b.N; i++ {
+				w, err := newResponse(s, addr, nil, r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := w.bsw.bind(); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// testBoundResponse creates a response for a client at addr, and binds its
+// transfer socket.
+func testBoundResponse(t *testing.T, s *Server, addr net.Addr, r *Request) *response {
+	w, err := newResponse(s, addr, nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.bsw.bind(); err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
@@ -0,0 +1,209 @@
+package tftp
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// socketPool retains transfer sockets which are bound in advance, so that a
+// socket is ready as soon as a request arrives.
+type socketPool struct {
+	size int
+
+	mu      sync.Mutex
+	idle    map[string][]net.PacketConn
+	filling map[string]bool
+	closed  bool
+}
+
+// newSocketPool creates a socketPool which retains up to size sockets for
+// each local host address.
+func newSocketPool(size int) *socketPool {
+	return &socketPool{
+		size:    size,
+		idle:    make(map[string][]net.PacketConn),
+		filling: make(map[string]bool),
+	}
+}
+
+// get retrieves a socket bound on host, or returns nil if none are
+// available.  Sockets are bound in the background to replace the socket
+// taken from the pool.
+//
+// Packets may arrive on a socket while it is in the pool, such as
+// retransmissions from the client of a previous transfer which used it.
+// These packets are discarded before the socket is used, and a socket which
+// cannot be drained is closed instead.
+func (p *socketPool) get(host string) net.PacketConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.startFill(host)
+
+	for len(p.idle[host]) > 0 {
+		cs := p.idle[host]
+		c := cs[len(cs)-1]
+		p.idle[host] = cs[:len(cs)-1]
+
+		if err := drain(c); err != nil {
+			_ = c.Close()
+			continue
+		}
+
+		return c
+	}
+
+	return nil
+}
+
+// warm begins binding sockets on host in the background, so that they are
+// ready before the first request arrives.
+func (p *socketPool) warm(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.startFill(host)
+	}
+}
+
+// put returns a socket bound on host to the pool, closing it if the pool is
+// full.
+func (p *socketPool) put(host string, c net.PacketConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[host]) >= p.size {
+		_ = c.Close()
+		return
+	}
+
+	p.idle[host] = append(p.idle[host], c)
+}
+
+// startFill binds sockets on host in the background until the pool for host
+// is full, unless this is already in progress.  p.mu must be held.
+func (p *socketPool) startFill(host string) {
+	if p.filling[host] || len(p.idle[host]) >= p.size {
+		return
+	}
+	p.filling[host] = true
+
+	go p.fill(host)
+}
+
+// fill binds sockets on host until the pool for host is full.
+func (p *socketPool) fill(host string) {
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.filling, host)
+	}()
+
+	for {
+		p.mu.Lock()
+		done := p.closed || len(p.idle[host]) >= p.size
+		p.mu.Unlock()
+		if done {
+			return
+		}
+
+		c, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return
+		}
+
+		p.put(host, c)
+	}
+}
+
+// close closes all sockets in the pool, and closes any socket which is
+// later returned to the pool.
+func (p *socketPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for host, cs := range p.idle {
+		for _, c := range cs {
+			_ = c.Close()
+		}
+		delete(p.idle, host)
+	}
+}
+
+// pooledConn is a net.PacketConn which returns itself to a socketPool when
+// closed, instead of closing the underlying socket.
+type pooledConn struct {
+	net.PacketConn
+	pool *socketPool
+	host string
+}
+
+// Close returns the underlying socket to the socketPool.
+func (c *pooledConn) Close() error {
+	c.pool.put(c.host, c.PacketConn)
+	return nil
+}
+
+// discard implements discarder.
+func (c *pooledConn) discard() error {
+	return c.PacketConn.Close()
+}
+
+// SyscallConn implements syscall.Conn using the underlying socket, so that a
+// pooled socket can be drained before it is reused.
+func (c *pooledConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return nil, errDrainUnsupported
+	}
+
+	return sc.SyscallConn()
+}
+
+// bindTransfer binds a new UDP socket on host for a transfer, taking one from
+// the server's pool of sockets bound in advance if s.PrewarmSockets is set.
+func (s *Server) bindTransfer(host string) (net.PacketConn, error) {
+	pool := s.socketPool()
+	if pool == nil {
+		return net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	}
+
+	c := pool.get(host)
+	if c == nil {
+		var err error
+		c, err = net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &pooledConn{
+		PacketConn: c,
+		pool:       pool,
+		host:       host,
+	}, nil
+}
+
+// socketPool returns the server's pool of sockets bound in advance, creating
+// it if needed, or nil if s.PrewarmSockets is not set.
+func (s *Server) socketPool() *socketPool {
+	if s.PrewarmSockets <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pool == nil {
+		s.pool = newSocketPool(s.PrewarmSockets)
+	}
+
+	return s.pool
+}
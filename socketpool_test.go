@@ -0,0 +1,172 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServerPrewarmSockets verifies that a Server binds transfer sockets in
+// advance if PrewarmSockets is set, uses them for transfers, and returns them
+// to the pool once each transfer completes.
+func TestServerPrewarmSockets(t *testing.T) {
+	s := &Server{
+		Addr:           "127.0.0.1:0",
+		PrewarmSockets: 2,
+	}
+	pool := s.socketPool()
+	pool.warm("127.0.0.1")
+
+	// Wait for the pool to fill
+	var idle []net.PacketConn
+	for i := 0; i < 100; i++ {
+		pool.mu.Lock()
+		idle = append([]net.PacketConn(nil), pool.idle["127.0.0.1"]...)
+		pool.mu.Unlock()
+
+		if len(idle) == 2 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, got := 2, len(idle); want != got {
+		t.Fatalf("unexpected number of idle sockets: %v != %v", want, got)
+	}
+
+	w := testBoundResponse(t, s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}, &Request{Mode: ModeOctet})
+	addr := w.bsw.conn.LocalAddr().String()
+
+	var found bool
+	for _, c := range idle {
+		if c.LocalAddr().String() == addr {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("transfer did not use a prewarmed socket: %v", addr)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The socket is returned to the pool, unless the pool was refilled
+	// while the transfer was in progress
+	pool.mu.Lock()
+	n := len(pool.idle["127.0.0.1"])
+	pool.mu.Unlock()
+	if want, got := 2, n; want != got {
+		t.Fatalf("unexpected number of idle sockets after close: %v != %v", want, got)
+	}
+
+	pool.close()
+	if c := pool.get("127.0.0.1"); c != nil {
+		t.Fatalf("closed pool returned a socket: %v", c.LocalAddr())
+	}
+}
+
+// Test_socketPoolDrain verifies that packets which arrive on a socket while
+// it is in the pool are discarded before the socket is used.
+func Test_socketPoolDrain(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pool := newSocketPool(1)
+	defer pool.close()
+	pool.put("127.0.0.1", conn)
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo([]byte{0, 4, 0, 1}, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	got := pool.get("127.0.0.1")
+	if got != conn {
+		t.Fatalf("pooled socket was not used: %v", got)
+	}
+
+	if err := got.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := got.ReadFrom(make([]byte, 32)); !isTimeout(err) {
+		t.Fatalf("expected timeout reading stale packet, but got: %v", err)
+	}
+}
+
+// BenchmarkServerFirstByte measures the time from sending a request to
+// receiving the first DATA packet, with and without prewarmed sockets.
+func BenchmarkServerFirstByte(b *testing.B) {
+	var tests = []struct {
+		name    string
+		prewarm int
+	}{
+		{name: "no pool"},
+		{name: "pool", prewarm: 8},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			s := &Server{
+				Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+					_ = w.(BlockWriter).WriteBlocks([]byte("hello"))
+					_ = w.Close()
+				}),
+				DisableDally:   true,
+				PrewarmSockets: tt.prewarm,
+			}
+
+			p, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Close()
+			s.Addr = p.LocalAddr().String()
+			go func() {
+				_ = s.Serve(p)
+			}()
+
+			c, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			rrq := testRRQ("foo")
+			buf := make([]byte, 512)
+
+			// Allow the pool to fill before measuring
+			time.Sleep(50 * time.Millisecond)
+			b.ResetTimer()
+
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := c.WriteTo(rrq, p.LocalAddr()); err != nil {
+					b.Fatal(err)
+				}
+
+				_, raddr, err := c.ReadFrom(buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += time.Since(start)
+
+				if _, err := c.WriteTo([]byte{0, 4, 0, 1}, raddr); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns/first-byte")
+		})
+	}
+}
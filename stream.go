@@ -0,0 +1,139 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// errFrameTooLarge is returned when a packet is too large to be framed for
+// a stream transport.
+var errFrameTooLarge = errors.New("tftp: packet too large for stream transport")
+
+// ServeStream accepts incoming connections on Listener l, creating a new
+// goroutine for each.  This is an experimental, non-standard transport for
+// tunneling TFTP through networks which do not permit UDP traffic.
+//
+// Each connection carries a single request and its transfer.  Every TFTP
+// packet sent in either direction is preceded by its length, as a 2 byte,
+// big endian integer.  Requests are handled by s.Handler in the same way as
+// requests received by Serve.  Once Shutdown is called, ServeStream returns
+// ErrServerClosed.
+func (s *Server) ServeStream(l net.Listener) error {
+	if !s.trackListener(l) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	s.mu.Lock()
+	s.boundAddr = l.Addr()
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		s.goServe(func() {
+			s.serveStream(c)
+		})
+	}
+}
+
+// serveStream reads a single request from stream connection c, and serves
+// it using c as the transport for the transfer.
+func (s *Server) serveStream(c net.Conn) {
+	p := newStreamPacketConn(c)
+	defer p.Close()
+
+	// Do not wait indefinitely for a client which never sends a request
+	if err := p.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+
+	// As with Serve, one extra byte is used to detect requests which are
+	// too large for the buffer
+	size := s.requestBufferSize()
+	buf := make([]byte, size+1)
+	n, addr, err := p.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	if n > size {
+		s.reportError(fmt.Errorf("tftp: request from %s exceeds %d bytes: %w", addr, size, errRequestTooLarge))
+		return
+	}
+
+	sc := s.newConn(addr, packetInfo{}, n, buf)
+	sc.stream = p
+	sc.serve()
+}
+
+// streamPacketConn is a net.PacketConn which sends and receives TFTP packets
+// over a stream connection, preceding each packet with its length.
+type streamPacketConn struct {
+	net.Conn
+
+	// Data read from the stream which does not yet contain a whole packet
+	buf []byte
+}
+
+// newStreamPacketConn creates a streamPacketConn which communicates using c.
+func newStreamPacketConn(c net.Conn) *streamPacketConn {
+	return &streamPacketConn{Conn: c}
+}
+
+// ReadFrom implements net.PacketConn, and reads a single packet from the
+// stream into b.  If a deadline expires before an entire packet is read, the
+// partial packet is retained, so that the stream can continue to be read.
+// If b is too small for the packet, the packet is truncated.
+func (c *streamPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	tmp := make([]byte, 1500)
+	for {
+		if len(c.buf) >= 2 {
+			size := 2 + int(binary.BigEndian.Uint16(c.buf[0:2]))
+			if len(c.buf) >= size {
+				n := copy(b, c.buf[2:size])
+				c.buf = c.buf[size:]
+				return n, c.RemoteAddr(), nil
+			}
+		}
+
+		n, err := c.Read(tmp)
+		c.buf = append(c.buf, tmp[:n]...)
+		if err != nil {
+			// A stream ending partway through a packet is unexpected
+			if err == io.EOF && len(c.buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return 0, nil, err
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn, and writes a single packet to the
+// stream.  addr is ignored, because a stream has only one peer.
+func (c *streamPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errFrameTooLarge
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(b)))
+	copy(frame[2:], b)
+
+	if _, err := c.Write(frame); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,199 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerServeStream verifies that a Server can serve a read request and
+// its transfer over a stream transport.
+func TestServerServeStream(t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, DefaultBlockSize+1)
+
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			if want, got := "foo", r.Filename; want != got {
+				t.Errorf("unexpected filename: %q != %q", want, got)
+			}
+
+			_ = w.(BlockWriter).WriteBlocks(content)
+		}),
+	}
+
+	l := newPipeListener()
+	defer l.Close()
+
+	go func() {
+		_ = s.ServeStream(l)
+	}()
+
+	c := newStreamPacketConn(l.Dial())
+	defer c.Close()
+
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.WriteTo(testRRQ("foo"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := parseDATAPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, data.Data...)
+
+		ack := []byte{0, byte(opcodeACK), byte(data.Block >> 8), byte(data.Block)}
+		if _, err := c.WriteTo(ack, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data.Data) < DefaultBlockSize {
+			break
+		}
+	}
+
+	if !bytes.Equal(content, got) {
+		t.Fatalf("unexpected content: %d bytes != %d bytes", len(content), len(got))
+	}
+}
+
+// TestServerServeStreamRequestBufferSize verifies that a Server receives
+// requests from a stream transport using its RequestBufferSize.
+func TestServerServeStreamRequestBufferSize(t *testing.T) {
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+			_ = w.Close()
+		}),
+		RequestBufferSize: 2048,
+		MaxFilenameLength: 2048,
+	}
+
+	l := newPipeListener()
+	defer l.Close()
+
+	go func() {
+		_ = s.ServeStream(l)
+	}()
+
+	c := newStreamPacketConn(l.Dial())
+	defer c.Close()
+
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request is larger than the default buffer size
+	b := testRRQ(strings.Repeat("a", 2048-len(testRRQ(""))))
+	if _, err := c.WriteTo(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok := parseErrorPacket(buf[:n]).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeFileNotFound {
+		t.Fatalf("unexpected reply: %v", buf[:n])
+	}
+}
+
+// Test_streamPacketConnPartialRead verifies that a streamPacketConn retains a
+// partial packet when a read times out, and returns the whole packet once the
+// remainder arrives.
+func Test_streamPacketConnPartialRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := newStreamPacketConn(server)
+	defer c.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{0, 4, 'a', 'b'})
+	}()
+
+	if err := c.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if _, _, err := c.ReadFrom(buf); !isTimeout(err) {
+		t.Fatalf("expected timeout, but got: %v", err)
+	}
+
+	go func() {
+		_, _ = client.Write([]byte{'c', 'd'})
+	}()
+
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []byte("abcd"), buf[:n]; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected packet: %q != %q", want, got)
+	}
+}
+
+// errPipeListenerClosed is returned when a pipeListener is closed.
+var errPipeListenerClosed = errors.New("pipe listener closed")
+
+// pipeListener is an in-memory net.Listener which accepts connections created
+// using net.Pipe.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial creates a connection which is accepted by the listener.
+func (l *pipeListener) Dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
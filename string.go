@@ -4,9 +4,9 @@ package tftp
 
 import "fmt"
 
-const _ErrorCode_name = "ErrorCodeUndefinedErrorCodeFileNotFoundErrorCodeAccessViolationErrorCodeDiskFullErrorCodeIllegalOperationErrorCodeUnknownTransferIDErrorCodeFileExistsErrorCodeNoSuchUser"
+const _ErrorCode_name = "ErrorCodeUndefinedErrorCodeFileNotFoundErrorCodeAccessViolationErrorCodeDiskFullErrorCodeIllegalOperationErrorCodeUnknownTransferIDErrorCodeFileExistsErrorCodeNoSuchUserErrorCodeBadOptions"
 
-var _ErrorCode_index = [...]uint8{0, 18, 39, 63, 80, 105, 131, 150, 169}
+var _ErrorCode_index = [...]uint8{0, 18, 39, 63, 80, 105, 131, 150, 169, 188}
 
 func (i ErrorCode) String() string {
 	if i >= ErrorCode(len(_ErrorCode_index)-1) {
@@ -15,9 +15,9 @@ func (i ErrorCode) String() string {
 	return _ErrorCode_name[_ErrorCode_index[i]:_ErrorCode_index[i+1]]
 }
 
-const _Opcode_name = "OpcodeReadOpcodeWriteopcodeDATAopcodeACKOpcodeError"
+const _Opcode_name = "OpcodeReadOpcodeWriteopcodeDATAopcodeACKOpcodeErroropcodeOACK"
 
-var _Opcode_index = [...]uint8{0, 10, 21, 31, 40, 51}
+var _Opcode_index = [...]uint8{0, 10, 21, 31, 40, 51, 61}
 
 func (i Opcode) String() string {
 	i -= 1
@@ -0,0 +1,234 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Tee returns a Handler which passes read requests to h, and writes a copy of
+// all content written by h to the io.WriteCloser returned by sink for each
+// request, such as a file used for auditing.  The copy contains the content
+// as written by h, before any netascii conversion.  The sink is closed once
+// h returns.
+//
+// Content sent using io.Copy, ServeContent or ServeBlocks is copied to the
+// sink without losing the optimizations of the default ResponseWriter.  If a
+// transfer is resumed at an offset, the copy begins at that offset.
+//
+// If sink returns nil, the request is passed to h without a copy being
+// made.  If a write to the sink fails, the error is returned to h, and the
+// transfer should be aborted.  Write requests are always passed to h
+// unmodified.
+func Tee(h Handler, sink func(r *Request) io.WriteCloser) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Opcode != OpcodeRead {
+			h.ServeTFTP(w, r)
+			return
+		}
+
+		s := sink(r)
+		if s == nil {
+			h.ServeTFTP(w, r)
+			return
+		}
+		defer s.Close()
+
+		h.ServeTFTP(&teeResponseWriter{
+			ResponseWriter: w,
+			sink:           s,
+		}, r)
+	})
+}
+
+// teeResponseWriter is a ResponseWriter which writes a copy of all content
+// sent to a client to sink.
+type teeResponseWriter struct {
+	ResponseWriter
+	sink io.Writer
+}
+
+// Write implements io.Writer, and writes the bytes accepted by the
+// underlying ResponseWriter to the sink.
+func (w *teeResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if _, serr := w.sink.Write(p[:n]); err == nil {
+		err = serr
+	}
+
+	return n, err
+}
+
+// WriteBlocks implements BlockWriter.  If the underlying ResponseWriter does
+// not implement BlockWriter, p is written and flushed instead.
+func (w *teeResponseWriter) WriteBlocks(p []byte) error {
+	bw, ok := w.ResponseWriter.(BlockWriter)
+	if !ok {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+
+		return w.Flush()
+	}
+
+	if err := bw.WriteBlocks(p); err != nil {
+		return err
+	}
+
+	_, err := w.sink.Write(p)
+	return err
+}
+
+// ReadFrom implements io.ReaderFrom, and copies each chunk read from src to
+// the sink before it is sent, so that the underlying ResponseWriter can still
+// send content from src without additional buffering.
+func (w *teeResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	tr := io.TeeReader(src, w.sink)
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(tr)
+	}
+
+	return io.Copy(writerOnly{w.ResponseWriter}, tr)
+}
+
+// serveBlocks implements blockServer, and copies each block read from src to
+// the sink before it is sent.
+func (w *teeResponseWriter) serveBlocks(src BlockSource) error {
+	return ServeBlocks(w.ResponseWriter, &teeBlockSource{
+		src:  src,
+		sink: w.sink,
+	})
+}
+
+// resume implements resumer.  If the underlying ResponseWriter cannot resume
+// a transfer, errInvalidOffset is returned.
+func (w *teeResponseWriter) resume(off int64) error {
+	rs, ok := w.ResponseWriter.(resumer)
+	if !ok {
+		return errInvalidOffset
+	}
+
+	return rs.resume(off)
+}
+
+// skip implements skipper.
+func (w *teeResponseWriter) skip(off int64) {
+	if sk, ok := w.ResponseWriter.(skipper); ok {
+		sk.skip(off)
+	}
+}
+
+// reportError implements errorReporter.
+func (w *teeResponseWriter) reportError(err error) {
+	reportHandlerError(w.ResponseWriter, err)
+}
+
+// teeBlockSource is a BlockSource which writes a copy of each block read from
+// src to sink.
+type teeBlockSource struct {
+	src  BlockSource
+	sink io.Writer
+}
+
+// ReadBlock implements BlockSource.
+func (s *teeBlockSource) ReadBlock(block uint16, buf []byte) (int, bool, error) {
+	n, last, err := s.src.ReadBlock(block, buf)
+	if err != nil {
+		return n, last, err
+	}
+
+	if _, err := s.sink.Write(buf[:n]); err != nil {
+		return 0, false, err
+	}
+
+	return n, last, nil
+}
+
+// MultiWriterHandler returns a Handler which accepts write requests, and
+// writes the content sent by a client to the io.WriteCloser returned by each
+// of sinks for the request, such as a local file and a remote replica.  Each
+// block of content is acknowledged only once it has been written to every
+// sink.  If a write to any sink fails, the transfer is aborted with an ERROR
+// packet chosen by ErrorFromOS.  All sinks are closed once the transfer ends.
+//
+// An error from a sink which does not originate from package os, such as an
+// error from a remote replica, is reported to the client using a generic
+// message, since it may describe the sink, and is reported in full by the
+// server's Errors channel.
+//
+// If a sink returns nil, no content is written to it.  Read requests are
+// rejected with ErrorCodeAccessViolation.
+func MultiWriterHandler(sinks ...func(r *Request) io.WriteCloser) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer w.Close()
+
+		if r.Opcode != OpcodeWrite {
+			_ = w.WriteError(ErrorCodeAccessViolation, "server is write-only")
+			return
+		}
+
+		ws := make([]io.Writer, 0, len(sinks))
+		for _, sink := range sinks {
+			s := sink(r)
+			if s == nil {
+				continue
+			}
+			defer s.Close()
+
+			ws = append(ws, s)
+		}
+
+		_, _ = ReceiveContent(w, r, &sinkWriter{
+			Writer: io.MultiWriter(ws...),
+			w:      w,
+			r:      r,
+		})
+	})
+}
+
+// errSinkUnavailable is sent to a client when a write to a sink used by
+// MultiWriterHandler fails with an error which does not originate from
+// package os.
+var errSinkUnavailable = &ErrorPacket{
+	Opcode:    OpcodeError,
+	ErrorCode: ErrorCodeUndefined,
+	ErrorMsg:  "storage unavailable",
+}
+
+// sinkWriter is an io.Writer which replaces any error returned by its
+// underlying sinks which does not originate from package os with
+// errSinkUnavailable, and reports the original error using w.
+type sinkWriter struct {
+	io.Writer
+	w ResponseWriter
+	r *Request
+}
+
+// Write implements io.Writer.
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	n, err := s.Writer.Write(p)
+	if err == nil || isOSError(err) {
+		return n, err
+	}
+
+	// The error may describe the sink, so it is only reported to the
+	// server
+	reportHandlerError(s.w, fmt.Errorf("tftp: sink error for %q: %w", s.r.Filename, err))
+	return n, errSinkUnavailable
+}
+
+// isOSError reports whether err originates from package os or from a system
+// call, and can be safely described to a client by ErrorFromOS.
+func isOSError(err error) bool {
+	var (
+		perr  *os.PathError
+		lerr  *os.LinkError
+		serr  *os.SyscallError
+		errno syscall.Errno
+	)
+
+	return errors.As(err, &perr) || errors.As(err, &lerr) ||
+		errors.As(err, &serr) || errors.As(err, &errno)
+}
@@ -0,0 +1,238 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestTee verifies that Tee writes a copy of the content sent to a client to
+// the sink for each request, and closes the sink once the handler returns.
+func TestTee(t *testing.T) {
+	content := bytes.Repeat([]byte("abc"), 1000)
+
+	var tests = []struct {
+		description string
+		h           Handler
+	}{
+		{
+			description: "ServeContent",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = ServeContent(w, r, bytes.NewReader(content))
+			}),
+		},
+		{
+			description: "WriteBlocks",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = w.(BlockWriter).WriteBlocks(content)
+			}),
+		},
+		{
+			description: "io.Copy",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				src := struct{ io.Reader }{bytes.NewReader(content)}
+				if _, err := io.Copy(w, src); err != nil {
+					return
+				}
+				_ = w.Flush()
+			}),
+		},
+		{
+			description: "ServeBlocks",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = ServeBlocks(w, &sliceBlockSource{b: content})
+			}),
+		},
+	}
+
+	for i, tt := range tests {
+		sink := &testSink{closed: make(chan struct{})}
+		s := &Server{
+			Handler: Tee(tt.h, func(r *Request) io.WriteCloser {
+				return sink
+			}),
+			DisableDally: true,
+		}
+
+		addr, done := testServe(t, s)
+		got, err := testGet(t, addr, "foo")
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		select {
+		case <-sink.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, sink was not closed", i, tt.description)
+		}
+		done()
+
+		if want := content; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content sent to client", i, tt.description)
+		}
+		if want, got := content, sink.buf.Bytes(); !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content written to sink", i, tt.description)
+		}
+	}
+}
+
+// Test_teeResponseWriterInterfaces verifies that teeResponseWriter forwards
+// the optional interfaces implemented by the default ResponseWriter.
+func Test_teeResponseWriterInterfaces(t *testing.T) {
+	var w ResponseWriter = &teeResponseWriter{}
+
+	if _, ok := w.(io.ReaderFrom); !ok {
+		t.Fatal("teeResponseWriter does not implement io.ReaderFrom")
+	}
+	if _, ok := w.(BlockWriter); !ok {
+		t.Fatal("teeResponseWriter does not implement BlockWriter")
+	}
+	if _, ok := w.(blockServer); !ok {
+		t.Fatal("teeResponseWriter does not implement blockServer")
+	}
+	if _, ok := w.(resumer); !ok {
+		t.Fatal("teeResponseWriter does not implement resumer")
+	}
+	if _, ok := w.(skipper); !ok {
+		t.Fatal("teeResponseWriter does not implement skipper")
+	}
+	if _, ok := w.(errorReporter); !ok {
+		t.Fatal("teeResponseWriter does not implement errorReporter")
+	}
+}
+
+// sliceBlockSource is a BlockSource which serves the blocks of a byte slice.
+type sliceBlockSource struct {
+	b []byte
+}
+
+func (s *sliceBlockSource) ReadBlock(block uint16, buf []byte) (int, bool, error) {
+	off := (int(block) - 1) * len(buf)
+	n := copy(buf, s.b[off:])
+	return n, off+n == len(s.b), nil
+}
+
+// testSink is an io.WriteCloser which captures all bytes written to it, and
+// signals when it is closed.
+type testSink struct {
+	buf    bytes.Buffer
+	closed chan struct{}
+}
+
+func (s *testSink) Write(b []byte) (int, error) { return s.buf.Write(b) }
+func (s *testSink) Close() error                { close(s.closed); return nil }
+
+// TestMultiWriterHandler verifies that MultiWriterHandler writes the content
+// of a write request to every sink, aborts the transfer if any sink fails,
+// and closes every sink.
+func TestMultiWriterHandler(t *testing.T) {
+	content := bytes.Repeat([]byte("abc"), 1000)
+
+	var tests = []struct {
+		description string
+		fail        error
+		err         *ErrorPacket
+		report      bool
+	}{
+		{
+			description: "all sinks succeed",
+		},
+		{
+			description: "one sink fails, disk full",
+			fail: &os.PathError{
+				Op:   "write",
+				Path: "/srv/replica/foo",
+				Err:  syscall.ENOSPC,
+			},
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeDiskFull,
+				ErrorMsg:  syscall.ENOSPC.Error(),
+			},
+		},
+		{
+			description: "one sink fails, remote unavailable",
+			fail:        errors.New("replica 10.0.0.5 unavailable"),
+			err:         errSinkUnavailable,
+			report:      true,
+		},
+	}
+
+	for i, tt := range tests {
+		sinks := []*testSink{
+			{closed: make(chan struct{})},
+			{closed: make(chan struct{})},
+		}
+
+		fns := []func(r *Request) io.WriteCloser{
+			func(_ *Request) io.WriteCloser { return sinks[0] },
+			func(_ *Request) io.WriteCloser { return nil },
+			func(_ *Request) io.WriteCloser { return sinks[1] },
+		}
+		if tt.fail != nil {
+			fns = append(fns, func(_ *Request) io.WriteCloser {
+				return nopWriteCloser{errWriter{err: tt.fail}}
+			})
+		}
+
+		s := &Server{
+			Handler:      MultiWriterHandler(fns...),
+			DisableDally: true,
+		}
+		errs := s.Errors()
+
+		addr, done := testServe(t, s)
+		err := (&Client{}).Put(addr.String(), "foo", bytes.NewReader(content))
+
+		for _, sink := range sinks {
+			select {
+			case <-sink.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("[%02d] test %q, sink was not closed", i, tt.description)
+			}
+		}
+		done()
+
+		if tt.err != nil {
+			if want, got := tt.err, err; !reflect.DeepEqual(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.description, want, got)
+			}
+
+			var reported bool
+			for len(errs) > 0 {
+				if strings.Contains((<-errs).Error(), "10.0.0.5") {
+					reported = true
+				}
+			}
+			if want, got := tt.report, reported; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error report: %v != %v",
+					i, tt.description, want, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		for j, sink := range sinks {
+			if want, got := content, sink.buf.Bytes(); !bytes.Equal(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected content written to sink %d",
+					i, tt.description, j)
+			}
+		}
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
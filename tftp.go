@@ -3,6 +3,9 @@ package tftp
 
 import (
 	"bytes"
+	"hash"
+	"net"
+	"time"
 )
 
 //go:generate stringer -output=string.go -type=ErrorCode,Opcode
@@ -21,6 +24,7 @@ const (
 	// Opcode types only used for internal communication
 	opcodeDATA Opcode = 3
 	opcodeACK  Opcode = 4
+	opcodeOACK Opcode = 6
 )
 
 // Mode represents a TFTP transfer mode, as defined in RFC 1350, Section 1.
@@ -52,6 +56,10 @@ const (
 	ErrorCodeUnknownTransferID ErrorCode = 5
 	ErrorCodeFileExists        ErrorCode = 6
 	ErrorCodeNoSuchUser        ErrorCode = 7
+
+	// ErrorCodeBadOptions is taken from RFC 2347, and indicates that a
+	// transfer should be terminated due to option negotiation.
+	ErrorCodeBadOptions ErrorCode = 8
 )
 
 // Handler provides an interface which allows structs to act as TFTP server
@@ -72,12 +80,49 @@ func (f HandlerFunc) ServeTFTP(w ResponseWriter, r *Request) {
 	f(w, r)
 }
 
+// HandlerError provides an interface which allows structs to act as TFTP
+// server handlers which can abort a transfer by returning an error.  If the
+// returned error is an *ErrorPacket, its code and message are sent to the
+// client.  Otherwise, ErrorCodeUndefined and the error's message are sent.
+//
+// Because its ServeTFTP method differs from Handler's, a HandlerError must be
+// wrapped using HandleErrors before it can be used by a Server.
+type HandlerError interface {
+	ServeTFTP(ResponseWriter, *Request) error
+}
+
+// HandlerErrorFunc is an adapter type which allows the use of normal
+// functions as TFTP handlers which return errors.
+type HandlerErrorFunc func(ResponseWriter, *Request) error
+
+// ServeTFTP calls f(w, r), allowing regular functions to implement
+// HandlerError.
+func (f HandlerErrorFunc) ServeTFTP(w ResponseWriter, r *Request) error {
+	return f(w, r)
+}
+
+// HandleErrors returns a Handler which calls h, and if h returns an error,
+// sends an ERROR packet to the client and closes the ResponseWriter.
+func HandleErrors(h HandlerError) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if err := h.ServeTFTP(w, r); err != nil {
+			writeError(w, err)
+			_ = w.Close()
+		}
+	})
+}
+
 // ResponseWriter provides an interface which allows a TFTP handler to write
 // TFTP data packets to a client.  The default ResponseWriter binds a new UDP
 // socket to communicate with a client, and closes it when Close is called.
 //
 // ResponseWriter implementations should buffer some data internally, in order
 // to send 512 byte blocks in a "lock-step" fashion to a client.
+//
+// A ResponseWriter is not safe for concurrent use by multiple goroutines.  The
+// default ResponseWriter detects concurrent calls to Write, Flush, and
+// WriteBlocks, and returns ErrConcurrentWrite rather than corrupting the
+// transfer.
 type ResponseWriter interface {
 	// Write implements io.Writer, and allows raw data to be sent to a client.
 	Write([]byte) (int, error)
@@ -89,6 +134,94 @@ type ResponseWriter interface {
 	// Flush flushes any buffered data to a client, signaling the end of data
 	// transfer.
 	Flush() error
+
+	// Options returns the map of options which will be acknowledged to the
+	// client, as described in RFC 2347.  Changing the map after the first
+	// call to Write or Flush has no effect.
+	Options() map[string]string
+
+	// WriteError sends an ERROR packet to a client, indicating that the
+	// transfer cannot continue.
+	WriteError(code ErrorCode, msg string) error
+
+	// Stats returns statistics about the transfer in progress.
+	Stats() TransferStats
+
+	// Cancel silently aborts the transfer, closing the underlying UDP
+	// socket immediately without sending any further packets to the
+	// client.  Close should not be called after Cancel.
+	Cancel() error
+
+	// LocalAddr returns the local network address of the socket used to
+	// communicate with the client, which contains the server's transfer ID.
+	// The socket is bound if it has not been already.  If the socket
+	// cannot be bound, LocalAddr returns nil.
+	LocalAddr() net.Addr
+
+	// SetMinBlockInterval sets the minimum amount of time between the
+	// sending of consecutive DATA blocks for this transfer, so that a
+	// transfer takes a predictable minimum amount of time.  The interval
+	// also applies between blocks in the same window when the windowsize
+	// option is in use.  An interval of zero or less disables pacing.
+	// Retransmissions are not delayed.
+	SetMinBlockInterval(d time.Duration)
+
+	// Checksum attaches h to this transfer, so that h is updated with the
+	// content of each DATA packet exchanged with the client, as it appears
+	// on the wire, but before any compression.  Each block is added once it
+	// is acknowledged, even if it is retransmitted.  For netascii mode
+	// transfers, h receives the content after conversion to netascii, which
+	// differs from the handler's content if any line endings were
+	// converted.  The digest computed by h is reported by Stats.  Checksum
+	// must be called before any data is exchanged.
+	Checksum(h hash.Hash)
+}
+
+// BlockWriter is an optional interface which may be implemented by a
+// ResponseWriter.  WriteBlocks sends the entire contents of p to a client
+// without additional buffering, and ends the transfer.  BlockWriter is useful
+// for handlers which already have all of their content in memory.
+type BlockWriter interface {
+	WriteBlocks(p []byte) error
+}
+
+// BlockSource is implemented by content which is naturally addressed by
+// block, such as rows in a database or ranges of an object, and is sent to a
+// client using ServeBlocks.
+//
+// ReadBlock reads the content of the specified block into buf, which is the
+// size of the transfer's block size, and returns the number of bytes read.
+// Blocks are numbered from 1, in the same way as DATA packets, and the block
+// number wraps around to 0 after block 65535.  ReadBlock must fill buf
+// unless it returns the final block of the content, which it reports by
+// returning true for last.  A block shorter than buf also ends the transfer.
+type BlockSource interface {
+	ReadBlock(block uint16, buf []byte) (n int, last bool, err error)
+}
+
+// TransferStats contains statistics about a single TFTP transfer.
+type TransferStats struct {
+	// Retransmits is the number of times a DATA packet was sent again,
+	// due to a timeout or a duplicate ACK from the client.
+	Retransmits int
+
+	// Bytes is the number of bytes of content which have been sent to or
+	// received from the client.  Transfers larger than 4 GiB are permitted,
+	// as block numbers wrap around to zero after block 65535.
+	Bytes int64
+
+	// StartTime is the time at which the transfer began, once the first
+	// packet is about to be exchanged with the client.  EndTime is the time
+	// at which the transfer ended, once the final block is exchanged, the
+	// transfer fails, or the transfer is closed early.  Each is the zero
+	// time until the corresponding event occurs.
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Checksum is the digest of the content exchanged so far, computed by
+	// the hash.Hash passed to ResponseWriter.Checksum, or nil if no hash
+	// was attached.
+	Checksum []byte
 }
 
 // fromNetASCII performs the necessary conversions from an input buffer
@@ -48,3 +48,48 @@ func Test_fromNetASCII(t *testing.T) {
 		}
 	}
 }
+
+// TestOpcodeString verifies that Opcode.String returns the expected name
+// for each Opcode.
+func TestOpcodeString(t *testing.T) {
+	var tests = []struct {
+		op Opcode
+		s  string
+	}{
+		{OpcodeRead, "OpcodeRead"},
+		{OpcodeWrite, "OpcodeWrite"},
+		{opcodeDATA, "opcodeDATA"},
+		{opcodeACK, "opcodeACK"},
+		{OpcodeError, "OpcodeError"},
+		{opcodeOACK, "opcodeOACK"},
+		{Opcode(7), "Opcode(7)"},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.s, tt.op.String(); want != got {
+			t.Fatalf("[%02d] unexpected Opcode string: %q != %q",
+				i, want, got)
+		}
+	}
+}
+
+// TestErrorCodeString verifies that ErrorCode.String returns the expected
+// name for each ErrorCode, and the numeric value for unknown ErrorCodes.
+func TestErrorCodeString(t *testing.T) {
+	var tests = []struct {
+		code ErrorCode
+		s    string
+	}{
+		{ErrorCodeUndefined, "ErrorCodeUndefined"},
+		{ErrorCodeNoSuchUser, "ErrorCodeNoSuchUser"},
+		{ErrorCodeBadOptions, "ErrorCodeBadOptions"},
+		{ErrorCode(42), "ErrorCode(42)"},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.s, tt.code.String(); want != got {
+			t.Fatalf("[%02d] unexpected ErrorCode string: %q != %q",
+				i, want, got)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package tftptest provides utilities for testing TFTP handlers.
+//
+// The design of this package is inspired by Go's net/http/httptest package.
+package tftptest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/tftp"
+)
+
+// blockSize is the block size used by the loopback client, which does not
+// negotiate any options.
+const blockSize = tftp.DefaultBlockSize
+
+// A GetFunc sends a read request for the named file to a server, and returns
+// the content sent in reply.
+type GetFunc func(filename string) ([]byte, error)
+
+// A PutFunc sends a write request for the named file to a server, followed by
+// data.
+type PutFunc func(filename string, data []byte) error
+
+// Loopback starts a TFTP server on the localhost interface which uses h to
+// handle requests, and returns functions which act as a client of that
+// server.  If the server rejects a request, the returned error is a
+// *tftp.ErrorPacket.
+//
+// The cleanup function stops the server, and should be called once all
+// requests are complete.  Loopback panics if the server cannot be started.
+func Loopback(h tftp.Handler) (get GetFunc, put PutFunc, cleanup func()) {
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("tftptest: failed to listen: %v", err))
+	}
+
+	s := &tftp.Server{
+		Addr:    p.LocalAddr().String(),
+		Handler: h,
+
+		// Packets are not lost on the loopback interface, so there is
+		// no need to wait for retransmissions once a transfer ends
+		DisableDally: true,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(p)
+	}()
+
+	addr := p.LocalAddr().String()
+	c := &tftp.Client{}
+
+	get = func(filename string) ([]byte, error) {
+		var b bytes.Buffer
+		if _, err := c.Get(addr, filename, &b); err != nil {
+			return nil, err
+		}
+
+		return b.Bytes(), nil
+	}
+
+	put = func(filename string, data []byte) error {
+		return c.Put(addr, filename, bytes.NewReader(data))
+	}
+
+	cleanup = func() {
+		_ = p.Close()
+		<-done
+	}
+
+	return get, put, cleanup
+}
@@ -0,0 +1,131 @@
+package tftptest
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/mdlayher/tftp"
+)
+
+// TestLoopbackGet verifies that Loopback performs a complete read request
+// round trip with a handler.
+func TestLoopbackGet(t *testing.T) {
+	var tests = []struct {
+		description string
+		content     []byte
+	}{
+		{
+			description: "empty",
+		},
+		{
+			description: "short block",
+			content:     []byte("hello world"),
+		},
+		{
+			description: "exact block multiple",
+			content:     bytes.Repeat([]byte{'a'}, 2*blockSize),
+		},
+		{
+			description: "many blocks",
+			content:     bytes.Repeat([]byte("abc"), 1000),
+		},
+	}
+
+	for i, tt := range tests {
+		get, _, cleanup := Loopback(tftp.HandlerFunc(func(w tftp.ResponseWriter, r *tftp.Request) {
+			_ = tftp.ServeContent(w, r, bytes.NewReader(tt.content))
+		}))
+
+		got, err := get("file")
+		cleanup()
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		if want := tt.content; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestLoopbackPut verifies that Loopback performs a complete write request
+// round trip with a handler.
+func TestLoopbackPut(t *testing.T) {
+	var tests = []struct {
+		description string
+		content     []byte
+	}{
+		{
+			description: "empty",
+		},
+		{
+			description: "short block",
+			content:     []byte("hello world"),
+		},
+		{
+			description: "exact block multiple",
+			content:     bytes.Repeat([]byte{'a'}, 2*blockSize),
+		},
+	}
+
+	for i, tt := range tests {
+		var (
+			mu       sync.Mutex
+			filename string
+			buf      bytes.Buffer
+		)
+
+		_, put, cleanup := Loopback(tftp.HandlerFunc(func(w tftp.ResponseWriter, r *tftp.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			filename = r.Filename
+			_, _ = tftp.ReceiveContent(w, r, &buf)
+			_ = w.Close()
+		}))
+
+		err := put("upload", tt.content)
+		cleanup()
+		if err != nil {
+			t.Fatalf("[%02d] test %q, unexpected error: %v", i, tt.description, err)
+		}
+
+		mu.Lock()
+		if want, got := "upload", filename; want != got {
+			t.Fatalf("[%02d] test %q, unexpected filename: %q != %q",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.content, buf.Bytes(); !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected content:\n- want: %v\n-  got: %v",
+				i, tt.description, want, got)
+		}
+		mu.Unlock()
+	}
+}
+
+// TestLoopbackError verifies that Loopback reports an ERROR packet sent by
+// a handler as a *tftp.ErrorPacket.
+func TestLoopbackError(t *testing.T) {
+	get, put, cleanup := Loopback(tftp.HandlerFunc(func(w tftp.ResponseWriter, r *tftp.Request) {
+		_ = w.WriteError(tftp.ErrorCodeFileNotFound, "not found")
+	}))
+	defer cleanup()
+
+	want := &tftp.ErrorPacket{
+		Opcode:    tftp.OpcodeError,
+		ErrorCode: tftp.ErrorCodeFileNotFound,
+		ErrorMsg:  "not found",
+	}
+
+	_, err := get("file")
+	if got, ok := err.(*tftp.ErrorPacket); !ok || *got != *want {
+		t.Fatalf("unexpected get error: %v != %v", want, err)
+	}
+
+	err = put("file", []byte("hello"))
+	if got, ok := err.(*tftp.ErrorPacket); !ok || *got != *want {
+		t.Fatalf("unexpected put error: %v != %v", want, err)
+	}
+}
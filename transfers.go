@@ -0,0 +1,244 @@
+package tftp
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// TransferInfo describes a transfer which is in progress.
+type TransferInfo struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr net.Addr
+
+	// Opcode and Filename are taken from the client's request.
+	Opcode   Opcode
+	Filename string
+
+	// Bytes is the number of bytes of content sent to the client for a
+	// read request, or received from the client for a write request.
+	Bytes int64
+
+	// Duration is the amount of time since the transfer began.
+	Duration time.Duration
+}
+
+// transferRecord is the JSON representation of a completed transfer, which
+// is written to a Server's TransferLog.
+type transferRecord struct {
+	Filename    string  `json:"filename"`
+	Mode        Mode    `json:"mode"`
+	Opcode      string  `json:"opcode"`
+	RemoteAddr  string  `json:"remote_addr"`
+	LocalAddr   string  `json:"local_addr,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	Duration    float64 `json:"duration_seconds"`
+	Retransmits int     `json:"retransmits"`
+
+	// Result is "ok" if the transfer succeeded, or "error" otherwise.  If
+	// the transfer ended with an ERROR packet, its code and message are
+	// included.
+	Result    string     `json:"result"`
+	ErrorCode *ErrorCode `json:"error_code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// transfer is an entry in a Server's registry of active transfers.
+type transfer struct {
+	r     *Request
+	w     *bufferedSocketResponseWriter
+	start time.Time
+}
+
+// ActiveTransfers returns a snapshot of the transfers which are currently
+// being handled by the server, ordered by the time each transfer began, and
+// then by the client's address.  The snapshot is taken atomically, so each
+// transfer appears exactly once, even if transfers begin or end while the
+// snapshot is taken.
+func (s *Server) ActiveTransfers() []TransferInfo {
+	s.mu.Lock()
+	ts := make([]*transfer, 0, len(s.transfers))
+	for t := range s.transfers {
+		ts = append(ts, t)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ts, func(i, j int) bool {
+		if !ts[i].start.Equal(ts[j].start) {
+			return ts[i].start.Before(ts[j].start)
+		}
+
+		return ts[i].w.remoteAddr.String() < ts[j].w.remoteAddr.String()
+	})
+
+	now := time.Now()
+	infos := make([]TransferInfo, 0, len(ts))
+	for _, t := range ts {
+		infos = append(infos, TransferInfo{
+			RemoteAddr: t.w.remoteAddr,
+			Opcode:     t.r.Opcode,
+			Filename:   t.r.Filename,
+			Bytes:      atomic.LoadInt64(&t.w.bytes),
+			Duration:   now.Sub(t.start),
+		})
+	}
+
+	return infos
+}
+
+// AbortClient aborts all transfers in progress with the client at addr, and
+// returns the number of transfers aborted.  If addr is a *net.UDPAddr with
+// port 0, transfers with the client on any port are aborted.
+//
+// The next time an aborted transfer would exchange a packet with the client,
+// it sends an ERROR packet instead, and the call to its ResponseWriter fails,
+// so that the handler can return and close the transfer socket.  A transfer
+// waiting for a reply from the client is interrupted immediately.
+func (s *Server) AbortClient(addr net.Addr) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for t := range s.transfers {
+		if !matchClient(addr, t.w.remoteAddr) {
+			continue
+		}
+
+		t.w.abort()
+		n++
+	}
+
+	return n
+}
+
+// matchClient reports whether the remote address of a transfer matches addr.
+func matchClient(addr net.Addr, remote net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || ua.Port != 0 {
+		return addr.String() == remote.String()
+	}
+
+	ra, ok := remote.(*net.UDPAddr)
+	return ok && ua.IP.Equal(ra.IP)
+}
+
+// reserveClient reserves the address of the client which sent the request
+// handled by c, and reports whether it was reserved.  An address cannot be
+// reserved while it is reserved by another request, or while a transfer is
+// in progress with the client.  A transfer whose final block has been sent
+// is no longer in progress, even if its handler has not yet returned, so that
+// a client may begin another transfer from the same address as soon as it
+// receives the final block of its previous transfer.
+//
+// The check and the reservation are made atomically, so that only one of
+// several requests received from a client at once can begin a transfer.
+func (s *Server) reserveClient(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := c.remoteAddr.String()
+	if _, ok := s.reserved[key]; ok {
+		return false
+	}
+
+	for t := range s.transfers {
+		if atomic.LoadInt32(&t.w.final) == 0 && matchClient(c.remoteAddr, t.w.remoteAddr) {
+			return false
+		}
+	}
+
+	if s.reserved == nil {
+		s.reserved = make(map[string]*conn)
+	}
+	s.reserved[key] = c
+
+	return true
+}
+
+// releaseClient releases the address reserved by c using reserveClient, if
+// it is still reserved by c.  Calling releaseClient more than once has no
+// effect.
+func (s *Server) releaseClient(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := c.remoteAddr.String()
+	if s.reserved[key] == c {
+		delete(s.reserved, key)
+	}
+}
+
+// track adds a transfer to the server's registry of active transfers, and
+// returns a function which removes it once the transfer is complete.
+func (s *Server) track(r *Request, w *bufferedSocketResponseWriter) func() {
+	t := &transfer{
+		r:     r,
+		w:     w,
+		start: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.transfers == nil {
+		s.transfers = make(map[*transfer]struct{})
+	}
+	s.transfers[t] = struct{}{}
+
+	return func() {
+		s.mu.Lock()
+		delete(s.transfers, t)
+		s.mu.Unlock()
+
+		if s.TransferLog != nil {
+			s.logTransfer(t)
+		}
+		if s.OnComplete != nil {
+			s.OnComplete(r, w.Stats(), w.result())
+		}
+	}
+}
+
+// logTransfer writes a record of the completed transfer t to the server's
+// TransferLog.
+func (s *Server) logTransfer(t *transfer) {
+	rec := transferRecord{
+		Filename:    t.r.Filename,
+		Mode:        t.r.Mode,
+		Opcode:      t.r.Opcode.String(),
+		RemoteAddr:  t.w.remoteAddr.String(),
+		Bytes:       atomic.LoadInt64(&t.w.bytes),
+		Duration:    time.Since(t.start).Seconds(),
+		Retransmits: t.w.stats.Retransmits,
+		Result:      "ok",
+	}
+
+	// The transfer socket may never have been bound
+	if c := t.w.conn; c != nil {
+		rec.LocalAddr = c.LocalAddr().String()
+	}
+
+	if err := t.w.err; err != nil {
+		rec.Result = "error"
+		rec.Error = err.Error()
+		if p, ok := err.(*ErrorPacket); ok {
+			rec.ErrorCode = &p.ErrorCode
+			rec.Error = p.ErrorMsg
+		}
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		s.logf("tftp: failed to encode transfer record: %v", err)
+		return
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	if _, err := s.TransferLog.Write(append(b, '\n')); err != nil {
+		s.logf("tftp: failed to write transfer record: %v", err)
+	}
+}
@@ -0,0 +1,554 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestServerActiveTransfers verifies that a Server reports a transfer while
+// it is in progress, and stops reporting it once it is complete.
+func TestServerActiveTransfers(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			_, _ = w.Write(bytes.Repeat([]byte{'a'}, DefaultBlockSize))
+			<-release
+			_ = w.Flush()
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	errC := make(chan error, 1)
+	go func() {
+		// testGet cannot be used here, since it calls t.Fatal
+		_, err := (&Client{}).Get(addr.String(), "foo", ioutil.Discard)
+		errC <- err
+	}()
+
+	// Wait for the first block to be acknowledged
+	var infos []TransferInfo
+	for i := 0; i < 100; i++ {
+		infos = s.ActiveTransfers()
+		if len(infos) == 1 && infos[0].Bytes == DefaultBlockSize {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if want, got := 1, len(infos); want != got {
+		t.Fatalf("unexpected number of active transfers: %v != %v", want, got)
+	}
+
+	info := infos[0]
+	if want, got := "foo", info.Filename; want != got {
+		t.Fatalf("unexpected filename: %q != %q", want, got)
+	}
+	if want, got := OpcodeRead, info.Opcode; want != got {
+		t.Fatalf("unexpected opcode: %v != %v", want, got)
+	}
+	if want, got := int64(DefaultBlockSize), info.Bytes; want != got {
+		t.Fatalf("unexpected number of bytes: %v != %v", want, got)
+	}
+	if info.RemoteAddr == nil || info.Duration <= 0 {
+		t.Fatalf("unexpected transfer info: %+v", info)
+	}
+
+	close(release)
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+
+	// The transfer is removed once the handler returns
+	for i := 0; i < 100; i++ {
+		if len(s.ActiveTransfers()) == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("transfer still active: %+v", s.ActiveTransfers())
+}
+
+// TestServerActiveTransfersOrder verifies that a Server reports concurrent
+// transfers exactly once each, ordered by the time each transfer began.
+func TestServerActiveTransfersOrder(t *testing.T) {
+	const n = 5
+
+	release := make(chan struct{})
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			defer w.Close()
+
+			_, _ = w.Write(bytes.Repeat([]byte{'a'}, DefaultBlockSize))
+			<-release
+			_ = w.Flush()
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	errC := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := (&Client{}).Get(addr.String(), "foo", ioutil.Discard)
+			errC <- err
+		}()
+	}
+
+	// Wait for the first block of every transfer to be acknowledged
+	var infos []TransferInfo
+	for i := 0; i < 100; i++ {
+		infos = s.ActiveTransfers()
+
+		var sent int
+		for _, info := range infos {
+			if info.Bytes == DefaultBlockSize {
+				sent++
+			}
+		}
+		if sent == n {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if want, got := n, len(infos); want != got {
+		t.Fatalf("unexpected number of active transfers: %v != %v", want, got)
+	}
+
+	seen := make(map[string]bool)
+	for i, info := range infos {
+		addr := info.RemoteAddr.String()
+		if seen[addr] {
+			t.Fatalf("duplicate transfer for %s", addr)
+		}
+		seen[addr] = true
+
+		if i == 0 {
+			continue
+		}
+
+		// Transfers which began earlier have been in progress for longer
+		prev := infos[i-1]
+		if prev.Duration < info.Duration {
+			t.Fatalf("transfers not ordered by start time: %+v", infos)
+		}
+	}
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestServerAbortClient verifies that a Server aborts a transfer in progress
+// with a client, informing the client with an ERROR packet.
+func TestServerAbortClient(t *testing.T) {
+	errC := make(chan error, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			err := ServeContent(w, r, bytes.NewReader(make([]byte, 10*DefaultBlockSize)))
+			_ = w.Close()
+			errC <- err
+		}),
+		DisableDally: true,
+	}
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Receive the first block, but never acknowledge it
+	b := make([]byte, 1024)
+	if _, _, err := c.ReadFrom(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// No transfers with other clients are aborted
+	if want, got := 0, s.AbortClient(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}); want != got {
+		t.Fatalf("unexpected number of aborted transfers: %v != %v", want, got)
+	}
+	if want, got := 1, s.AbortClient(c.LocalAddr()); want != got {
+		t.Fatalf("unexpected number of aborted transfers: %v != %v", want, got)
+	}
+
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := parseErrorPacket(b[:n]).(*ErrorPacket); !ok || e.ErrorCode != ErrorCodeUndefined {
+		t.Fatalf("expected ERROR packet, but got: %v", b[:n])
+	}
+
+	if want, got := errTransferAborted, <-errC; want != got {
+		t.Fatalf("unexpected handler error: %v != %v", want, got)
+	}
+
+	for i := 0; i < 100; i++ {
+		if len(s.ActiveTransfers()) == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("transfer still active: %+v", s.ActiveTransfers())
+}
+
+// TestServerTransferLog verifies that a Server writes a JSON record of each
+// completed transfer to its TransferLog.
+func TestServerTransferLog(t *testing.T) {
+	var tests = []struct {
+		description string
+		h           Handler
+		fields      map[string]interface{}
+	}{
+		{
+			description: "OK",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = ServeContent(w, r, bytes.NewReader([]byte("hello")))
+			}),
+			fields: map[string]interface{}{
+				"bytes":  float64(5),
+				"result": "ok",
+			},
+		},
+		{
+			description: "file not found",
+			h: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = w.WriteError(ErrorCodeFileNotFound, "not found")
+			}),
+			fields: map[string]interface{}{
+				"bytes":      float64(0),
+				"result":     "error",
+				"error_code": float64(ErrorCodeFileNotFound),
+				"error":      "not found",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		lw := make(chanWriter, 1)
+		s := &Server{
+			Handler:      tt.h,
+			DisableDally: true,
+			TransferLog:  lw,
+		}
+
+		addr, done := testServe(t, s)
+		_, _ = testGet(t, addr, "foo")
+
+		var b []byte
+		select {
+		case b = <-lw:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, timed out waiting for transfer record",
+				i, tt.description)
+		}
+		done()
+
+		if b[len(b)-1] != '\n' {
+			t.Fatalf("[%02d] test %q, transfer record must end with a newline: %q",
+				i, tt.description, b)
+		}
+
+		var rec map[string]interface{}
+		if err := json.Unmarshal(b, &rec); err != nil {
+			t.Fatalf("[%02d] test %q, failed to decode transfer record: %v",
+				i, tt.description, err)
+		}
+
+		fields := map[string]interface{}{
+			"filename":    "foo",
+			"mode":        string(ModeOctet),
+			"opcode":      OpcodeRead.String(),
+			"retransmits": float64(0),
+		}
+		for k, v := range tt.fields {
+			fields[k] = v
+		}
+
+		for k, want := range fields {
+			if got := rec[k]; want != got {
+				t.Fatalf("[%02d] test %q, unexpected %q field: %v != %v",
+					i, tt.description, k, want, got)
+			}
+		}
+
+		for _, k := range []string{"remote_addr", "duration_seconds"} {
+			if _, ok := rec[k]; !ok {
+				t.Fatalf("[%02d] test %q, missing %q field: %s",
+					i, tt.description, k, b)
+			}
+		}
+	}
+}
+
+// TestServerOnComplete verifies that a Server calls OnComplete with the
+// result of each transfer once its handler returns.
+func TestServerOnComplete(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1000)
+
+	var tests = []struct {
+		description string
+		get         func(t *testing.T, addr net.Addr)
+		ok          bool
+	}{
+		{
+			description: "complete",
+			get: func(t *testing.T, addr net.Addr) {
+				_, _ = testGet(t, addr, "foo")
+			},
+			ok: true,
+		},
+		{
+			description: "client disappears",
+			get: func(t *testing.T, addr net.Addr) {
+				// Receive the first block, but never acknowledge it
+				_ = testExchange(t, addr, testRRQ("foo"))
+			},
+		},
+	}
+
+	type result struct {
+		stats TransferStats
+		err   error
+	}
+
+	for i, tt := range tests {
+		results := make(chan result, 1)
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				_ = ServeContent(w, r, bytes.NewReader(content))
+				_ = w.Close()
+			}),
+			DisableDally:      true,
+			RetransmitTimeout: 20 * time.Millisecond,
+			TransferTimeout:   200 * time.Millisecond,
+			OnComplete: func(r *Request, stats TransferStats, err error) {
+				results <- result{stats: stats, err: err}
+			},
+		}
+
+		addr, done := testServe(t, s)
+		tt.get(t, addr)
+
+		var res result
+		select {
+		case res = <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, timed out waiting for OnComplete",
+				i, tt.description)
+		}
+		done()
+
+		if want, got := tt.ok, res.err == nil; want != got {
+			t.Fatalf("[%02d] test %q, unexpected transfer result: %v",
+				i, tt.description, res.err)
+		}
+		if !tt.ok {
+			continue
+		}
+
+		if want, got := int64(len(content)), res.stats.Bytes; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// chanWriter is an io.Writer which sends a copy of each write on a channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// TestServerDuplicateRequest verifies that a Server does not start a
+// competing transfer when a client with a transfer in progress sends another
+// request to the server's main port.
+func TestServerDuplicateRequest(t *testing.T) {
+	var tests = []struct {
+		description string
+		reject      bool
+		err         error
+	}{
+		{
+			description: "discarded",
+		},
+		{
+			description: "rejected",
+			reject:      true,
+			err: &ErrorPacket{
+				Opcode:    OpcodeError,
+				ErrorCode: ErrorCodeIllegalOperation,
+				ErrorMsg:  "transfer already in progress",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		var calls int32
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		s := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					close(started)
+					<-release
+				}
+			}),
+			RejectDuplicateRequests: tt.reject,
+		}
+		errC := s.Errors()
+
+		addr, done := testServe(t, s)
+
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, timed out waiting for handler",
+				i, tt.description)
+		}
+
+		// A stray copy of the request from the same client must not start
+		// another transfer
+		if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errC:
+			if !errors.Is(err, errDuplicateRequest) {
+				t.Fatalf("[%02d] test %q, unexpected error: %v",
+					i, tt.description, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%02d] test %q, timed out waiting for error",
+				i, tt.description)
+		}
+
+		if tt.err != nil {
+			if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 1500)
+			n, _, err := c.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := tt.err, parseErrorPacket(buf[:n]); !reflect.DeepEqual(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected reply: %v != %v",
+					i, tt.description, want, got)
+			}
+		}
+
+		close(release)
+		_ = c.Close()
+		done()
+
+		if want, got := int32(1), atomic.LoadInt32(&calls); want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of handler calls: %d != %d",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// TestServerDuplicateRequestConcurrent verifies that a Server starts only a
+// single transfer when a client sends several requests at once, before any
+// of them begins a transfer.
+func TestServerDuplicateRequestConcurrent(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	s := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+		}),
+
+		// Delay each request before its transfer begins, so that both
+		// requests are received while neither is in progress
+		RewriteFilename: func(filename string) string {
+			time.Sleep(50 * time.Millisecond)
+			return filename
+		},
+	}
+	errC := s.Errors()
+
+	addr, done := testServe(t, s)
+	defer done()
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.WriteTo(testRRQ("foo"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-errC:
+		if !errors.Is(err, errDuplicateRequest) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// Allow time for a competing transfer to begin, if one was started
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if want, got := int32(1), atomic.LoadInt32(&calls); want != got {
+		t.Fatalf("unexpected number of handler calls: %d != %d", want, got)
+	}
+}